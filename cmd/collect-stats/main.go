@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 
@@ -24,14 +25,21 @@ func loadEnv() {
 
 }
 
+func parseFlags(f *stats.AggregateFlags) {
+	flag.BoolVar(&f.Full, "full", false, "recompute every key from scratch instead of only the keys whose listings changed since the last snapshot set")
+
+	flag.Parse()
+}
+
 func main() {
 	loadEnv()
-
-	collectStats()
+	f := stats.AggregateFlags{}
+	parseFlags(&f)
+	collectStats(&f)
 }
 
-func collectStats() {
-	err := stats.AggregateStats()
+func collectStats(f *stats.AggregateFlags) {
+	err := stats.AggregateStats(f)
 
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	db "github.com/faideww/ffff/internal/db"
+	"github.com/joho/godotenv"
+)
+
+func loadEnv() {
+	env := os.Getenv("GO_ENV")
+	if env == "" {
+		env = "development"
+	}
+
+	godotenv.Load(".env." + env + ".local")
+	if env != "test" {
+		godotenv.Load(".env.local")
+	}
+
+	godotenv.Load(".env." + env)
+	godotenv.Load()
+
+}
+
+type migrateFlags struct {
+	Command string
+	To      int
+	Steps   int
+}
+
+func parseFlags(f *migrateFlags) {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: migrate [flags] up|down|status\n")
+		flag.PrintDefaults()
+	}
+	flag.IntVar(&f.To, "to", 0, "`up` only: stop after applying this migration version (0 applies everything)")
+	flag.IntVar(&f.Steps, "steps", 1, "`down` only: how many of the most recent migrations to revert")
+
+	flag.Parse()
+	f.Command = flag.Arg(0)
+}
+
+func main() {
+	loadEnv()
+	f := migrateFlags{}
+	parseFlags(&f)
+	l := log.New(os.Stdout, "[MIGRATE]", log.Ldate|log.Ltime)
+
+	dbHandle, err := db.DBConnect(os.Getenv("PG_DB_CONNSTR"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dbHandle.Close()
+
+	ctx := context.Background()
+	switch f.Command {
+	case "up":
+		n, err := db.MigrateUp(ctx, dbHandle, f.To, l)
+		if err != nil {
+			log.Fatal(err)
+		}
+		l.Printf("applied %d migrations\n", n)
+		// Partitioned tables only exist once every migration is in
+		if db.CheckSchema(ctx, dbHandle) == nil {
+			created, err := db.EnsurePartitions(ctx, dbHandle, time.Now())
+			if err != nil {
+				log.Fatal(err)
+			}
+			l.Printf("created %d partitions\n", created)
+		}
+	case "down":
+		n, err := db.MigrateDown(ctx, dbHandle, f.Steps, l)
+		if err != nil {
+			log.Fatal(err)
+		}
+		l.Printf("reverted %d migrations\n", n)
+	case "status":
+		if err = printStatus(ctx, dbHandle); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
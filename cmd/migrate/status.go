@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	db "github.com/faideww/ffff/internal/db"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func printStatus(ctx context.Context, dbHandle *pgxpool.Pool) error {
+	migrations, err := db.Migrations()
+	if err != nil {
+		return err
+	}
+	applied, err := db.AppliedMigrations(ctx, dbHandle)
+	if err != nil {
+		return err
+	}
+
+	appliedAt := make(map[int]string, len(applied))
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt.Format("Jan 02, 2006 3:04 PM")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	known := make(map[int]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = true
+		at, ok := appliedAt[m.Version]
+		if !ok {
+			at = "pending"
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", m.Version, m.Name, at)
+	}
+	// Applied by a newer binary than this one
+	for _, a := range applied {
+		if !known[a.Version] {
+			fmt.Fprintf(w, "%04d\t%s\t%s (unknown to this build)\n", a.Version, a.Name, appliedAt[a.Version])
+		}
+	}
+	return w.Flush()
+}
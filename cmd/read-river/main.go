@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	psapi "github.com/faideww/ffff/internal/psapi"
 	"github.com/joho/godotenv"
@@ -27,6 +28,17 @@ func loadEnv() {
 func parseFlags(f *psapi.CliFlags) {
 	flag.BoolVar(&f.StartFromHead, "startFromHead", false, "whether to query the trade api for the river head and begin from there, or resume from the latest changeset in the `changesets` table")
 
+	flag.StringVar(&f.Replay, "replay", "", "read pages recorded with -record from this directory instead of the live API")
+	flag.StringVar(&f.Record, "record", "", "save every page read from the live API into this directory, for -replay")
+
+	flag.StringVar(&f.MetricsAddr, "metricsAddr", "", "serve Prometheus metrics on this address (e.g. :9091)")
+	flag.Float64Var(&f.LagAlertMinutes, "lagAlertMinutes", 30, "alert when the estimated lag behind the river head exceeds this many minutes (0 disables it); alerts are posted to LAG_ALERT_WEBHOOK_URL if set")
+
+	flag.StringVar(&f.HeadProviders, "headProviders", "poeninja,ggg", "where to look up the river head, tried in order (poeninja, ggg)")
+	flag.DurationVar(&f.HeadTimeout, "headTimeout", 10*time.Second, "how long each head provider gets to answer")
+
+	flag.StringVar(&f.Realms, "realms", "pc", "comma-separated realms to read (pc, xbox, sony), each with its own reader; INITIAL_CHANGE_ID_<REALM> sets a realm's starting change id")
+
 	flag.Parse()
 }
 
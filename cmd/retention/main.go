@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	db "github.com/faideww/ffff/internal/db"
+	"github.com/faideww/ffff/internal/retention"
+	"github.com/joho/godotenv"
+)
+
+func loadEnv() {
+	env := os.Getenv("GO_ENV")
+	if env == "" {
+		env = "development"
+	}
+
+	godotenv.Load(".env." + env + ".local")
+	if env != "test" {
+		godotenv.Load(".env.local")
+	}
+
+	godotenv.Load(".env." + env)
+	godotenv.Load()
+
+}
+
+const DAY = 24 * time.Hour
+
+func parseFlags(p *retention.Policy) {
+	var changesetDays, hourlyDays, dailyDays, historyDays, partitionDays int
+	flag.IntVar(&changesetDays, "changesetDays", 7, "roll changesets older than this many days into hourly summaries (0 keeps them all)")
+	flag.IntVar(&hourlyDays, "hourlyDays", 3, "merge snapshots older than this many days into one per key per hour (0 disables)")
+	flag.IntVar(&dailyDays, "dailyDays", 30, "merge hourly snapshots older than this many days into one per key per day (0 disables)")
+	flag.IntVar(&historyDays, "historyDays", 30, "archive and delete delisted listings older than this many days (0 keeps them all)")
+	flag.IntVar(&partitionDays, "partitionDays", 0, "drop monthly partitions of changesets, snapshots and jewel_history that ended more than this many days ago (0 keeps them all)")
+	flag.StringVar(&p.ArchiveDir, "archiveDir", "archive", "directory to write archived listing history to")
+	flag.IntVar(&p.BatchSize, "batchSize", 5000, "rows to process per statement")
+
+	flag.Parse()
+	p.ChangesetRollupAfter = time.Duration(changesetDays) * DAY
+	p.HourlySnapshotsAfter = time.Duration(hourlyDays) * DAY
+	p.DailySnapshotsAfter = time.Duration(dailyDays) * DAY
+	p.ArchiveHistoryAfter = time.Duration(historyDays) * DAY
+	p.DropPartitionsAfter = time.Duration(partitionDays) * DAY
+}
+
+func main() {
+	loadEnv()
+	p := retention.Policy{}
+	parseFlags(&p)
+	l := log.New(os.Stdout, "[RETENTION]", log.Ldate|log.Ltime)
+
+	ctx := context.Background()
+	store, err := db.OpenStore(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	if err = store.CheckSchema(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = retention.Run(ctx, store, p, time.Now(), l); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+
+	db "github.com/faideww/ffff/internal/db"
+	"github.com/faideww/ffff/internal/stats"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	DENDROGRAM_HEIGHT     = 400
+	DENDROGRAM_MARGIN     = 40
+	DENDROGRAM_LEAF_WIDTH = 18
+	DENDROGRAM_MIN_WIDTH  = 600
+)
+
+type svgLine struct {
+	X1, Y1, X2, Y2 float64
+	// Whether the line belongs to a cluster at or below the cut
+	Inlier bool
+}
+
+type svgLabel struct {
+	X, Y float64
+	Text string
+}
+
+type dendrogramPlot struct {
+	Width, Height float64
+	Lines         []svgLine
+	Labels        []svgLabel
+	// Y of the cut line, or -1 if there is no cut
+	CutY float64
+}
+
+type strataRow struct {
+	Level       int
+	Height      float64
+	NumClusters int
+	Silhouette  pgtype.Float8
+	CutScore    pgtype.Float8
+	Chosen      bool
+}
+
+// Lays a dendrogram out as line segments. Leaves are ordered as they appear
+// in the final merged cluster, which keeps every merge's children adjacent,
+// and each merge is drawn as a bracket at its linkage height.
+func layoutDendrogram(strata []stats.DendrogramStrata, prices []float64, cutLevel pgtype.Int4, inliers []float64) dendrogramPlot {
+	n := len(strata[0].Clusters)
+	width := math.Max(DENDROGRAM_MIN_WIDTH, float64(n*DENDROGRAM_LEAF_WIDTH+2*DENDROGRAM_MARGIN))
+	plot := dendrogramPlot{Width: width, Height: DENDROGRAM_HEIGHT + DENDROGRAM_MARGIN, CutY: -1}
+
+	maxHeight := strata[len(strata)-1].Height
+	if maxHeight <= 0 || math.IsInf(maxHeight, 0) {
+		maxHeight = 1
+	}
+	plotHeight := float64(DENDROGRAM_HEIGHT - 2*DENDROGRAM_MARGIN)
+	y := func(h float64) float64 {
+		return DENDROGRAM_MARGIN + (1-h/maxHeight)*plotHeight
+	}
+
+	order := strata[len(strata)-1].Clusters[0]
+	spacing := (width - 2*DENDROGRAM_MARGIN) / float64(max(n-1, 1))
+
+	type node struct{ x, y float64 }
+	key := func(c stats.IndexCluster) string { return fmt.Sprint(c) }
+	nodes := make(map[string]node, 2*n)
+	for pos, idx := range order {
+		x := DENDROGRAM_MARGIN + float64(pos)*spacing
+		nodes[key(stats.IndexCluster{idx})] = node{x, y(0)}
+		label := "?"
+		if idx < len(prices) {
+			label = fmt.Sprintf("%.0f", prices[idx])
+		}
+		plot.Labels = append(plot.Labels, svgLabel{x, y(0) + 12, label})
+	}
+
+	inlierIdx := make(map[int]bool)
+	for i, p := range prices {
+		if slices.Contains(inliers, p) {
+			inlierIdx[i] = true
+		}
+	}
+	isInlier := func(c stats.IndexCluster) bool {
+		for _, idx := range c {
+			if !inlierIdx[idx] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for level := 1; level < len(strata); level++ {
+		current := make(map[string]bool, len(strata[level].Clusters))
+		for _, c := range strata[level].Clusters {
+			current[key(c)] = true
+		}
+
+		// The clusters that disappeared at this level are the ones merged
+		var children []stats.IndexCluster
+		for _, c := range strata[level-1].Clusters {
+			if !current[key(c)] {
+				children = append(children, c)
+			}
+		}
+		if len(children) != 2 {
+			continue
+		}
+
+		merged := strata[level].Clusters[0]
+		h := y(strata[level].Height)
+		inlier := cutLevel.Valid && level <= int(cutLevel.Int32) && isInlier(merged)
+		a, b := nodes[key(children[0])], nodes[key(children[1])]
+		plot.Lines = append(plot.Lines,
+			svgLine{a.x, a.y, a.x, h, inlier},
+			svgLine{b.x, b.y, b.x, h, inlier},
+			svgLine{a.x, h, b.x, h, inlier},
+		)
+		nodes[key(merged)] = node{(a.x + b.x) / 2, h}
+	}
+
+	if cutLevel.Valid && int(cutLevel.Int32)+1 < len(strata) {
+		cut := int(cutLevel.Int32)
+		plot.CutY = y((strata[cut].Height + strata[cut+1].Height) / 2)
+	}
+
+	return plot
+}
+
+// Renders the dendrogram and silhouette scores recorded for a node the last
+// time its window price was computed
+func (s *server) handleDendrogram(w http.ResponseWriter, r *http.Request) {
+	diag, err := s.store.LatestDiagnostics(r.Context(), keyParam(r))
+	if errors.Is(err, db.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	var strata []stats.DendrogramStrata
+	if diag.Dendrogram != nil {
+		if err = json.Unmarshal(diag.Dendrogram, &strata); err != nil {
+			s.fail(w, err)
+			return
+		}
+	}
+
+	var plot *dendrogramPlot
+	var strataRows []strataRow
+	if len(strata) > 0 {
+		p := layoutDendrogram(strata, diag.Prices, diag.CutLevel, diag.InlierPrices)
+		plot = &p
+		for i, st := range strata {
+			row := strataRow{Level: i, Height: st.Height, NumClusters: len(st.Clusters)}
+			if i < len(diag.Silhouettes) {
+				row.Silhouette = diag.Silhouettes[i]
+			}
+			if i < len(diag.CutScores) {
+				row.CutScore = diag.CutScores[i]
+			}
+			row.Chosen = diag.CutLevel.Valid && int(diag.CutLevel.Int32) == i
+			strataRows = append(strataRows, row)
+		}
+	}
+
+	s.render(w, "dendrogram", map[string]any{
+		"Realm":       realmParam(r),
+		"League":      r.PathValue("league"),
+		"Diagnostics": diag,
+		"Plot":        plot,
+		"Strata":      strataRows,
+	})
+}
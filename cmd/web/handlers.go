@@ -0,0 +1,246 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	db "github.com/faideww/ffff/internal/db"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+type server struct {
+	store     db.Store
+	l         *log.Logger
+	templates map[string]*template.Template
+}
+
+type jewelRow struct {
+	db.DBJewel
+	FlagReasons []string
+}
+
+type mainTableRow struct {
+	AllocatedNode string
+	JewelClass    string
+	FleshPrice    float64
+	FlamePrice    float64
+}
+
+func (s *server) render(w http.ResponseWriter, name string, data any) {
+	err := s.templates[name].ExecuteTemplate(w, "root", data)
+	if err != nil {
+		s.l.Printf("failed to render %s: %s\n", name, err)
+		http.Error(w, "failed to render page", http.StatusInternalServerError)
+	}
+}
+
+func (s *server) fail(w http.ResponseWriter, err error) {
+	s.l.Printf("request failed: %s\n", err)
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
+
+func (s *server) writeJSON(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		s.l.Printf("failed to encode response: %s\n", err)
+	}
+}
+
+// Pages and APIs take the realm as ?realm=, defaulting to PC
+func realmParam(r *http.Request) string {
+	if realm := r.URL.Query().Get("realm"); realm != "" {
+		return realm
+	}
+	return "pc"
+}
+
+// The key named by a route's {league}/{jewelType}/{jewelClass}/{node}
+func keyParam(r *http.Request) db.JewelKey {
+	return db.JewelKey{
+		Realm:         realmParam(r),
+		League:        r.PathValue("league"),
+		JewelType:     r.PathValue("jewelType"),
+		JewelClass:    r.PathValue("jewelClass"),
+		AllocatedNode: r.PathValue("node"),
+	}
+}
+
+func (s *server) handleMainTable(w http.ResponseWriter, r *http.Request) {
+	realm := realmParam(r)
+	league := r.URL.Query().Get("league")
+	if league == "" {
+		league = strings.Split(os.Getenv("LEAGUES"), ",")[0]
+	}
+
+	snapshots, err := s.store.LatestSnapshots(r.Context())
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	var jewels []mainTableRow
+	rowIdx := make(map[string]int)
+	for _, snap := range snapshots {
+		if snap.Realm != realm || snap.League != league {
+			continue
+		}
+		key := snap.JewelClass + "_" + snap.AllocatedNode
+		idx, ok := rowIdx[key]
+		if !ok {
+			idx = len(jewels)
+			rowIdx[key] = idx
+			jewels = append(jewels, mainTableRow{AllocatedNode: snap.AllocatedNode, JewelClass: snap.JewelClass})
+		}
+		switch snap.JewelType {
+		case "Forbidden Flesh":
+			jewels[idx].FleshPrice = snap.WindowPrice
+		case "Forbidden Flame":
+			jewels[idx].FlamePrice = snap.WindowPrice
+		}
+	}
+
+	s.render(w, "mainTable", map[string]any{"Jewels": jewels, "Realm": realm, "League": league})
+}
+
+func (s *server) handleDump(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := s.store.LatestSnapshots(r.Context())
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	if r.URL.Query().Get("sort") == "rising" {
+		sortByRising(snapshots)
+	}
+
+	s.render(w, "dump", map[string]any{"Jewels": snapshots})
+}
+
+// Orders snapshots by 24h change, fastest risers first. Snapshots without
+// enough history to have a 24h change go last.
+func sortByRising(snapshots []db.LeagueSnapshot) {
+	slices.SortStableFunc(snapshots, func(a, b db.LeagueSnapshot) int {
+		if a.Change24h.Valid != b.Change24h.Valid {
+			if a.Change24h.Valid {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(b.Change24h.Float64, a.Change24h.Float64)
+	})
+}
+
+func (s *server) handleJewelDump(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	realm := realmParam(r)
+	league, jewelType, node := r.PathValue("league"), r.PathValue("jewelType"), r.PathValue("node")
+
+	dbJewels, err := s.store.NodeJewels(ctx, realm, league, jewelType, node)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	flags, err := s.store.LatestNodeFlags(ctx, realm, league, jewelType, node)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	reasonsByItem := make(map[string][]string, len(flags))
+	for _, f := range flags {
+		reasonsByItem[f.ItemId] = f.Reasons
+	}
+
+	jewels := make([]jewelRow, len(dbJewels))
+	for i, j := range dbJewels {
+		jewels[i] = jewelRow{j, reasonsByItem[j.ItemId]}
+	}
+
+	s.render(w, "jewelDump", map[string]any{"Jewels": jewels})
+}
+
+// Serves the latest snapshot for a single node, including the sorted price
+// distribution and the inlier cluster the window price was chosen from
+func (s *server) handleSnapshotApi(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := s.store.LatestKeySnapshot(r.Context(), keyParam(r))
+	if errors.Is(err, db.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	s.writeJSON(w, snapshot)
+}
+
+// Serves the latest snapshots for a league with their trend metrics.
+// ?sort=rising orders them by 24h change.
+func (s *server) handleTrendsApi(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := s.store.LatestSnapshots(r.Context())
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	type trendResponse struct {
+		JewelType     string
+		JewelClass    string
+		AllocatedNode string
+		WindowPrice   float64
+		Change1h      pgtype.Float8
+		Change24h     pgtype.Float8
+		Change7d      pgtype.Float8
+		Ewma          float64
+		Volatility    float64
+		GeneratedAt   time.Time
+	}
+
+	realm, league := realmParam(r), r.PathValue("league")
+	var leagueSnapshots []db.LeagueSnapshot
+	for _, snap := range snapshots {
+		if snap.Realm == realm && snap.League == league {
+			leagueSnapshots = append(leagueSnapshots, snap)
+		}
+	}
+	if r.URL.Query().Get("sort") == "rising" {
+		sortByRising(leagueSnapshots)
+	}
+
+	trends := make([]trendResponse, len(leagueSnapshots))
+	for i, snap := range leagueSnapshots {
+		trends[i] = trendResponse{
+			JewelType:     snap.JewelType,
+			JewelClass:    snap.JewelClass,
+			AllocatedNode: snap.AllocatedNode,
+			WindowPrice:   snap.WindowPrice,
+			Change1h:      snap.Change1h,
+			Change24h:     snap.Change24h,
+			Change7d:      snap.Change7d,
+			Ewma:          snap.Ewma,
+			Volatility:    snap.Volatility,
+			GeneratedAt:   snap.GeneratedAt,
+		}
+	}
+
+	s.writeJSON(w, trends)
+}
+
+// Serves the forecasts generated alongside a league's latest snapshot set
+func (s *server) handleForecastsApi(w http.ResponseWriter, r *http.Request) {
+	forecasts, err := s.store.LatestForecasts(r.Context(), realmParam(r), r.PathValue("league"))
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	s.writeJSON(w, forecasts)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+
+	db "github.com/faideww/ffff/internal/db"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/joho/godotenv"
+)
+
+func loadEnv() {
+	env := os.Getenv("GO_ENV")
+	if env == "" {
+		env = "development"
+	}
+
+	godotenv.Load(".env." + env + ".local")
+	if env != "test" {
+		godotenv.Load(".env.local")
+	}
+
+	godotenv.Load(".env." + env)
+	godotenv.Load()
+
+}
+
+var templateFuncs = template.FuncMap{
+	"currency": func(v float64) string {
+		if v <= 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.0fc", v)
+	},
+	"percent": func(v pgtype.Float8) string {
+		if !v.Valid {
+			return "-"
+		}
+		return fmt.Sprintf("%+.1f%%", v.Float64*100)
+	},
+}
+
+// Every page template defines "title" and "body" and is rendered through the
+// "root" layout, so each page gets its own template set
+func loadTemplate(name string) *template.Template {
+	return template.Must(template.New(name).Funcs(templateFuncs).ParseFiles("templates/root.html", "templates/"+name))
+}
+
+func main() {
+	loadEnv()
+	l := log.New(os.Stdout, "[WEB]", log.Ldate|log.Ltime)
+
+	ctx := context.Background()
+	store, err := db.OpenStore(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	if err = store.CheckSchema(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	s := &server{
+		store: store,
+		l:     l,
+		templates: map[string]*template.Template{
+			"mainTable":  loadTemplate("mainTable.html"),
+			"dump":       loadTemplate("dump.html"),
+			"jewelDump":  loadTemplate("jewelDump.html"),
+			"dendrogram": loadTemplate("dendrogram.html"),
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	mux.HandleFunc("GET /{$}", s.handleMainTable)
+	mux.HandleFunc("GET /dump", s.handleDump)
+	mux.HandleFunc("GET /dump/jewel/{league}/{jewelType}/{node}", s.handleJewelDump)
+	mux.HandleFunc("GET /dendrogram/{league}/{jewelType}/{jewelClass}/{node}", s.handleDendrogram)
+	mux.HandleFunc("GET /api/snapshots/{league}/{jewelType}/{jewelClass}/{node}", s.handleSnapshotApi)
+	mux.HandleFunc("GET /api/trends/{league}", s.handleTrendsApi)
+	mux.HandleFunc("GET /api/forecasts/{league}", s.handleForecastsApi)
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	l.Printf("listening on :%s\n", port)
+	log.Fatal(http.ListenAndServe(":"+port, mux))
+}
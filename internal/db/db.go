@@ -8,11 +8,6 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// type SQLiteConfig struct {
-// 	DbUrl       string
-// 	DbAuthToken string
-// }
-
 type PGXScanner interface {
 	Scan(dest ...interface{}) (err error)
 }
@@ -25,45 +20,139 @@ type DBJewel struct {
 	ItemId            string    `db:"itemId"`
 	StashId           string    `db:"stashId"`
 	League            string    `db:"league"`
+	Realm             string    `db:"realm"`
 	ListPriceAmount   float64   `db:"listPriceAmount"`
 	ListPriceCurrency string    `db:"listPriceCurrency"`
 	LastChangeId      string    `db:"lastChangeId"`
 	RecordedAt        time.Time `db:"recordedAt"`
+	AccountName       string    `db:"accountName"`
+	FirstSeenAt       time.Time `db:"firstSeenAt"`
+	PriceChanges      int       `db:"priceChanges"`
 }
 
 type DBChangeset struct {
 	Id            int         `db:"id"`
+	Realm         string      `db:"realm"`
 	ChangeId      string      `db:"changeId"`
 	NextChangeId  string      `db:"nextChangeId"`
 	StashCount    int         `db:"stashCount"`
 	ProcessedAt   time.Time   `db:"processedAt"`
 	TimeTakenMs   int64       `db:"timeTaken"`
 	DriftFromHead pgtype.Int4 `db:"driftFromHead"`
+	// How far behind the head each shard was; nil when drift wasn't measured
+	ShardDrift []int64 `db:"shardDrift"`
+	// Drift converted to time using the head's recent advancement rate
+	LagMinutes pgtype.Float8 `db:"lagMinutes"`
+}
+
+// An access token from GGG's OAuth server, saved so a restarted reader
+// doesn't have to request a new one
+type DBOAuthToken struct {
+	ClientId    string    `db:"clientId"`
+	Scope       string    `db:"scope"`
+	AccessToken string    `db:"accessToken"`
+	ObtainedAt  time.Time `db:"obtainedAt"`
+	// Null for tokens that don't expire
+	ExpiresAt pgtype.Timestamptz `db:"expiresAt"`
+}
+
+// Changesets from one hour, merged by the retention command
+type DBChangesetRollup struct {
+	Realm        string      `db:"realm"`
+	HourStart    time.Time   `db:"hourStart"`
+	Pages        int         `db:"pages"`
+	StashCount   int64       `db:"stashCount"`
+	TimeTakenMs  int64       `db:"timeTaken"`
+	MinDrift     pgtype.Int4 `db:"minDrift"`
+	MaxDrift     pgtype.Int4 `db:"maxDrift"`
+	DriftSum     int64       `db:"driftSum"`
+	DriftSamples int         `db:"driftSamples"`
 }
 
 type DBSnapshotSet struct {
 	Id            int                `db:"id"`
+	Realm         string             `db:"realm"`
 	League        string             `db:"league"`
 	ExchangeRates map[string]float64 `db:"exchangeRates"`
 	GeneratedAt   time.Time          `db:"generatedAt"`
+	// The window settings the set was computed with; null for sets from
+	// before they were recorded
+	WindowSeconds   pgtype.Int8 `db:"windowSeconds"`
+	HalfLifeSeconds pgtype.Int8 `db:"halfLifeSeconds"`
 }
 
 type DBJewelSnapshot struct {
-	Id                 int       `db:"id"`
-	SetId              int       `db:"setId"`
-	JewelType          string    `db:"jewelType"`
-	JewelClass         string    `db:"jewelClass"`
-	AllocatedNode      string    `db:"allocatedNode"`
-	MinPrice           float64   `db:"minPrice"`
-	FirstQuartilePrice float64   `db:"firstQuartilePrice"`
-	MedianPrice        float64   `db:"medianPrice"`
-	ThirdQuartilePrice float64   `db:"thirdQuartilePrice"`
-	MaxPrice           float64   `db:"maxPrice"`
-	WindowPrice        float64   `db:"windowPrice"`
-	Confidence         float64   `db:"confidence"`
-	Stddev             float64   `db:"stddev"`
-	NumListed          int       `db:"numListed"`
-	GeneratedAt        time.Time `db:"generatedAt"`
+	Id                 int           `db:"id"`
+	SetId              int           `db:"setId"`
+	JewelType          string        `db:"jewelType"`
+	JewelClass         string        `db:"jewelClass"`
+	AllocatedNode      string        `db:"allocatedNode"`
+	MinPrice           float64       `db:"minPrice"`
+	FirstQuartilePrice float64       `db:"firstQuartilePrice"`
+	MedianPrice        float64       `db:"medianPrice"`
+	ThirdQuartilePrice float64       `db:"thirdQuartilePrice"`
+	MaxPrice           float64       `db:"maxPrice"`
+	WindowPrice        float64       `db:"windowPrice"`
+	Confidence         float64       `db:"confidence"`
+	Stddev             float64       `db:"stddev"`
+	NumListed          int           `db:"numListed"`
+	NumSellers         int           `db:"numSellers"`
+	Prices             []float64     `db:"prices"`
+	InlierPrices       []float64     `db:"inlierPrices"`
+	Change1h           pgtype.Float8 `db:"change1h"`
+	Change24h          pgtype.Float8 `db:"change24h"`
+	Change7d           pgtype.Float8 `db:"change7d"`
+	Ewma               float64       `db:"ewma"`
+	Volatility         float64       `db:"volatility"`
+	GeneratedAt        time.Time     `db:"generatedAt"`
+	Resolution         string        `db:"resolution"`
+}
+
+type DBFlaggedListing struct {
+	Id            int       `db:"id"`
+	SetId         int       `db:"setId"`
+	ItemId        string    `db:"itemId"`
+	AccountName   string    `db:"accountName"`
+	JewelType     string    `db:"jewelType"`
+	JewelClass    string    `db:"jewelClass"`
+	AllocatedNode string    `db:"allocatedNode"`
+	ChaosPrice    float64   `db:"chaosPrice"`
+	WindowPrice   float64   `db:"windowPrice"`
+	Reasons       []string  `db:"reasons"`
+	FlaggedAt     time.Time `db:"flaggedAt"`
+}
+
+type DBForecast struct {
+	Id            int       `db:"id"`
+	SetId         int       `db:"setId"`
+	JewelType     string    `db:"jewelType"`
+	JewelClass    string    `db:"jewelClass"`
+	AllocatedNode string    `db:"allocatedNode"`
+	HorizonHours  int       `db:"horizonHours"`
+	ForecastPrice float64   `db:"forecastPrice"`
+	LowerPrice    float64   `db:"lowerPrice"`
+	UpperPrice    float64   `db:"upperPrice"`
+	Seasonal      bool      `db:"seasonal"`
+	GeneratedAt   time.Time `db:"generatedAt"`
+	TargetAt      time.Time `db:"targetAt"`
+}
+
+type DBSnapshotDiagnostics struct {
+	Id            int             `db:"id"`
+	SetId         int             `db:"setId"`
+	JewelType     string          `db:"jewelType"`
+	JewelClass    string          `db:"jewelClass"`
+	AllocatedNode string          `db:"allocatedNode"`
+	Estimator     string          `db:"estimator"`
+	Prices        []float64       `db:"prices"`
+	Dendrogram    []byte          `db:"dendrogram"`
+	Silhouettes   []pgtype.Float8 `db:"silhouettes"`
+	CutCriterion  pgtype.Text     `db:"cutCriterion"`
+	CutScores     []pgtype.Float8 `db:"cutScores"`
+	CutLevel      pgtype.Int4     `db:"cutLevel"`
+	InlierPrices  []float64       `db:"inlierPrices"`
+	Notes         []string        `db:"notes"`
+	GeneratedAt   time.Time       `db:"generatedAt"`
 }
 
 func DBConnect(connStr string) (*pgxpool.Pool, error) {
@@ -0,0 +1,242 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const LEADER_POLL_INTERVAL = 2 * time.Second
+const LEADER_HEARTBEAT_INTERVAL = 5 * time.Second
+
+const UPSERT_WORKER_QUERY = `
+INSERT INTO workers(workerId,role,status,startedAt,heartbeatAt)
+  VALUES ($1,$2,$3,$4,$4)
+  ON CONFLICT(workerId)
+  DO
+    UPDATE SET role = $2, status = $3, heartbeatAt = $4
+`
+
+const HEARTBEAT_WORKER_QUERY = `
+UPDATE workers
+  SET status = $2, heartbeatAt = $3
+  WHERE workerId = $1
+`
+
+// Marks any leader rows left behind by a worker that died without releasing
+// its lock, so the workers table only ever shows one leader per role
+const DEMOTE_STALE_LEADERS_QUERY = `
+UPDATE workers
+  SET status = 'lost'
+  WHERE role = $1 AND status = 'leader' AND workerId != $2
+`
+
+type DBWorker struct {
+	WorkerId    string    `db:"workerId"`
+	Role        string    `db:"role"`
+	Status      string    `db:"status"`
+	StartedAt   time.Time `db:"startedAt"`
+	HeartbeatAt time.Time `db:"heartbeatAt"`
+}
+
+// A Leader holds a lock that only one worker per role can hold at a time,
+// and keeps it alive with a heartbeat. On Postgres it's a session-level
+// advisory lock on a dedicated pool connection, which Postgres releases as
+// soon as that session goes away, so a standby can take over without
+// waiting for any timeout on our side.
+type Leader struct {
+	Role     string
+	WorkerId string
+
+	// Renews the lock, failing once it has been lost
+	beat func(ctx context.Context) error
+	// Gives the lock up; `lost` says whether it's already gone
+	release func(ctx context.Context, lost bool)
+
+	lost      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	l         *log.Logger
+}
+
+// Identifies this process in the workers table. Fly machines get a stable id
+// from the environment; everywhere else we fall back to hostname + pid.
+func WorkerId() string {
+	if id := os.Getenv("FLY_MACHINE_ID"); id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func advisoryLockKey(role string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("ffff:" + role))
+	return int64(h.Sum64())
+}
+
+// Blocks until this worker holds the advisory lock for `role` (or ctx is
+// cancelled). While waiting, the worker is registered as a standby and keeps
+// its heartbeat fresh.
+func AcquireLeadership(ctx context.Context, pool *pgxpool.Pool, role string, workerId string, l *log.Logger) (*Leader, error) {
+	key := advisoryLockKey(role)
+	startedAt := time.Now()
+
+	_, err := pool.Exec(ctx, UPSERT_WORKER_QUERY, workerId, role, "standby", startedAt)
+	if err != nil {
+		l.Printf("failed to register worker %s\n", workerId)
+		return nil, err
+	}
+
+	waitingLogged := false
+	for {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var acquired bool
+		err = conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired)
+		if err != nil {
+			conn.Release()
+			return nil, err
+		}
+
+		if acquired {
+			if _, err = conn.Exec(ctx, DEMOTE_STALE_LEADERS_QUERY, role, workerId); err != nil {
+				conn.Release()
+				return nil, err
+			}
+			if _, err = conn.Exec(ctx, HEARTBEAT_WORKER_QUERY, workerId, "leader", time.Now()); err != nil {
+				conn.Release()
+				return nil, err
+			}
+
+			l.Printf("worker %s is now the leader for %s\n", workerId, role)
+			// Heartbeats go over the same connection that holds the lock. If
+			// that connection breaks, the lock is gone too, so a failed
+			// heartbeat means we are no longer the leader.
+			beat := func(ctx context.Context) error {
+				_, err := conn.Exec(ctx, HEARTBEAT_WORKER_QUERY, workerId, "leader", time.Now())
+				return err
+			}
+			return newLeader(role, workerId, beat, advisoryLockRelease(conn, key, workerId, l), l), nil
+		}
+
+		// Someone else holds the lock - hand the connection back to the pool
+		// while we wait, otherwise every standby pins a connection
+		conn.Release()
+		if !waitingLogged {
+			l.Printf("another worker is the leader for %s; waiting as standby\n", role)
+			waitingLogged = true
+		}
+
+		if _, err = pool.Exec(ctx, HEARTBEAT_WORKER_QUERY, workerId, "standby", time.Now()); err != nil {
+			l.Printf("failed to update standby heartbeat: %s\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(LEADER_POLL_INTERVAL):
+		}
+	}
+}
+
+// Unlocks and hands the lock's connection back to the pool, or destroys it
+// if the lock was lost
+func advisoryLockRelease(conn *pgxpool.Conn, key int64, workerId string, l *log.Logger) func(ctx context.Context, lost bool) {
+	return func(ctx context.Context, lost bool) {
+		if lost {
+			// The session is already broken; destroy it rather than
+			// returning it to the pool
+			conn.Conn().Close(ctx)
+		} else {
+			if _, err := conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", key); err != nil {
+				l.Printf("failed to release advisory lock: %s\n", err)
+			}
+			if _, err := conn.Exec(ctx, HEARTBEAT_WORKER_QUERY, workerId, "stopped", time.Now()); err != nil {
+				l.Printf("failed to update worker status: %s\n", err)
+			}
+		}
+		conn.Release()
+	}
+}
+
+// Starts heartbeating a freshly acquired lock
+func newLeader(role string, workerId string, beat func(ctx context.Context) error, release func(ctx context.Context, lost bool), l *log.Logger) *Leader {
+	ld := &Leader{
+		Role:     role,
+		WorkerId: workerId,
+		beat:     beat,
+		release:  release,
+		lost:     make(chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		l:        l,
+	}
+	go ld.heartbeat()
+	return ld
+}
+
+func (ld *Leader) heartbeat() {
+	defer close(ld.done)
+	ticker := time.NewTicker(LEADER_HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ld.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), LEADER_HEARTBEAT_INTERVAL)
+			err := ld.beat(ctx)
+			cancel()
+			if err != nil {
+				ld.l.Printf("leader heartbeat failed, giving up leadership: %s\n", err)
+				close(ld.lost)
+				return
+			}
+		}
+	}
+}
+
+// Closed when leadership has been lost. The holder must stop writing as soon
+// as this fires, since a standby may already have taken over.
+func (ld *Leader) Lost() <-chan struct{} {
+	return ld.lost
+}
+
+// Returns an error if leadership has been lost since the last check
+func (ld *Leader) Check() error {
+	select {
+	case <-ld.lost:
+		return errors.New("lost leadership for " + ld.Role)
+	default:
+		return nil
+	}
+}
+
+func (ld *Leader) Release(ctx context.Context) {
+	ld.closeOnce.Do(func() {
+		close(ld.stop)
+		<-ld.done
+		select {
+		case <-ld.lost:
+			ld.release(ctx, true)
+		default:
+			ld.release(ctx, false)
+		}
+	})
+}
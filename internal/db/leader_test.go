@@ -0,0 +1,76 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testSQLiteStore(t *testing.T, path string) *SQLiteStore {
+	t.Helper()
+	store, err := NewSQLiteStore(context.Background(), SQLiteConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func expectStandby(t *testing.T, store *SQLiteStore, workerId string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if leader, err := store.AcquireLeadership(ctx, "river", workerId, log.New(io.Discard, "", 0)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("%s got %v, %v while the lock was held", workerId, leader, err)
+	}
+}
+
+func TestSQLiteLeaderLock(t *testing.T) {
+	ctx := context.Background()
+	l := log.New(io.Discard, "", 0)
+	path := filepath.Join(t.TempDir(), "ffff.db")
+	first, second := testSQLiteStore(t, path), testSQLiteStore(t, path)
+
+	a, err := first.AcquireLeadership(ctx, "river", "a", l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStandby(t, second, "b")
+
+	// Other roles have their own lock
+	other, err := second.AcquireLeadership(ctx, "stats", "b", l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Release(ctx)
+
+	a.Release(ctx)
+	b, err := second.AcquireLeadership(ctx, "river", "b", l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStandby(t, first, "a")
+
+	// Once b's heartbeat lapses a takes over, and b's next heartbeat finds
+	// out
+	lapsed := sqliteTime(time.Now().Add(-SQLITE_LEADER_LOCK_TIMEOUT - time.Second))
+	if _, err = first.db.Exec("UPDATE leader_locks SET heartbeatAt = ?", lapsed); err != nil {
+		t.Fatal(err)
+	}
+	a, err = first.AcquireLeadership(ctx, "river", "a", l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.beat(ctx); err == nil {
+		t.Errorf("heartbeat succeeded after the lock was taken over")
+	}
+
+	// Releasing the lost lock leaves a's alone
+	b.Release(ctx)
+	expectStandby(t, second, "c")
+	a.Release(ctx)
+}
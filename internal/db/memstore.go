@@ -0,0 +1,715 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Implements every store in memory, mirroring the semantics of PGStore's
+// queries. Meant for tests and local experiments; nothing is persisted.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	jewels       map[int]DBJewel
+	jewelsByItem map[string]int
+	history      []DBJewelHistory
+	changesets   []DBChangeset
+	sets         []DBSnapshotSet
+	snapshots    []DBJewelSnapshot
+	flags        []DBFlaggedListing
+	forecasts    []DBForecast
+	diagnostics  []DBSnapshotDiagnostics
+	rollups      []DBChangesetRollup
+	tokens       map[[2]string]DBOAuthToken
+	nextId       int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		jewels:       make(map[int]DBJewel),
+		jewelsByItem: make(map[string]int),
+		tokens:       make(map[[2]string]DBOAuthToken),
+	}
+}
+
+func (s *MemoryStore) id() int {
+	s.nextId++
+	return s.nextId
+}
+
+func jewelKey(j *DBJewel) JewelKey {
+	return JewelKey{j.Realm, j.League, j.JewelType, j.JewelClass, j.AllocatedNode}
+}
+
+// Holds the lock from the read through the apply, so the pair is atomic
+func (s *MemoryStore) UpdateStashJewels(ctx context.Context, stashIds []string, diff func(existing []DBJewel) (JewelChanges, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var existing []DBJewel
+	for _, j := range s.jewels {
+		if slices.Contains(stashIds, j.StashId) {
+			existing = append(existing, j)
+		}
+	}
+	changes, err := diff(existing)
+	if err != nil {
+		return err
+	}
+	s.applyJewelChanges(changes)
+	return nil
+}
+
+// Overwrites a listing with a newer sighting, counting price changes
+func updateListing(existing DBJewel, next DBJewel) DBJewel {
+	if existing.ListPriceAmount != next.ListPriceAmount || existing.ListPriceCurrency != next.ListPriceCurrency {
+		existing.PriceChanges++
+	}
+	existing.StashId = next.StashId
+	existing.ListPriceAmount = next.ListPriceAmount
+	existing.ListPriceCurrency = next.ListPriceCurrency
+	existing.LastChangeId = next.LastChangeId
+	existing.RecordedAt = next.RecordedAt
+	existing.AccountName = next.AccountName
+	return existing
+}
+
+func (s *MemoryStore) applyJewelChanges(changes JewelChanges) {
+	for _, d := range changes.Delisted {
+		j, ok := s.jewels[d.Id]
+		if !ok {
+			continue
+		}
+		delete(s.jewels, d.Id)
+		delete(s.jewelsByItem, j.ItemId)
+		s.history = append(s.history, DBJewelHistory{
+			Id:                s.id(),
+			ItemId:            j.ItemId,
+			AccountName:       j.AccountName,
+			Realm:             j.Realm,
+			League:            j.League,
+			JewelType:         j.JewelType,
+			JewelClass:        j.JewelClass,
+			AllocatedNode:     j.AllocatedNode,
+			ListPriceAmount:   j.ListPriceAmount,
+			ListPriceCurrency: j.ListPriceCurrency,
+			PriceChanges:      j.PriceChanges,
+			FirstSeenAt:       j.FirstSeenAt,
+			DelistedAt:        d.DelistedAt,
+		})
+	}
+
+	for _, next := range changes.Updated {
+		if j, ok := s.jewels[next.Id]; ok {
+			s.jewels[next.Id] = updateListing(j, next)
+		}
+	}
+
+	for _, next := range changes.Upserted {
+		if id, ok := s.jewelsByItem[next.ItemId]; ok {
+			s.jewels[id] = updateListing(s.jewels[id], next)
+			continue
+		}
+		next.Id = s.id()
+		next.FirstSeenAt = next.RecordedAt
+		next.PriceChanges = 0
+		s.jewels[next.Id] = next
+		s.jewelsByItem[next.ItemId] = next.Id
+	}
+}
+
+func (s *MemoryStore) JewelsSince(ctx context.Context, realm string, cutoffs map[string]time.Time) ([]DBJewel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jewels []DBJewel
+	for _, j := range s.jewels {
+		if cutoff, ok := cutoffs[j.League]; ok && j.Realm == realm && j.RecordedAt.After(cutoff) {
+			jewels = append(jewels, j)
+		}
+	}
+	return jewels, nil
+}
+
+func (s *MemoryStore) JewelsForKeys(ctx context.Context, cutoffs map[JewelKey]time.Time) ([]DBJewel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jewels []DBJewel
+	for _, j := range s.jewels {
+		if cutoff, ok := cutoffs[jewelKey(&j)]; ok && j.RecordedAt.After(cutoff) {
+			jewels = append(jewels, j)
+		}
+	}
+	return jewels, nil
+}
+
+func (s *MemoryStore) ChangedKeys(ctx context.Context, realm string, league string, since, prevCutoff, cutoff time.Time, currencies []string) ([]JewelKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make(map[JewelKey]bool)
+	for _, j := range s.jewels {
+		if j.Realm != realm || j.League != league {
+			continue
+		}
+		fellOut := j.RecordedAt.After(prevCutoff) && !j.RecordedAt.After(cutoff)
+		if j.RecordedAt.After(since) || fellOut || slices.Contains(currencies, j.ListPriceCurrency) {
+			keys[jewelKey(&j)] = true
+		}
+	}
+	for _, h := range s.history {
+		if h.Realm == realm && h.League == league && h.DelistedAt.After(since) {
+			keys[JewelKey{h.Realm, h.League, h.JewelType, h.JewelClass, h.AllocatedNode}] = true
+		}
+	}
+	changed := make([]JewelKey, 0, len(keys))
+	for k := range keys {
+		changed = append(changed, k)
+	}
+	return changed, nil
+}
+
+func (s *MemoryStore) QuickDelistings(ctx context.Context, realm string, leagues []string, since time.Time, maxLifetime time.Duration) ([]DBJewelHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var delistings []DBJewelHistory
+	for _, h := range s.history {
+		if h.Realm == realm && slices.Contains(leagues, h.League) && h.AccountName != "" && h.DelistedAt.After(since) && h.DelistedAt.Sub(h.FirstSeenAt) < maxLifetime {
+			delistings = append(delistings, h)
+		}
+	}
+	return delistings, nil
+}
+
+func (s *MemoryStore) NodeJewels(ctx context.Context, realm string, league string, jewelType string, allocatedNode string) ([]DBJewel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jewels []DBJewel
+	for _, j := range s.jewels {
+		if j.Realm == realm && j.League == league && j.JewelType == jewelType && j.AllocatedNode == allocatedNode {
+			jewels = append(jewels, j)
+		}
+	}
+	slices.SortFunc(jewels, func(a, b DBJewel) int {
+		return b.RecordedAt.Compare(a.RecordedAt)
+	})
+	return jewels, nil
+}
+
+func (s *MemoryStore) LatestChangeset(ctx context.Context, realm string) (DBChangeset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var latest DBChangeset
+	found := false
+	for _, c := range s.changesets {
+		if c.Realm == realm && (!found || c.ProcessedAt.After(latest.ProcessedAt)) {
+			latest = c
+			found = true
+		}
+	}
+	if !found {
+		return DBChangeset{}, ErrNotFound
+	}
+	return latest, nil
+}
+
+func (s *MemoryStore) InsertChangeset(ctx context.Context, c DBChangeset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.Id = s.id()
+	s.changesets = append(s.changesets, c)
+	return nil
+}
+
+func (s *MemoryStore) LatestSnapshotSets(ctx context.Context, realm string, leagues []string) ([]DBSnapshotSet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	latest := make(map[string]DBSnapshotSet)
+	for _, set := range s.sets {
+		if set.Realm != realm || !slices.Contains(leagues, set.League) {
+			continue
+		}
+		if prev, ok := latest[set.League]; !ok || set.GeneratedAt.After(prev.GeneratedAt) {
+			latest[set.League] = set
+		}
+	}
+	sets := make([]DBSnapshotSet, 0, len(latest))
+	for _, set := range latest {
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+func (s *MemoryStore) SnapshotsInSet(ctx context.Context, setId int) ([]DBJewelSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var snapshots []DBJewelSnapshot
+	for _, snap := range s.snapshots {
+		if snap.SetId == setId {
+			snapshots = append(snapshots, snap)
+		}
+	}
+	return snapshots, nil
+}
+
+func (s *MemoryStore) FlagsInSet(ctx context.Context, setId int) ([]DBFlaggedListing, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var flags []DBFlaggedListing
+	for _, f := range s.flags {
+		if f.SetId == setId {
+			flags = append(flags, f)
+		}
+	}
+	return flags, nil
+}
+
+func (s *MemoryStore) PriorFlagCounts(ctx context.Context, realm string, since time.Time) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inRealm := make(map[int]bool, len(s.sets))
+	for _, set := range s.sets {
+		inRealm[set.Id] = set.Realm == realm
+	}
+
+	items := make(map[string]map[string]bool)
+	for _, f := range s.flags {
+		if !inRealm[f.SetId] || f.AccountName == "" || !f.FlaggedAt.After(since) {
+			continue
+		}
+		if items[f.AccountName] == nil {
+			items[f.AccountName] = make(map[string]bool)
+		}
+		items[f.AccountName][f.ItemId] = true
+	}
+
+	counts := make(map[string]int, len(items))
+	for seller, ids := range items {
+		counts[seller] = len(ids)
+	}
+	return counts, nil
+}
+
+func (s *MemoryStore) SnapshotHistory(ctx context.Context, realm string, leagues []string, since time.Time) ([]SnapshotPricePoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	setsById := make(map[int]DBSnapshotSet, len(s.sets))
+	for _, set := range s.sets {
+		setsById[set.Id] = set
+	}
+
+	var points []SnapshotPricePoint
+	for _, snap := range s.snapshots {
+		set := setsById[snap.SetId]
+		if set.Realm != realm || !slices.Contains(leagues, set.League) || !snap.GeneratedAt.After(since) {
+			continue
+		}
+		points = append(points, SnapshotPricePoint{
+			Key:         JewelKey{set.Realm, set.League, snap.JewelType, snap.JewelClass, snap.AllocatedNode},
+			WindowPrice: snap.WindowPrice,
+			GeneratedAt: snap.GeneratedAt,
+		})
+	}
+	slices.SortStableFunc(points, func(a, b SnapshotPricePoint) int {
+		return a.GeneratedAt.Compare(b.GeneratedAt)
+	})
+	return points, nil
+}
+
+func (s *MemoryStore) InsertSnapshotSets(ctx context.Context, sets []NewSnapshotSet) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	setIds := make(map[string]int, len(sets))
+	for _, set := range sets {
+		setId := s.id()
+		setIds[set.League] = setId
+		s.sets = append(s.sets, DBSnapshotSet{
+			Id:              setId,
+			Realm:           set.Realm,
+			League:          set.League,
+			ExchangeRates:   maps.Clone(set.ExchangeRates),
+			GeneratedAt:     set.GeneratedAt,
+			WindowSeconds:   pgtype.Int8{Int64: int64(set.Window / time.Second), Valid: true},
+			HalfLifeSeconds: pgtype.Int8{Int64: int64(set.HalfLife / time.Second), Valid: true},
+		})
+		for _, snap := range set.Snapshots {
+			snap.Id = s.id()
+			snap.SetId = setId
+			snap.GeneratedAt = set.GeneratedAt
+			snap.Resolution = "raw"
+			s.snapshots = append(s.snapshots, snap)
+		}
+		for _, f := range set.Flags {
+			f.Id = s.id()
+			f.SetId = setId
+			f.FlaggedAt = set.GeneratedAt
+			s.flags = append(s.flags, f)
+		}
+	}
+	return setIds, nil
+}
+
+func (s *MemoryStore) InsertForecasts(ctx context.Context, forecasts []DBForecast) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range forecasts {
+		f.Id = s.id()
+		s.forecasts = append(s.forecasts, f)
+	}
+	return nil
+}
+
+func (s *MemoryStore) InsertDiagnostics(ctx context.Context, diagnostics []DBSnapshotDiagnostics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range diagnostics {
+		d.Id = s.id()
+		s.diagnostics = append(s.diagnostics, d)
+	}
+	return nil
+}
+
+// The newest set of the realm's league; callers hold the lock
+func (s *MemoryStore) latestSet(realm string, league string) (DBSnapshotSet, bool) {
+	var latest DBSnapshotSet
+	found := false
+	for _, set := range s.sets {
+		if set.Realm == realm && set.League == league && (!found || set.GeneratedAt.After(latest.GeneratedAt)) {
+			latest = set
+			found = true
+		}
+	}
+	return latest, found
+}
+
+func compareSnapshotKeys(a, b DBJewelSnapshot) int {
+	return cmp.Or(cmp.Compare(a.JewelType, b.JewelType), cmp.Compare(a.JewelClass, b.JewelClass), cmp.Compare(a.AllocatedNode, b.AllocatedNode))
+}
+
+func (s *MemoryStore) LatestSnapshots(ctx context.Context) ([]LeagueSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	latestIds := make(map[int]DBSnapshotSet)
+	for _, set := range s.sets {
+		if latest, _ := s.latestSet(set.Realm, set.League); latest.Id == set.Id {
+			latestIds[set.Id] = set
+		}
+	}
+	var snapshots []LeagueSnapshot
+	for _, snap := range s.snapshots {
+		if set, ok := latestIds[snap.SetId]; ok {
+			snapshots = append(snapshots, LeagueSnapshot{snap, set.Realm, set.League})
+		}
+	}
+	slices.SortFunc(snapshots, func(a, b LeagueSnapshot) int {
+		return cmp.Or(cmp.Compare(a.Realm, b.Realm), cmp.Compare(a.League, b.League), compareSnapshotKeys(a.DBJewelSnapshot, b.DBJewelSnapshot))
+	})
+	return snapshots, nil
+}
+
+func (s *MemoryStore) LatestKeySnapshot(ctx context.Context, key JewelKey) (LeagueSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	setsById := make(map[int]DBSnapshotSet, len(s.sets))
+	for _, set := range s.sets {
+		setsById[set.Id] = set
+	}
+	var latest LeagueSnapshot
+	found := false
+	for _, snap := range s.snapshots {
+		set := setsById[snap.SetId]
+		if (JewelKey{set.Realm, set.League, snap.JewelType, snap.JewelClass, snap.AllocatedNode}) != key {
+			continue
+		}
+		if !found || snap.GeneratedAt.After(latest.GeneratedAt) {
+			latest = LeagueSnapshot{snap, set.Realm, set.League}
+			found = true
+		}
+	}
+	if !found {
+		return latest, ErrNotFound
+	}
+	return latest, nil
+}
+
+func (s *MemoryStore) LatestNodeFlags(ctx context.Context, realm string, league string, jewelType string, allocatedNode string) ([]DBFlaggedListing, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, ok := s.latestSet(realm, league)
+	if !ok {
+		return nil, nil
+	}
+	var flags []DBFlaggedListing
+	for _, f := range s.flags {
+		if f.SetId == set.Id && f.JewelType == jewelType && f.AllocatedNode == allocatedNode {
+			flags = append(flags, f)
+		}
+	}
+	return flags, nil
+}
+
+func (s *MemoryStore) LatestForecasts(ctx context.Context, realm string, league string) ([]DBForecast, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, ok := s.latestSet(realm, league)
+	if !ok {
+		return nil, nil
+	}
+	var forecasts []DBForecast
+	for _, f := range s.forecasts {
+		if f.SetId == set.Id {
+			forecasts = append(forecasts, f)
+		}
+	}
+	slices.SortFunc(forecasts, func(a, b DBForecast) int {
+		return cmp.Or(cmp.Compare(a.JewelType, b.JewelType), cmp.Compare(a.JewelClass, b.JewelClass), cmp.Compare(a.AllocatedNode, b.AllocatedNode), cmp.Compare(a.HorizonHours, b.HorizonHours))
+	})
+	return forecasts, nil
+}
+
+func (s *MemoryStore) LatestDiagnostics(ctx context.Context, key JewelKey) (DBSnapshotDiagnostics, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	setsById := make(map[int]DBSnapshotSet, len(s.sets))
+	for _, set := range s.sets {
+		setsById[set.Id] = set
+	}
+	var latest DBSnapshotDiagnostics
+	found := false
+	for _, d := range s.diagnostics {
+		set := setsById[d.SetId]
+		if (JewelKey{set.Realm, set.League, d.JewelType, d.JewelClass, d.AllocatedNode}) != key {
+			continue
+		}
+		if !found || d.GeneratedAt.After(latest.GeneratedAt) {
+			latest = d
+			found = true
+		}
+	}
+	if !found {
+		return latest, ErrNotFound
+	}
+	return latest, nil
+}
+
+func (s *MemoryStore) RollupChangesets(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	newest := make(map[string]time.Time)
+	for _, c := range s.changesets {
+		if c.ProcessedAt.After(newest[c.Realm]) {
+			newest[c.Realm] = c.ProcessedAt
+		}
+	}
+	var batch []DBChangeset
+	for _, c := range s.changesets {
+		if c.ProcessedAt.Before(cutoff) && c.ProcessedAt.Before(newest[c.Realm]) {
+			batch = append(batch, c)
+		}
+	}
+	slices.SortStableFunc(batch, func(a, b DBChangeset) int {
+		return a.ProcessedAt.Compare(b.ProcessedAt)
+	})
+	if len(batch) > limit {
+		batch = batch[:limit]
+	}
+
+	folded := make(map[int]bool, len(batch))
+	for _, c := range batch {
+		folded[c.Id] = true
+		hour := c.ProcessedAt.UTC().Truncate(time.Hour)
+		i := slices.IndexFunc(s.rollups, func(r DBChangesetRollup) bool {
+			return r.Realm == c.Realm && r.HourStart.Equal(hour)
+		})
+		if i < 0 {
+			s.rollups = append(s.rollups, DBChangesetRollup{Realm: c.Realm, HourStart: hour})
+			i = len(s.rollups) - 1
+		}
+		r := &s.rollups[i]
+		r.Pages++
+		r.StashCount += int64(c.StashCount)
+		r.TimeTakenMs += c.TimeTakenMs
+		if d := c.DriftFromHead; d.Valid {
+			if !r.MinDrift.Valid || d.Int32 < r.MinDrift.Int32 {
+				r.MinDrift = d
+			}
+			if !r.MaxDrift.Valid || d.Int32 > r.MaxDrift.Int32 {
+				r.MaxDrift = d
+			}
+			r.DriftSum += int64(d.Int32)
+			r.DriftSamples++
+		}
+	}
+	s.changesets = slices.DeleteFunc(s.changesets, func(c DBChangeset) bool {
+		return folded[c.Id]
+	})
+	return int64(len(batch)), nil
+}
+
+func (s *MemoryStore) OldestSnapshot(ctx context.Context, resolution string, cutoff time.Time) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var oldest time.Time
+	found := false
+	for _, snap := range s.snapshots {
+		if snap.Resolution == resolution && snap.GeneratedAt.Before(cutoff) && (!found || snap.GeneratedAt.Before(oldest)) {
+			oldest = snap.GeneratedAt
+			found = true
+		}
+	}
+	if !found {
+		return oldest, ErrNotFound
+	}
+	return oldest, nil
+}
+
+func (s *MemoryStore) MergeSnapshots(ctx context.Context, from string, to string, start, end time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	setsById := make(map[int]DBSnapshotSet, len(s.sets))
+	for _, set := range s.sets {
+		setsById[set.Id] = set
+	}
+	inBucket := func(snap DBJewelSnapshot) bool {
+		return snap.Resolution == from && !snap.GeneratedAt.Before(start) && snap.GeneratedAt.Before(end)
+	}
+
+	var bucket []bucketSnapshot
+	for _, snap := range s.snapshots {
+		if !inBucket(snap) {
+			continue
+		}
+		set := setsById[snap.SetId]
+		bucket = append(bucket, bucketSnapshot{
+			Id:          snap.Id,
+			Key:         JewelKey{set.Realm, set.League, snap.JewelType, snap.JewelClass, snap.AllocatedNode},
+			MinPrice:    snap.MinPrice,
+			MedianPrice: snap.MedianPrice,
+			WindowPrice: snap.WindowPrice,
+		})
+	}
+
+	merged := make(map[int]bucketSnapshot)
+	for _, m := range mergeSnapshotBucket(bucket) {
+		merged[m.Id] = m
+	}
+	for i, snap := range s.snapshots {
+		if m, ok := merged[snap.Id]; ok {
+			s.snapshots[i].MinPrice = m.MinPrice
+			s.snapshots[i].MedianPrice = m.MedianPrice
+			s.snapshots[i].WindowPrice = m.WindowPrice
+			s.snapshots[i].Resolution = to
+		}
+	}
+	s.snapshots = slices.DeleteFunc(s.snapshots, inBucket)
+	return nil
+}
+
+func (s *MemoryStore) ExpiredHistory(ctx context.Context, cutoff time.Time, limit int) ([]DBJewelHistory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []DBJewelHistory
+	for _, h := range s.history {
+		if h.DelistedAt.Before(cutoff) {
+			expired = append(expired, h)
+		}
+	}
+	slices.SortFunc(expired, func(a, b DBJewelHistory) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	if len(expired) > limit {
+		expired = expired[:limit]
+	}
+	return expired, nil
+}
+
+func (s *MemoryStore) DeleteHistory(ctx context.Context, ids []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.history = slices.DeleteFunc(s.history, func(h DBJewelHistory) bool {
+		return slices.Contains(ids, h.Id)
+	})
+	return nil
+}
+
+// Nothing in memory is partitioned
+func (s *MemoryStore) DropPartitionsBefore(ctx context.Context, cutoff time.Time, l *log.Logger) (int, error) {
+	return 0, nil
+}
+
+// Everything generated for a snapshot set, for inspecting results in tests
+func (s *MemoryStore) SetContents(setId int) ([]DBJewelSnapshot, []DBFlaggedListing, []DBForecast) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bySet := func(id int) bool { return id == setId }
+	var snapshots []DBJewelSnapshot
+	for _, snap := range s.snapshots {
+		if bySet(snap.SetId) {
+			snapshots = append(snapshots, snap)
+		}
+	}
+	var flags []DBFlaggedListing
+	for _, f := range s.flags {
+		if bySet(f.SetId) {
+			flags = append(flags, f)
+		}
+	}
+	var forecasts []DBForecast
+	for _, f := range s.forecasts {
+		if bySet(f.SetId) {
+			forecasts = append(forecasts, f)
+		}
+	}
+	slices.SortFunc(snapshots, compareSnapshotKeys)
+	return snapshots, flags, forecasts
+}
+
+func (s *MemoryStore) LoadToken(ctx context.Context, clientId string, scope string) (DBOAuthToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[[2]string{clientId, scope}]
+	if !ok {
+		return t, ErrNotFound
+	}
+	return t, nil
+}
+
+func (s *MemoryStore) SaveToken(ctx context.Context, t DBOAuthToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[[2]string{t.ClientId, t.Scope}] = t
+	return nil
+}
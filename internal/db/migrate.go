@@ -0,0 +1,253 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+const CREATE_MIGRATIONS_TABLE_QUERY = `
+CREATE TABLE if not exists schema_migrations(
+  version INTEGER PRIMARY KEY NOT NULL,
+  name TEXT NOT NULL,
+  appliedAt TIMESTAMPTZ NOT NULL
+)
+`
+
+const SELECT_APPLIED_MIGRATIONS_QUERY = `
+SELECT version, name, appliedAt FROM schema_migrations ORDER BY version
+`
+
+var ErrSchemaOutdated = errors.New("database schema is outdated")
+
+// Migrations are embedded from migrations/NNNN_name.up.sql and the matching
+// NNNN_name.down.sql
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type DBSchemaMigration struct {
+	Version   int       `db:"version"`
+	Name      string    `db:"name"`
+	AppliedAt time.Time `db:"appliedAt"`
+}
+
+// Every embedded migration, oldest first
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		match := migrationFilePattern.FindStringSubmatch(e.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", e.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		body, err := fs.ReadFile(migrationFiles, "migrations/"+e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	return migrations, nil
+}
+
+// Lists the migrations recorded in schema_migrations. A database that has
+// never been migrated has none.
+func AppliedMigrations(ctx context.Context, pool *pgxpool.Pool) ([]DBSchemaMigration, error) {
+	var exists bool
+	err := pool.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	rows, _ := pool.Query(ctx, SELECT_APPLIED_MIGRATIONS_QUERY)
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DBSchemaMigration])
+}
+
+// Fails with ErrSchemaOutdated unless every embedded migration has been
+// applied. Daemons call this on startup so they never run queries against
+// columns that don't exist yet.
+func CheckSchema(ctx context.Context, pool *pgxpool.Pool) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	applied, err := AppliedMigrations(ctx, pool)
+	if err != nil {
+		return err
+	}
+
+	appliedVersions := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		appliedVersions[a.Version] = true
+	}
+	var pending []string
+	for _, m := range migrations {
+		if !appliedVersions[m.Version] {
+			pending = append(pending, fmt.Sprintf("%04d_%s", m.Version, m.Name))
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: %d pending migrations (%v), run `migrate up`", ErrSchemaOutdated, len(pending), pending)
+	}
+	return nil
+}
+
+// Serialises migration runs on a dedicated connection, so two deploys
+// starting at once can't apply the same migration twice
+func withMigrationLock(ctx context.Context, pool *pgxpool.Pool, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	key := advisoryLockKey("migrate")
+	if _, err = conn.Exec(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+
+	if _, err = conn.Exec(ctx, CREATE_MIGRATIONS_TABLE_QUERY); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func appliedVersions(ctx context.Context, conn *pgxpool.Conn) (map[int]bool, error) {
+	rows, _ := conn.Query(ctx, "SELECT version FROM schema_migrations")
+	versions, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool, len(versions))
+	for _, v := range versions {
+		applied[v] = true
+	}
+	return applied, nil
+}
+
+// Applies every pending migration up to and including `target` (0 means
+// all of them), each in its own transaction. Returns how many were applied.
+func MigrateUp(ctx context.Context, pool *pgxpool.Pool, target int, l *log.Logger) (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = withMigrationLock(ctx, pool, func(conn *pgxpool.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if applied[m.Version] || (target > 0 && m.Version > target) {
+				continue
+			}
+			start := time.Now()
+			err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, m.Up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, "INSERT INTO schema_migrations(version,name,appliedAt) VALUES ($1,$2,$3)", m.Version, m.Name, time.Now())
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s failed: %w", m.Version, m.Name, err)
+			}
+			l.Printf("applied %04d_%s in %.2fs\n", m.Version, m.Name, time.Since(start).Seconds())
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Reverts the `steps` most recently applied migrations, newest first.
+// Returns how many were reverted.
+func MigrateDown(ctx context.Context, pool *pgxpool.Pool, steps int, l *log.Logger) (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	byVersion := make(map[int]Migration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+
+	count := 0
+	err = withMigrationLock(ctx, pool, func(conn *pgxpool.Conn) error {
+		rows, _ := conn.Query(ctx, "SELECT version FROM schema_migrations ORDER BY version DESC LIMIT $1", steps)
+		versions, err := pgx.CollectRows(rows, pgx.RowTo[int])
+		if err != nil {
+			return err
+		}
+
+		for _, v := range versions {
+			m, ok := byVersion[v]
+			if !ok {
+				return fmt.Errorf("migration %d is applied but this binary doesn't know how to revert it", v)
+			}
+			start := time.Now()
+			err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, m.Down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("reverting %04d_%s failed: %w", m.Version, m.Name, err)
+			}
+			l.Printf("reverted %04d_%s in %.2fs\n", m.Version, m.Name, time.Since(start).Seconds())
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
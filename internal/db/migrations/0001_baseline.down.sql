@@ -0,0 +1,4 @@
+DROP TABLE if exists snapshots;
+DROP TABLE if exists snapshot_sets;
+DROP TABLE if exists changesets;
+DROP TABLE if exists jewels;
@@ -1,3 +1,6 @@
+-- The schema as it stood before migrations were introduced. Everything uses
+-- IF NOT EXISTS so databases created from the old create-tables.sql script
+-- can be brought under migration control as-is.
 CREATE TABLE if not exists jewels(
   id BIGSERIAL PRIMARY KEY NOT NULL,
   jewelType TEXT NOT NULL,
@@ -23,7 +26,7 @@ CREATE TABLE if not exists changesets(
   stashCount INTEGER NOT NULL,
   processedAt TIMESTAMPTZ NOT NULL,
   timeTaken INTEGER NOT NULL,
-  driftFromHead INTEGER,
+  driftFromHead INTEGER
 );
 
 CREATE INDEX if not exists changesets_by_changeid ON changesets (changeId);
@@ -57,4 +60,3 @@ CREATE TABLE if not exists snapshots(
 );
 
 CREATE INDEX if not exists snapshots_by_setid ON snapshots (setId);
-
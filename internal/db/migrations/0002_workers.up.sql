@@ -0,0 +1,9 @@
+CREATE TABLE if not exists workers(
+  workerId TEXT PRIMARY KEY NOT NULL,
+  role TEXT NOT NULL,
+  status TEXT NOT NULL,
+  startedAt TIMESTAMPTZ NOT NULL,
+  heartbeatAt TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX if not exists workers_by_role ON workers (role);
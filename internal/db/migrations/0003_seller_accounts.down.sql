@@ -0,0 +1,2 @@
+ALTER TABLE snapshots DROP COLUMN if exists numSellers;
+ALTER TABLE jewels DROP COLUMN if exists accountName;
@@ -0,0 +1,2 @@
+ALTER TABLE jewels ADD COLUMN if not exists accountName TEXT NOT NULL DEFAULT '';
+ALTER TABLE snapshots ADD COLUMN if not exists numSellers INTEGER NOT NULL DEFAULT 0;
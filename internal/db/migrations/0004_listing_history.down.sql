@@ -0,0 +1,4 @@
+DROP TABLE if exists flagged_listings;
+DROP TABLE if exists jewel_history;
+ALTER TABLE jewels DROP COLUMN if exists priceChanges;
+ALTER TABLE jewels DROP COLUMN if exists firstSeenAt;
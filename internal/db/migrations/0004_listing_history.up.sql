@@ -0,0 +1,38 @@
+ALTER TABLE jewels ADD COLUMN if not exists firstSeenAt TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE jewels ADD COLUMN if not exists priceChanges INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE if not exists jewel_history(
+  id BIGSERIAL PRIMARY KEY NOT NULL,
+  itemId TEXT NOT NULL,
+  accountName TEXT NOT NULL,
+  league TEXT NOT NULL,
+  jewelType TEXT NOT NULL,
+  jewelClass TEXT NOT NULL,
+  allocatedNode TEXT NOT NULL,
+  listPriceAmount REAL NOT NULL,
+  listPriceCurrency TEXT NOT NULL,
+  priceChanges INTEGER NOT NULL,
+  firstSeenAt TIMESTAMPTZ NOT NULL,
+  delistedAt TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX if not exists jewel_history_by_league_date ON jewel_history (league,delistedAt);
+CREATE INDEX if not exists jewel_history_by_account ON jewel_history (accountName,delistedAt);
+
+CREATE TABLE if not exists flagged_listings(
+  id BIGSERIAL PRIMARY KEY NOT NULL,
+  setId BIGINT NOT NULL,
+  itemId TEXT NOT NULL,
+  accountName TEXT NOT NULL,
+  jewelType TEXT NOT NULL,
+  jewelClass TEXT NOT NULL,
+  allocatedNode TEXT NOT NULL,
+  chaosPrice REAL NOT NULL,
+  windowPrice REAL NOT NULL,
+  reasons TEXT[] NOT NULL,
+  flaggedAt TIMESTAMPTZ NOT NULL,
+  CONSTRAINT fk_set FOREIGN KEY(setId) REFERENCES snapshot_sets(id)
+);
+
+CREATE INDEX if not exists flagged_listings_by_setid ON flagged_listings (setId);
+CREATE INDEX if not exists flagged_listings_by_account ON flagged_listings (accountName,flaggedAt);
@@ -0,0 +1,3 @@
+ALTER TABLE snapshots DROP COLUMN if exists inlierPrices;
+ALTER TABLE snapshots DROP COLUMN if exists prices;
+ALTER TABLE snapshots DROP COLUMN if exists confidence;
@@ -0,0 +1,3 @@
+ALTER TABLE snapshots ADD COLUMN if not exists confidence REAL NOT NULL DEFAULT 0;
+ALTER TABLE snapshots ADD COLUMN if not exists prices REAL[] NOT NULL DEFAULT '{}';
+ALTER TABLE snapshots ADD COLUMN if not exists inlierPrices REAL[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,6 @@
+DROP INDEX if exists snapshots_by_generatedat;
+ALTER TABLE snapshots DROP COLUMN if exists volatility;
+ALTER TABLE snapshots DROP COLUMN if exists ewma;
+ALTER TABLE snapshots DROP COLUMN if exists change7d;
+ALTER TABLE snapshots DROP COLUMN if exists change24h;
+ALTER TABLE snapshots DROP COLUMN if exists change1h;
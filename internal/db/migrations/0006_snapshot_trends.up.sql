@@ -0,0 +1,7 @@
+ALTER TABLE snapshots ADD COLUMN if not exists change1h REAL;
+ALTER TABLE snapshots ADD COLUMN if not exists change24h REAL;
+ALTER TABLE snapshots ADD COLUMN if not exists change7d REAL;
+ALTER TABLE snapshots ADD COLUMN if not exists ewma REAL NOT NULL DEFAULT 0;
+ALTER TABLE snapshots ADD COLUMN if not exists volatility REAL NOT NULL DEFAULT 0;
+
+CREATE INDEX if not exists snapshots_by_generatedat ON snapshots (generatedAt);
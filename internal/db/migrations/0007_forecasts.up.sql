@@ -0,0 +1,17 @@
+CREATE TABLE if not exists forecasts(
+  id BIGSERIAL PRIMARY KEY NOT NULL,
+  setId BIGINT NOT NULL,
+  jewelType TEXT NOT NULL,
+  jewelClass TEXT NOT NULL,
+  allocatedNode TEXT NOT NULL,
+  horizonHours INTEGER NOT NULL,
+  forecastPrice REAL NOT NULL,
+  lowerPrice REAL NOT NULL,
+  upperPrice REAL NOT NULL,
+  seasonal BOOLEAN NOT NULL,
+  generatedAt TIMESTAMPTZ NOT NULL,
+  targetAt TIMESTAMPTZ NOT NULL,
+  CONSTRAINT fk_set FOREIGN KEY(setId) REFERENCES snapshot_sets(id)
+);
+
+CREATE INDEX if not exists forecasts_by_setid ON forecasts (setId);
@@ -0,0 +1 @@
+DROP TABLE if exists snapshot_diagnostics;
@@ -0,0 +1,20 @@
+CREATE TABLE if not exists snapshot_diagnostics(
+  id BIGSERIAL PRIMARY KEY NOT NULL,
+  setId BIGINT NOT NULL,
+  jewelType TEXT NOT NULL,
+  jewelClass TEXT NOT NULL,
+  allocatedNode TEXT NOT NULL,
+  estimator TEXT NOT NULL,
+  prices REAL[] NOT NULL,
+  dendrogram JSONB,
+  silhouettes REAL[],
+  cutCriterion TEXT,
+  cutScores REAL[],
+  cutLevel INTEGER,
+  inlierPrices REAL[],
+  notes TEXT[] NOT NULL,
+  generatedAt TIMESTAMPTZ NOT NULL,
+  CONSTRAINT fk_set FOREIGN KEY(setId) REFERENCES snapshot_sets(id)
+);
+
+CREATE INDEX if not exists snapshot_diagnostics_by_key ON snapshot_diagnostics (jewelType,jewelClass,allocatedNode,generatedAt);
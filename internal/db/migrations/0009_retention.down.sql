@@ -0,0 +1,3 @@
+DROP INDEX if exists snapshots_by_resolution_date;
+ALTER TABLE snapshots DROP COLUMN if exists resolution;
+DROP TABLE if exists changeset_rollups;
@@ -0,0 +1,17 @@
+-- Old changesets are folded into one row per hour by the retention command.
+-- Drift is kept as a sum and a sample count so partial hours can be merged.
+CREATE TABLE if not exists changeset_rollups(
+  hourStart TIMESTAMPTZ PRIMARY KEY NOT NULL,
+  pages INTEGER NOT NULL,
+  stashCount BIGINT NOT NULL,
+  timeTaken BIGINT NOT NULL,
+  minDrift INTEGER,
+  maxDrift INTEGER,
+  driftSum BIGINT NOT NULL,
+  driftSamples INTEGER NOT NULL
+);
+
+-- 'raw' for snapshots as collect-stats wrote them, 'hourly' or 'daily' once
+-- retention has merged them into one row per key per bucket
+ALTER TABLE snapshots ADD COLUMN if not exists resolution TEXT NOT NULL DEFAULT 'raw';
+CREATE INDEX if not exists snapshots_by_resolution_date ON snapshots (resolution,generatedAt);
@@ -0,0 +1,32 @@
+-- Folds every partition back into a plain table. Fails if changesets has
+-- picked up duplicate change ids since the unique constraints were dropped.
+ALTER TABLE changesets RENAME TO changesets_partitioned;
+CREATE TABLE changesets (LIKE changesets_partitioned INCLUDING DEFAULTS);
+INSERT INTO changesets SELECT * FROM changesets_partitioned;
+ALTER SEQUENCE changesets_id_seq OWNED BY changesets.id;
+DROP TABLE changesets_partitioned;
+ALTER TABLE changesets ADD PRIMARY KEY (id);
+ALTER TABLE changesets ADD UNIQUE (changeId);
+ALTER TABLE changesets ADD UNIQUE (nextChangeId);
+CREATE INDEX changesets_by_changeid ON changesets (changeId);
+CREATE INDEX changesets_by_date ON changesets (processedAt);
+
+ALTER TABLE snapshots RENAME TO snapshots_partitioned;
+CREATE TABLE snapshots (LIKE snapshots_partitioned INCLUDING DEFAULTS);
+INSERT INTO snapshots SELECT * FROM snapshots_partitioned;
+ALTER SEQUENCE snapshots_id_seq OWNED BY snapshots.id;
+DROP TABLE snapshots_partitioned;
+ALTER TABLE snapshots ADD PRIMARY KEY (id);
+ALTER TABLE snapshots ADD CONSTRAINT fk_set FOREIGN KEY(setId) REFERENCES snapshot_sets(id);
+CREATE INDEX snapshots_by_setid ON snapshots (setId);
+CREATE INDEX snapshots_by_generatedat ON snapshots (generatedAt);
+CREATE INDEX snapshots_by_resolution_date ON snapshots (resolution,generatedAt);
+
+ALTER TABLE jewel_history RENAME TO jewel_history_partitioned;
+CREATE TABLE jewel_history (LIKE jewel_history_partitioned INCLUDING DEFAULTS);
+INSERT INTO jewel_history SELECT * FROM jewel_history_partitioned;
+ALTER SEQUENCE jewel_history_id_seq OWNED BY jewel_history.id;
+DROP TABLE jewel_history_partitioned;
+ALTER TABLE jewel_history ADD PRIMARY KEY (id);
+CREATE INDEX jewel_history_by_league_date ON jewel_history (league,delistedAt);
+CREATE INDEX jewel_history_by_account ON jewel_history (accountName,delistedAt);
@@ -0,0 +1,57 @@
+-- changesets, snapshots and jewel_history become range partitioned by month
+-- on their timestamp, so retention can drop a whole month at once instead
+-- of deleting row by row. The daemons create upcoming partitions on startup
+-- (see db.EnsurePartitions); this only covers the data that already exists.
+--
+-- Unique constraints on a partitioned table have to include the partition
+-- key, so ids become unique per (id, timestamp) and changeId/nextChangeId
+-- lose their unique constraints. Leadership already keeps a single reader
+-- writing changesets.
+CREATE FUNCTION pg_temp.create_monthly_partitions(parent TEXT, oldest TIMESTAMPTZ, newest TIMESTAMPTZ) RETURNS void AS $$
+DECLARE
+  m TIMESTAMP;
+BEGIN
+  FOR m IN
+    SELECT generate_series(
+      date_trunc('month', coalesce(oldest, now()) AT TIME ZONE 'UTC'),
+      date_trunc('month', greatest(newest, now()) AT TIME ZONE 'UTC') + interval '2 months',
+      interval '1 month')
+  LOOP
+    EXECUTE format('CREATE TABLE if not exists %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+      parent || '_p' || to_char(m, 'YYYYMM'), parent,
+      m AT TIME ZONE 'UTC', (m + interval '1 month') AT TIME ZONE 'UTC');
+  END LOOP;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE changesets RENAME TO changesets_unpartitioned;
+CREATE TABLE changesets (LIKE changesets_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (processedAt);
+SELECT pg_temp.create_monthly_partitions('changesets', min(processedAt), max(processedAt)) FROM changesets_unpartitioned;
+INSERT INTO changesets SELECT * FROM changesets_unpartitioned;
+ALTER SEQUENCE changesets_id_seq OWNED BY changesets.id;
+DROP TABLE changesets_unpartitioned;
+ALTER TABLE changesets ADD PRIMARY KEY (id,processedAt);
+CREATE INDEX changesets_by_changeid ON changesets (changeId);
+CREATE INDEX changesets_by_date ON changesets (processedAt);
+
+ALTER TABLE snapshots RENAME TO snapshots_unpartitioned;
+CREATE TABLE snapshots (LIKE snapshots_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (generatedAt);
+SELECT pg_temp.create_monthly_partitions('snapshots', min(generatedAt), max(generatedAt)) FROM snapshots_unpartitioned;
+INSERT INTO snapshots SELECT * FROM snapshots_unpartitioned;
+ALTER SEQUENCE snapshots_id_seq OWNED BY snapshots.id;
+DROP TABLE snapshots_unpartitioned;
+ALTER TABLE snapshots ADD PRIMARY KEY (id,generatedAt);
+ALTER TABLE snapshots ADD CONSTRAINT fk_set FOREIGN KEY(setId) REFERENCES snapshot_sets(id);
+CREATE INDEX snapshots_by_setid ON snapshots (setId);
+CREATE INDEX snapshots_by_generatedat ON snapshots (generatedAt);
+CREATE INDEX snapshots_by_resolution_date ON snapshots (resolution,generatedAt);
+
+ALTER TABLE jewel_history RENAME TO jewel_history_unpartitioned;
+CREATE TABLE jewel_history (LIKE jewel_history_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (delistedAt);
+SELECT pg_temp.create_monthly_partitions('jewel_history', min(delistedAt), max(delistedAt)) FROM jewel_history_unpartitioned;
+INSERT INTO jewel_history SELECT * FROM jewel_history_unpartitioned;
+ALTER SEQUENCE jewel_history_id_seq OWNED BY jewel_history.id;
+DROP TABLE jewel_history_unpartitioned;
+ALTER TABLE jewel_history ADD PRIMARY KEY (id,delistedAt);
+CREATE INDEX jewel_history_by_league_date ON jewel_history (league,delistedAt);
+CREATE INDEX jewel_history_by_account ON jewel_history (accountName,delistedAt);
@@ -0,0 +1,3 @@
+-- Drift from the river head on each shard of the change id, alongside the
+-- total in driftFromHead
+ALTER TABLE changesets ADD COLUMN if not exists shardDrift BIGINT[];
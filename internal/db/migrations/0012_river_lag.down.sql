@@ -0,0 +1 @@
+ALTER TABLE changesets DROP COLUMN if exists lagMinutes;
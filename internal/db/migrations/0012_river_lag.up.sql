@@ -0,0 +1,2 @@
+-- driftFromHead converted into minutes using the head's advancement rate
+ALTER TABLE changesets ADD COLUMN if not exists lagMinutes REAL;
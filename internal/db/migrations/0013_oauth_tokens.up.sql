@@ -0,0 +1,9 @@
+-- Access tokens from the client_credentials grant, so restarts reuse them
+CREATE TABLE if not exists oauth_tokens(
+  clientId TEXT NOT NULL,
+  scope TEXT NOT NULL,
+  accessToken TEXT NOT NULL,
+  obtainedAt TIMESTAMPTZ NOT NULL,
+  expiresAt TIMESTAMPTZ,
+  PRIMARY KEY (clientId,scope)
+);
@@ -0,0 +1,29 @@
+-- Console data can't be told apart from PC data without the realm column,
+-- so it is dropped rather than merged in
+DELETE FROM forecasts WHERE setId IN (SELECT id FROM snapshot_sets WHERE realm != 'pc');
+DELETE FROM snapshot_diagnostics WHERE setId IN (SELECT id FROM snapshot_sets WHERE realm != 'pc');
+DELETE FROM flagged_listings WHERE setId IN (SELECT id FROM snapshot_sets WHERE realm != 'pc');
+DELETE FROM snapshots WHERE setId IN (SELECT id FROM snapshot_sets WHERE realm != 'pc');
+DELETE FROM snapshot_sets WHERE realm != 'pc';
+DROP INDEX if exists snapshot_sets_by_realm_league;
+ALTER TABLE snapshot_sets DROP COLUMN if exists realm;
+CREATE INDEX if not exists snapshot_sets_by_league ON snapshot_sets (league);
+
+DELETE FROM changeset_rollups WHERE realm != 'pc';
+ALTER TABLE changeset_rollups DROP CONSTRAINT if exists changeset_rollups_pkey;
+ALTER TABLE changeset_rollups DROP COLUMN if exists realm;
+ALTER TABLE changeset_rollups ADD PRIMARY KEY (hourStart);
+
+DELETE FROM changesets WHERE realm != 'pc';
+DROP INDEX if exists changesets_by_realm_date;
+ALTER TABLE changesets DROP COLUMN if exists realm;
+
+DELETE FROM jewel_history WHERE realm != 'pc';
+DROP INDEX if exists jewel_history_by_realm_league_date;
+ALTER TABLE jewel_history DROP COLUMN if exists realm;
+CREATE INDEX if not exists jewel_history_by_league_date ON jewel_history (league,delistedAt);
+
+DELETE FROM jewels WHERE realm != 'pc';
+DROP INDEX if exists jewels_by_realm_league_date;
+ALTER TABLE jewels DROP COLUMN if exists realm;
+CREATE INDEX if not exists jewels_by_league_date ON jewels (league,recordedAt);
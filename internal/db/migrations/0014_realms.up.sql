@@ -0,0 +1,21 @@
+-- GGG runs a separate public stash river for each realm (pc, xbox, sony).
+-- Everything read before realms were tracked came from the PC river.
+ALTER TABLE jewels ADD COLUMN if not exists realm TEXT NOT NULL DEFAULT 'pc';
+DROP INDEX if exists jewels_by_league_date;
+CREATE INDEX if not exists jewels_by_realm_league_date ON jewels (realm,league,recordedAt);
+
+ALTER TABLE jewel_history ADD COLUMN if not exists realm TEXT NOT NULL DEFAULT 'pc';
+DROP INDEX if exists jewel_history_by_league_date;
+CREATE INDEX if not exists jewel_history_by_realm_league_date ON jewel_history (realm,league,delistedAt);
+
+-- Each realm's reader resumes from its own newest changeset
+ALTER TABLE changesets ADD COLUMN if not exists realm TEXT NOT NULL DEFAULT 'pc';
+CREATE INDEX if not exists changesets_by_realm_date ON changesets (realm,processedAt);
+
+ALTER TABLE changeset_rollups ADD COLUMN if not exists realm TEXT NOT NULL DEFAULT 'pc';
+ALTER TABLE changeset_rollups DROP CONSTRAINT if exists changeset_rollups_pkey;
+ALTER TABLE changeset_rollups ADD PRIMARY KEY (realm,hourStart);
+
+ALTER TABLE snapshot_sets ADD COLUMN if not exists realm TEXT NOT NULL DEFAULT 'pc';
+DROP INDEX if exists snapshot_sets_by_league;
+CREATE INDEX if not exists snapshot_sets_by_realm_league ON snapshot_sets (realm,league,generatedAt);
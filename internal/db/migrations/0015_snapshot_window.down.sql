@@ -0,0 +1,2 @@
+ALTER TABLE snapshot_sets DROP COLUMN if exists halfLifeSeconds;
+ALTER TABLE snapshot_sets DROP COLUMN if exists windowSeconds;
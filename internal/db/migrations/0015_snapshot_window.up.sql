@@ -0,0 +1,5 @@
+-- The window and half-life each set's snapshots were computed with, so a
+-- config change recomputes every key rather than carrying old snapshots
+-- forward. Null for sets from before they were recorded.
+ALTER TABLE snapshot_sets ADD COLUMN if not exists windowSeconds BIGINT;
+ALTER TABLE snapshot_sets ADD COLUMN if not exists halfLifeSeconds BIGINT;
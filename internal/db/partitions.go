@@ -0,0 +1,145 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// How many months past the current one get a partition ahead of time
+const PARTITIONS_AHEAD = 2
+
+const SELECT_PARTITIONS_QUERY = `
+SELECT c.relname FROM pg_inherits i
+  JOIN pg_class c ON c.oid = i.inhrelid
+  WHERE i.inhparent = $1::regclass
+`
+
+type PartitionedTable struct {
+	Name string
+	// The timestamp column the table is partitioned on
+	Key string
+	// Optional column whose every value must have rows newer than a
+	// partition before the partition can be dropped
+	Group string
+}
+
+// Tables range partitioned by month since 0010_monthly_partitions
+var PartitionedTables = []PartitionedTable{
+	{"changesets", "processedAt", "realm"},
+	{"snapshots", "generatedAt", ""},
+	{"jewel_history", "delistedAt", ""},
+}
+
+// Partitions are named <table>_pYYYYMM after the (UTC) month they hold
+var partitionNamePattern = regexp.MustCompile(`_p(\d{6})$`)
+
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func partitionName(table string, month time.Time) string {
+	return fmt.Sprintf("%s_p%s", table, month.Format("200601"))
+}
+
+// Creates the partitions for the month of `now` and the PARTITIONS_AHEAD
+// months after it, for every partitioned table. Safe to run from several
+// daemons at once. Returns how many partitions were created.
+func EnsurePartitions(ctx context.Context, pool *pgxpool.Pool, now time.Time) (int, error) {
+	created := 0
+	err := pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", advisoryLockKey("partitions")); err != nil {
+			return err
+		}
+
+		for _, t := range PartitionedTables {
+			for i := 0; i <= PARTITIONS_AHEAD; i++ {
+				month := monthStart(now).AddDate(0, i, 0)
+				name := partitionName(t.Name, month)
+				var exists bool
+				if err := tx.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", name).Scan(&exists); err != nil {
+					return err
+				}
+				if exists {
+					continue
+				}
+
+				query := fmt.Sprintf("CREATE TABLE %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+					pgx.Identifier{name}.Sanitize(), pgx.Identifier{t.Name}.Sanitize(),
+					month.Format(time.RFC3339), month.AddDate(0, 1, 0).Format(time.RFC3339))
+				if _, err := tx.Exec(ctx, query); err != nil {
+					return fmt.Errorf("creating partition %s: %w", name, err)
+				}
+				created++
+			}
+		}
+		return nil
+	})
+	return created, err
+}
+
+// Detaches and drops every partition whose whole month lies before
+// `cutoff`. A table's newest partition with any rows is always kept, and
+// changesets keeps each realm's newest, so no reader loses the row it
+// resumes from. Returns how many partitions were dropped.
+func DropPartitionsBefore(ctx context.Context, pool *pgxpool.Pool, cutoff time.Time, l *log.Logger) (int, error) {
+	dropped := 0
+	for _, t := range PartitionedTables {
+		rows, _ := pool.Query(ctx, SELECT_PARTITIONS_QUERY, t.Name)
+		names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return dropped, err
+		}
+
+		for _, name := range names {
+			match := partitionNamePattern.FindStringSubmatch(name)
+			if match == nil {
+				continue
+			}
+			month, err := time.Parse("200601", match[1])
+			if err != nil {
+				return dropped, err
+			}
+			end := month.AddDate(0, 1, 0)
+			if end.After(cutoff) {
+				continue
+			}
+
+			var newerRows bool
+			table := pgx.Identifier{t.Name}.Sanitize()
+			query := fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s WHERE %s >= $1)", table, t.Key)
+			if t.Group != "" {
+				query = fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %[1]s WHERE %[2]s >= $1) AND NOT EXISTS(SELECT 1 FROM %[1]s o WHERE o.%[2]s < $1 AND NOT EXISTS(SELECT 1 FROM %[1]s n WHERE n.%[3]s = o.%[3]s AND n.%[2]s >= $1))",
+					table, t.Key, t.Group)
+			}
+			if err = pool.QueryRow(ctx, query, end).Scan(&newerRows); err != nil {
+				return dropped, err
+			}
+			if !newerRows {
+				l.Printf("keeping %s, it may hold the newest rows of %s\n", name, t.Name)
+				continue
+			}
+
+			err = pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+				detach := fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", pgx.Identifier{t.Name}.Sanitize(), pgx.Identifier{name}.Sanitize())
+				if _, err := tx.Exec(ctx, detach); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, "DROP TABLE "+pgx.Identifier{name}.Sanitize())
+				return err
+			})
+			if err != nil {
+				return dropped, fmt.Errorf("dropping partition %s: %w", name, err)
+			}
+			l.Printf("dropped partition %s\n", name)
+			dropped++
+		}
+	}
+	return dropped, nil
+}
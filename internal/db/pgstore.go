@@ -0,0 +1,741 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Locks the rows until the page's changes are applied
+const SELECT_STASH_JEWELS_QUERY = `
+SELECT *
+  FROM jewels
+  WHERE stashId = any($1)
+  FOR UPDATE
+  `
+
+// Delisted jewels are moved into jewel_history rather than dropped, so the
+// stats job can look at how long a seller's listings tend to stay up
+const DELETE_JEWEL_QUERY = `
+WITH delisted AS (
+  DELETE
+    FROM jewels
+    WHERE id = $1
+    RETURNING *
+)
+INSERT INTO jewel_history(itemId,accountName,realm,league,jewelType,jewelClass,allocatedNode,listPriceAmount,listPriceCurrency,priceChanges,firstSeenAt,delistedAt)
+  SELECT itemId,accountName,realm,league,jewelType,jewelClass,allocatedNode,listPriceAmount,listPriceCurrency,priceChanges,firstSeenAt,$2
+  FROM delisted
+  `
+
+const UPDATE_JEWEL_PRICE_QUERY = `
+UPDATE jewels
+  SET stashId = $1, listPriceAmount = $2, listPriceCurrency = $3, lastChangeId = $4, recordedAt = $5, accountName = $7,
+    priceChanges = priceChanges + CASE WHEN listPriceAmount != $2 OR listPriceCurrency != $3 THEN 1 ELSE 0 END
+  WHERE id = $6
+  `
+
+const UPSERT_JEWEL_QUERY = `
+INSERT INTO jewels(jewelType,jewelClass,allocatedNode,itemId,stashId,league,listPriceAmount,listPriceCurrency,lastChangeId,recordedAt,accountName,firstSeenAt,realm)
+  VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$10,$12)
+  ON CONFLICT(itemId)
+  DO
+    UPDATE SET stashId = $5, listPriceAmount = $7, listPriceCurrency = $8, lastChangeId = $9, recordedAt = $10, accountName = $11,
+      priceChanges = jewels.priceChanges + CASE WHEN jewels.listPriceAmount != $7 OR jewels.listPriceCurrency != $8 THEN 1 ELSE 0 END
+`
+
+// Staging tables for ReplaceStashContents, filled with COPY and dropped when
+// the transaction ends
+const CREATE_STAGED_STASHES_QUERY = `
+CREATE TEMP TABLE staged_stashes(
+  stashId TEXT NOT NULL,
+  recordedAt TIMESTAMPTZ NOT NULL
+) ON COMMIT DROP
+`
+
+const CREATE_STAGED_JEWELS_QUERY = `
+CREATE TEMP TABLE staged_jewels(
+  jewelType TEXT NOT NULL,
+  jewelClass TEXT NOT NULL,
+  allocatedNode TEXT NOT NULL,
+  itemId TEXT NOT NULL,
+  stashId TEXT NOT NULL,
+  realm TEXT NOT NULL,
+  league TEXT NOT NULL,
+  listPriceAmount REAL NOT NULL,
+  listPriceCurrency TEXT NOT NULL,
+  lastChangeId TEXT NOT NULL,
+  recordedAt TIMESTAMPTZ NOT NULL,
+  accountName TEXT NOT NULL
+) ON COMMIT DROP
+`
+
+// Listings in a staged stash that aren't anywhere on the page anymore
+const DELIST_STAGED_JEWELS_QUERY = `
+WITH delisted AS (
+  DELETE
+    FROM jewels j
+    USING staged_stashes s
+    WHERE j.stashId = s.stashId
+      AND NOT EXISTS (SELECT 1 FROM staged_jewels sj WHERE sj.itemId = j.itemId)
+    RETURNING j.*, s.recordedAt AS delistedAt
+)
+INSERT INTO jewel_history(itemId,accountName,realm,league,jewelType,jewelClass,allocatedNode,listPriceAmount,listPriceCurrency,priceChanges,firstSeenAt,delistedAt)
+  SELECT itemId,accountName,realm,league,jewelType,jewelClass,allocatedNode,listPriceAmount,listPriceCurrency,priceChanges,firstSeenAt,delistedAt
+  FROM delisted
+`
+
+// Unchanged listings are left alone, like UpdateDb does when diffing
+const UPSERT_STAGED_JEWELS_QUERY = `
+INSERT INTO jewels(jewelType,jewelClass,allocatedNode,itemId,stashId,realm,league,listPriceAmount,listPriceCurrency,lastChangeId,recordedAt,accountName,firstSeenAt)
+  SELECT jewelType,jewelClass,allocatedNode,itemId,stashId,realm,league,listPriceAmount,listPriceCurrency,lastChangeId,recordedAt,accountName,recordedAt
+  FROM staged_jewels
+  ON CONFLICT(itemId)
+  DO
+    UPDATE SET stashId = excluded.stashId, listPriceAmount = excluded.listPriceAmount, listPriceCurrency = excluded.listPriceCurrency,
+      lastChangeId = excluded.lastChangeId, recordedAt = excluded.recordedAt, accountName = excluded.accountName,
+      priceChanges = jewels.priceChanges + CASE WHEN jewels.listPriceAmount != excluded.listPriceAmount OR jewels.listPriceCurrency != excluded.listPriceCurrency THEN 1 ELSE 0 END
+    WHERE jewels.listPriceAmount != excluded.listPriceAmount OR jewels.listPriceCurrency != excluded.listPriceCurrency
+      OR jewels.stashId != excluded.stashId OR jewels.accountName != excluded.accountName
+`
+
+const SELECT_JEWELS_SINCE_QUERY = `
+SELECT j.*
+  FROM jewels j
+  JOIN unnest($2::text[], $3::timestamptz[]) AS w(league, cutoff) ON j.league = w.league
+  WHERE j.realm = $1 AND j.recordedAt > w.cutoff
+`
+
+const SELECT_JEWELS_BY_KEY_QUERY = `
+SELECT j.*
+  FROM jewels j
+  JOIN unnest($1::text[], $2::text[], $3::text[], $4::text[], $5::text[], $6::timestamptz[]) AS k(realm, league, jewelType, jewelClass, allocatedNode, cutoff)
+    ON j.realm = k.realm AND j.league = k.league AND j.jewelType = k.jewelType AND j.jewelClass = k.jewelClass AND j.allocatedNode = k.allocatedNode
+  WHERE j.recordedAt > k.cutoff
+`
+
+const SELECT_CHANGED_KEYS_QUERY = `
+SELECT realm, league, jewelType, jewelClass, allocatedNode
+  FROM jewels
+  WHERE realm = $1 AND league = $2 AND (recordedAt > $3 OR (recordedAt > $4 AND recordedAt <= $5) OR listPriceCurrency = any($6))
+UNION
+SELECT realm, league, jewelType, jewelClass, allocatedNode
+  FROM jewel_history
+  WHERE realm = $1 AND league = $2 AND delistedAt > $3
+`
+
+const SELECT_QUICK_DELISTINGS_QUERY = `
+SELECT *
+  FROM jewel_history
+  WHERE realm = $1 AND league = any($2) AND accountName != '' AND delistedAt > $3 AND delistedAt - firstSeenAt < $4
+`
+
+const INSERT_CHANGESET_QUERY = `
+INSERT INTO changesets(realm,changeId,nextChangeId,stashCount,processedAt,timeTaken,driftFromHead,shardDrift,lagMinutes)
+  VALUES (@realm,@changeId,@nextChangeId,@stashCount,@processedAt,@timeTaken,@driftFromHead,@shardDrift,@lagMinutes)
+`
+
+const SELECT_OAUTH_TOKEN_QUERY = `
+SELECT * FROM oauth_tokens WHERE clientId = $1 AND scope = $2
+`
+
+const UPSERT_OAUTH_TOKEN_QUERY = `
+INSERT INTO oauth_tokens(clientId,scope,accessToken,obtainedAt,expiresAt)
+  VALUES (@clientId,@scope,@accessToken,@obtainedAt,@expiresAt)
+  ON CONFLICT(clientId,scope)
+  DO
+    UPDATE SET accessToken = excluded.accessToken, obtainedAt = excluded.obtainedAt, expiresAt = excluded.expiresAt
+`
+
+const SELECT_LATEST_SETS_QUERY = `
+SELECT DISTINCT ON (league) *
+  FROM snapshot_sets
+  WHERE realm = $1 AND league = any($2)
+  ORDER BY league, generatedAt DESC
+`
+
+const SELECT_PRIOR_FLAGS_QUERY = `
+SELECT f.accountName, count(DISTINCT f.itemId)
+  FROM flagged_listings f
+  JOIN snapshot_sets ss ON ss.id = f.setId
+  WHERE ss.realm = $1 AND f.accountName != '' AND f.flaggedAt > $2
+  GROUP BY f.accountName
+`
+
+const SELECT_SNAPSHOT_HISTORY_QUERY = `
+SELECT ss.realm, ss.league, s.jewelType, s.jewelClass, s.allocatedNode, s.windowPrice, s.generatedAt
+  FROM snapshots s
+  JOIN snapshot_sets ss ON ss.id = s.setId
+  WHERE ss.realm = $1 AND ss.league = any($2) AND s.generatedAt > $3
+  ORDER BY s.generatedAt
+`
+
+const INSERT_SNAPSHOT_SET_QUERY = `
+INSERT INTO snapshot_sets(realm, league, exchangeRates, generatedAt, windowSeconds, halfLifeSeconds)
+  VALUES (@realm, @league, @exchangeRates, @generatedAt, @windowSeconds, @halfLifeSeconds)
+  RETURNING id
+`
+
+const INSERT_SNAPSHOT_QUERY = `
+INSERT INTO snapshots(setId,jewelType,jewelClass,allocatedNode,minPrice,firstQuartilePrice,medianPrice,thirdQuartilePrice,maxPrice,windowPrice,confidence,stddev,numListed,numSellers,prices,inlierPrices,change1h,change24h,change7d,ewma,volatility,generatedAt)
+  VALUES (@setId,@jewelType,@jewelClass,@allocatedNode,@minPrice,@q1Price,@medianPrice,@q3Price,@maxPrice,@windowPrice,@confidence,@stddev,@numListed,@numSellers,@prices,@inlierPrices,@change1h,@change24h,@change7d,@ewma,@volatility,@generatedAt)
+`
+
+const INSERT_FLAGGED_LISTING_QUERY = `
+INSERT INTO flagged_listings(setId,itemId,accountName,jewelType,jewelClass,allocatedNode,chaosPrice,windowPrice,reasons,flaggedAt)
+  VALUES (@setId,@itemId,@accountName,@jewelType,@jewelClass,@allocatedNode,@chaosPrice,@windowPrice,@reasons,@flaggedAt)
+`
+
+const INSERT_FORECAST_QUERY = `
+INSERT INTO forecasts(setId,jewelType,jewelClass,allocatedNode,horizonHours,forecastPrice,lowerPrice,upperPrice,seasonal,generatedAt,targetAt)
+  VALUES (@setId,@jewelType,@jewelClass,@allocatedNode,@horizonHours,@forecastPrice,@lowerPrice,@upperPrice,@seasonal,@generatedAt,@targetAt)
+`
+
+const INSERT_DIAGNOSTICS_QUERY = `
+INSERT INTO snapshot_diagnostics(setId,jewelType,jewelClass,allocatedNode,estimator,prices,dendrogram,silhouettes,cutCriterion,cutScores,cutLevel,inlierPrices,notes,generatedAt)
+  VALUES (@setId,@jewelType,@jewelClass,@allocatedNode,@estimator,@prices,@dendrogram,@silhouettes,@cutCriterion,@cutScores,@cutLevel,@inlierPrices,@notes,@generatedAt)
+`
+
+const SELECT_NODE_JEWELS_QUERY = `
+SELECT *
+  FROM jewels
+  WHERE realm = $1 AND league = $2 AND jewelType = $3 AND allocatedNode = $4
+  ORDER BY recordedAt DESC
+`
+
+const SELECT_LATEST_SNAPSHOTS_QUERY = `
+SELECT s.*, ss.realm, ss.league
+  FROM snapshots s
+  JOIN snapshot_sets ss ON ss.id = s.setId
+  WHERE s.setId IN (
+    SELECT DISTINCT ON (realm, league) id FROM snapshot_sets ORDER BY realm, league, generatedAt DESC
+  )
+  ORDER BY ss.realm, ss.league, s.jewelType, s.jewelClass, s.allocatedNode
+`
+
+const SELECT_LATEST_KEY_SNAPSHOT_QUERY = `
+SELECT s.*, ss.realm, ss.league
+  FROM snapshots s
+  JOIN snapshot_sets ss ON ss.id = s.setId
+  WHERE ss.realm = $1 AND ss.league = $2 AND s.jewelType = $3 AND s.jewelClass = $4 AND s.allocatedNode = $5
+  ORDER BY s.generatedAt DESC
+  LIMIT 1
+`
+
+const SELECT_LATEST_NODE_FLAGS_QUERY = `
+SELECT *
+  FROM flagged_listings
+  WHERE setId = (SELECT id FROM snapshot_sets WHERE realm = $1 AND league = $2 ORDER BY generatedAt DESC LIMIT 1)
+    AND jewelType = $3 AND allocatedNode = $4
+`
+
+const SELECT_LATEST_FORECASTS_QUERY = `
+SELECT *
+  FROM forecasts
+  WHERE setId = (SELECT id FROM snapshot_sets WHERE realm = $1 AND league = $2 ORDER BY generatedAt DESC LIMIT 1)
+  ORDER BY jewelType, jewelClass, allocatedNode, horizonHours
+`
+
+const SELECT_LATEST_DIAGNOSTICS_QUERY = `
+SELECT d.*
+  FROM snapshot_diagnostics d
+  JOIN snapshot_sets ss ON ss.id = d.setId
+  WHERE ss.realm = $1 AND ss.league = $2 AND d.jewelType = $3 AND d.jewelClass = $4 AND d.allocatedNode = $5
+  ORDER BY d.generatedAt DESC
+  LIMIT 1
+`
+
+// Returns how many changesets were folded
+const ROLLUP_CHANGESETS_QUERY = `
+WITH batch AS (
+  DELETE FROM changesets
+    WHERE id IN (
+      SELECT id FROM changesets
+        WHERE processedAt < $1
+          AND id NOT IN (SELECT DISTINCT ON (realm) id FROM changesets ORDER BY realm, processedAt DESC)
+        ORDER BY processedAt
+        LIMIT $2
+    )
+    RETURNING *
+), rollup AS (
+  INSERT INTO changeset_rollups(realm,hourStart,pages,stashCount,timeTaken,minDrift,maxDrift,driftSum,driftSamples)
+    SELECT realm, date_trunc('hour', processedAt), count(*), sum(stashCount), sum(timeTaken), min(driftFromHead), max(driftFromHead), coalesce(sum(driftFromHead), 0), count(driftFromHead)
+    FROM batch
+    GROUP BY 1, 2
+    ON CONFLICT(realm,hourStart)
+    DO
+      UPDATE SET pages = changeset_rollups.pages + excluded.pages,
+        stashCount = changeset_rollups.stashCount + excluded.stashCount,
+        timeTaken = changeset_rollups.timeTaken + excluded.timeTaken,
+        minDrift = least(changeset_rollups.minDrift, excluded.minDrift),
+        maxDrift = greatest(changeset_rollups.maxDrift, excluded.maxDrift),
+        driftSum = changeset_rollups.driftSum + excluded.driftSum,
+        driftSamples = changeset_rollups.driftSamples + excluded.driftSamples
+)
+SELECT count(*) FROM batch
+`
+
+const SELECT_OLDEST_SNAPSHOT_QUERY = `
+SELECT min(generatedAt) FROM snapshots WHERE resolution = $1 AND generatedAt < $2
+`
+
+const MERGE_SNAPSHOT_BUCKET_QUERY = `
+UPDATE snapshots s
+  SET minPrice = b.minPrice, medianPrice = b.medianPrice, windowPrice = b.windowPrice, resolution = $4
+  FROM (
+    SELECT max(s.id) AS keepId,
+      min(s.minPrice) AS minPrice,
+      percentile_cont(0.5) WITHIN GROUP (ORDER BY s.medianPrice) AS medianPrice,
+      percentile_cont(0.5) WITHIN GROUP (ORDER BY s.windowPrice) AS windowPrice
+    FROM snapshots s
+    JOIN snapshot_sets ss ON ss.id = s.setId
+    WHERE s.resolution = $1 AND s.generatedAt >= $2 AND s.generatedAt < $3
+    GROUP BY ss.realm, ss.league, s.jewelType, s.jewelClass, s.allocatedNode
+  ) b
+  WHERE s.id = b.keepId
+`
+
+const DELETE_MERGED_SNAPSHOTS_QUERY = `
+DELETE FROM snapshots WHERE resolution = $1 AND generatedAt >= $2 AND generatedAt < $3
+`
+
+const SELECT_EXPIRED_HISTORY_QUERY = `
+SELECT * FROM jewel_history WHERE delistedAt < $1 ORDER BY id LIMIT $2
+`
+
+// Implements every store on top of Postgres
+type PGStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPGStore(pool *pgxpool.Pool) *PGStore {
+	return &PGStore{pool}
+}
+
+func (s *PGStore) CheckSchema(ctx context.Context) error {
+	return CheckSchema(ctx, s.pool)
+}
+
+func (s *PGStore) AcquireLeadership(ctx context.Context, role string, workerId string, l *log.Logger) (*Leader, error) {
+	return AcquireLeadership(ctx, s.pool, role, workerId, l)
+}
+
+func (s *PGStore) PreparePartitions(ctx context.Context, now time.Time) error {
+	_, err := EnsurePartitions(ctx, s.pool, now)
+	return err
+}
+
+func (s *PGStore) Close() {
+	s.pool.Close()
+}
+
+func (s *PGStore) UpdateStashJewels(ctx context.Context, stashIds []string, diff func(existing []DBJewel) (JewelChanges, error)) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		rows, _ := tx.Query(ctx, SELECT_STASH_JEWELS_QUERY, stashIds)
+		existing, err := pgx.CollectRows(rows, pgx.RowToStructByName[DBJewel])
+		if err != nil {
+			return err
+		}
+		changes, err := diff(existing)
+		if err != nil {
+			return err
+		}
+		return tx.SendBatch(ctx, jewelChangesBatch(changes)).Close()
+	})
+}
+
+func jewelChangesBatch(changes JewelChanges) *pgx.Batch {
+	batch := &pgx.Batch{}
+	for _, d := range changes.Delisted {
+		batch.Queue(DELETE_JEWEL_QUERY, d.Id, d.DelistedAt)
+	}
+	for _, j := range changes.Updated {
+		batch.Queue(UPDATE_JEWEL_PRICE_QUERY, j.StashId, j.ListPriceAmount, j.ListPriceCurrency, j.LastChangeId, j.RecordedAt, j.Id, j.AccountName)
+	}
+	for _, j := range changes.Upserted {
+		batch.Queue(UPSERT_JEWEL_QUERY, j.JewelType, j.JewelClass, j.AllocatedNode, j.ItemId, j.StashId, j.League, j.ListPriceAmount, j.ListPriceCurrency, j.LastChangeId, j.RecordedAt, j.AccountName, j.Realm)
+	}
+	return batch
+}
+
+// Stages the page with COPY and applies it as one delete and one upsert.
+// COPY column names are quoted, so they're given in the lowercase Postgres
+// folds the table's unquoted names to.
+func (s *PGStore) ReplaceStashContents(ctx context.Context, stashes []StashContents) error {
+	stashRows := make([][]any, len(stashes))
+	// An item listed twice on one page keeps its last listing, since the
+	// upsert can't touch the same row twice
+	jewelRows := make(map[string][]any)
+	var itemOrder []string
+	for i, st := range stashes {
+		stashRows[i] = []any{st.StashId, st.RecordedAt}
+		for _, j := range st.Jewels {
+			if _, ok := jewelRows[j.ItemId]; !ok {
+				itemOrder = append(itemOrder, j.ItemId)
+			}
+			jewelRows[j.ItemId] = []any{j.JewelType, j.JewelClass, j.AllocatedNode, j.ItemId, j.StashId, j.Realm, j.League, j.ListPriceAmount, j.ListPriceCurrency, j.LastChangeId, j.RecordedAt, j.AccountName}
+		}
+	}
+	orderedJewelRows := make([][]any, len(itemOrder))
+	for i, id := range itemOrder {
+		orderedJewelRows[i] = jewelRows[id]
+	}
+
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, CREATE_STAGED_STASHES_QUERY); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, CREATE_STAGED_JEWELS_QUERY); err != nil {
+			return err
+		}
+
+		_, err := tx.CopyFrom(ctx, pgx.Identifier{"staged_stashes"}, []string{"stashid", "recordedat"}, pgx.CopyFromRows(stashRows))
+		if err != nil {
+			return err
+		}
+		jewelColumns := []string{"jeweltype", "jewelclass", "allocatednode", "itemid", "stashid", "realm", "league", "listpriceamount", "listpricecurrency", "lastchangeid", "recordedat", "accountname"}
+		if _, err = tx.CopyFrom(ctx, pgx.Identifier{"staged_jewels"}, jewelColumns, pgx.CopyFromRows(orderedJewelRows)); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, DELIST_STAGED_JEWELS_QUERY); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, UPSERT_STAGED_JEWELS_QUERY)
+		return err
+	})
+}
+
+func (s *PGStore) JewelsSince(ctx context.Context, realm string, cutoffs map[string]time.Time) ([]DBJewel, error) {
+	leagues := make([]string, 0, len(cutoffs))
+	leagueCutoffs := make([]time.Time, 0, len(cutoffs))
+	for league, cutoff := range cutoffs {
+		leagues = append(leagues, league)
+		leagueCutoffs = append(leagueCutoffs, cutoff)
+	}
+
+	rows, _ := s.pool.Query(ctx, SELECT_JEWELS_SINCE_QUERY, realm, leagues, leagueCutoffs)
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DBJewel])
+}
+
+func (s *PGStore) JewelsForKeys(ctx context.Context, cutoffs map[JewelKey]time.Time) ([]DBJewel, error) {
+	var realms, leagues, types, classes, nodes []string
+	var keyCutoffs []time.Time
+	for k, cutoff := range cutoffs {
+		realms = append(realms, k.Realm)
+		leagues = append(leagues, k.League)
+		types = append(types, k.JewelType)
+		classes = append(classes, k.JewelClass)
+		nodes = append(nodes, k.AllocatedNode)
+		keyCutoffs = append(keyCutoffs, cutoff)
+	}
+
+	rows, _ := s.pool.Query(ctx, SELECT_JEWELS_BY_KEY_QUERY, realms, leagues, types, classes, nodes, keyCutoffs)
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DBJewel])
+}
+
+func (s *PGStore) ChangedKeys(ctx context.Context, realm string, league string, since, prevCutoff, cutoff time.Time, currencies []string) ([]JewelKey, error) {
+	if currencies == nil {
+		currencies = []string{}
+	}
+	rows, _ := s.pool.Query(ctx, SELECT_CHANGED_KEYS_QUERY, realm, league, since, prevCutoff, cutoff, currencies)
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[JewelKey])
+}
+
+func (s *PGStore) QuickDelistings(ctx context.Context, realm string, leagues []string, since time.Time, maxLifetime time.Duration) ([]DBJewelHistory, error) {
+	rows, _ := s.pool.Query(ctx, SELECT_QUICK_DELISTINGS_QUERY, realm, leagues, since, maxLifetime)
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DBJewelHistory])
+}
+
+func (s *PGStore) NodeJewels(ctx context.Context, realm string, league string, jewelType string, allocatedNode string) ([]DBJewel, error) {
+	rows, _ := s.pool.Query(ctx, SELECT_NODE_JEWELS_QUERY, realm, league, jewelType, allocatedNode)
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DBJewel])
+}
+
+func (s *PGStore) LatestChangeset(ctx context.Context, realm string) (DBChangeset, error) {
+	rows, _ := s.pool.Query(ctx, "SELECT * FROM changesets WHERE realm = $1 ORDER BY processedAt DESC LIMIT 1", realm)
+	c, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[DBChangeset])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c, ErrNotFound
+	}
+	return c, err
+}
+
+func (s *PGStore) InsertChangeset(ctx context.Context, c DBChangeset) error {
+	_, err := s.pool.Exec(ctx, INSERT_CHANGESET_QUERY, pgx.NamedArgs{
+		"realm":         c.Realm,
+		"changeId":      c.ChangeId,
+		"nextChangeId":  c.NextChangeId,
+		"stashCount":    c.StashCount,
+		"processedAt":   c.ProcessedAt,
+		"timeTaken":     c.TimeTakenMs,
+		"driftFromHead": c.DriftFromHead,
+		"shardDrift":    c.ShardDrift,
+		"lagMinutes":    c.LagMinutes,
+	})
+	return err
+}
+
+func (s *PGStore) LoadToken(ctx context.Context, clientId string, scope string) (DBOAuthToken, error) {
+	rows, _ := s.pool.Query(ctx, SELECT_OAUTH_TOKEN_QUERY, clientId, scope)
+	t, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[DBOAuthToken])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return t, ErrNotFound
+	}
+	return t, err
+}
+
+func (s *PGStore) SaveToken(ctx context.Context, t DBOAuthToken) error {
+	_, err := s.pool.Exec(ctx, UPSERT_OAUTH_TOKEN_QUERY, pgx.NamedArgs{
+		"clientId":    t.ClientId,
+		"scope":       t.Scope,
+		"accessToken": t.AccessToken,
+		"obtainedAt":  t.ObtainedAt,
+		"expiresAt":   t.ExpiresAt,
+	})
+	return err
+}
+
+func (s *PGStore) LatestSnapshotSets(ctx context.Context, realm string, leagues []string) ([]DBSnapshotSet, error) {
+	rows, _ := s.pool.Query(ctx, SELECT_LATEST_SETS_QUERY, realm, leagues)
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DBSnapshotSet])
+}
+
+func (s *PGStore) SnapshotsInSet(ctx context.Context, setId int) ([]DBJewelSnapshot, error) {
+	rows, _ := s.pool.Query(ctx, "SELECT * FROM snapshots WHERE setId = $1", setId)
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DBJewelSnapshot])
+}
+
+func (s *PGStore) FlagsInSet(ctx context.Context, setId int) ([]DBFlaggedListing, error) {
+	rows, _ := s.pool.Query(ctx, "SELECT * FROM flagged_listings WHERE setId = $1", setId)
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DBFlaggedListing])
+}
+
+func (s *PGStore) PriorFlagCounts(ctx context.Context, realm string, since time.Time) (map[string]int, error) {
+	rows, err := s.pool.Query(ctx, SELECT_PRIOR_FLAGS_QUERY, realm, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var seller string
+		var count int
+		if err = rows.Scan(&seller, &count); err != nil {
+			return nil, err
+		}
+		counts[seller] = count
+	}
+	return counts, rows.Err()
+}
+
+func (s *PGStore) SnapshotHistory(ctx context.Context, realm string, leagues []string, since time.Time) ([]SnapshotPricePoint, error) {
+	rows, err := s.pool.Query(ctx, SELECT_SNAPSHOT_HISTORY_QUERY, realm, leagues, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []SnapshotPricePoint
+	for rows.Next() {
+		var p SnapshotPricePoint
+		err = rows.Scan(&p.Key.Realm, &p.Key.League, &p.Key.JewelType, &p.Key.JewelClass, &p.Key.AllocatedNode, &p.WindowPrice, &p.GeneratedAt)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+func (s *PGStore) InsertSnapshotSets(ctx context.Context, sets []NewSnapshotSet) (map[string]int, error) {
+	setIds := make(map[string]int, len(sets))
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		batch := &pgx.Batch{}
+		for _, set := range sets {
+			exchangeRatesJson, err := json.Marshal(set.ExchangeRates)
+			if err != nil {
+				return err
+			}
+			var setId int
+			err = tx.QueryRow(ctx, INSERT_SNAPSHOT_SET_QUERY, pgx.NamedArgs{
+				"realm":           set.Realm,
+				"league":          set.League,
+				"exchangeRates":   exchangeRatesJson,
+				"generatedAt":     set.GeneratedAt,
+				"windowSeconds":   int64(set.Window / time.Second),
+				"halfLifeSeconds": int64(set.HalfLife / time.Second),
+			}).Scan(&setId)
+			if err != nil {
+				return err
+			}
+			setIds[set.League] = setId
+
+			for _, snap := range set.Snapshots {
+				batch.Queue(INSERT_SNAPSHOT_QUERY, pgx.NamedArgs{
+					"setId":         setId,
+					"jewelType":     snap.JewelType,
+					"jewelClass":    snap.JewelClass,
+					"allocatedNode": snap.AllocatedNode,
+					"minPrice":      snap.MinPrice,
+					"q1Price":       snap.FirstQuartilePrice,
+					"medianPrice":   snap.MedianPrice,
+					"q3Price":       snap.ThirdQuartilePrice,
+					"maxPrice":      snap.MaxPrice,
+					"windowPrice":   snap.WindowPrice,
+					"confidence":    snap.Confidence,
+					"stddev":        snap.Stddev,
+					"numListed":     snap.NumListed,
+					"numSellers":    snap.NumSellers,
+					"prices":        snap.Prices,
+					"inlierPrices":  snap.InlierPrices,
+					"change1h":      snap.Change1h,
+					"change24h":     snap.Change24h,
+					"change7d":      snap.Change7d,
+					"ewma":          snap.Ewma,
+					"volatility":    snap.Volatility,
+					"generatedAt":   set.GeneratedAt,
+				})
+			}
+			for _, f := range set.Flags {
+				batch.Queue(INSERT_FLAGGED_LISTING_QUERY, pgx.NamedArgs{
+					"setId":         setId,
+					"itemId":        f.ItemId,
+					"accountName":   f.AccountName,
+					"jewelType":     f.JewelType,
+					"jewelClass":    f.JewelClass,
+					"allocatedNode": f.AllocatedNode,
+					"chaosPrice":    f.ChaosPrice,
+					"windowPrice":   f.WindowPrice,
+					"reasons":       f.Reasons,
+					"flaggedAt":     set.GeneratedAt,
+				})
+			}
+		}
+		return tx.SendBatch(ctx, batch).Close()
+	})
+	return setIds, err
+}
+
+func (s *PGStore) InsertForecasts(ctx context.Context, forecasts []DBForecast) error {
+	batch := &pgx.Batch{}
+	for _, f := range forecasts {
+		batch.Queue(INSERT_FORECAST_QUERY, pgx.NamedArgs{
+			"setId":         f.SetId,
+			"jewelType":     f.JewelType,
+			"jewelClass":    f.JewelClass,
+			"allocatedNode": f.AllocatedNode,
+			"horizonHours":  f.HorizonHours,
+			"forecastPrice": f.ForecastPrice,
+			"lowerPrice":    f.LowerPrice,
+			"upperPrice":    f.UpperPrice,
+			"seasonal":      f.Seasonal,
+			"generatedAt":   f.GeneratedAt,
+			"targetAt":      f.TargetAt,
+		})
+	}
+	return s.pool.SendBatch(ctx, batch).Close()
+}
+
+func (s *PGStore) InsertDiagnostics(ctx context.Context, diagnostics []DBSnapshotDiagnostics) error {
+	batch := &pgx.Batch{}
+	for _, d := range diagnostics {
+		batch.Queue(INSERT_DIAGNOSTICS_QUERY, pgx.NamedArgs{
+			"setId":         d.SetId,
+			"jewelType":     d.JewelType,
+			"jewelClass":    d.JewelClass,
+			"allocatedNode": d.AllocatedNode,
+			"estimator":     d.Estimator,
+			"prices":        d.Prices,
+			"dendrogram":    d.Dendrogram,
+			"silhouettes":   d.Silhouettes,
+			"cutCriterion":  d.CutCriterion,
+			"cutScores":     d.CutScores,
+			"cutLevel":      d.CutLevel,
+			"inlierPrices":  d.InlierPrices,
+			"notes":         d.Notes,
+			"generatedAt":   d.GeneratedAt,
+		})
+	}
+	return s.pool.SendBatch(ctx, batch).Close()
+}
+
+func (s *PGStore) LatestSnapshots(ctx context.Context) ([]LeagueSnapshot, error) {
+	rows, _ := s.pool.Query(ctx, SELECT_LATEST_SNAPSHOTS_QUERY)
+	return pgx.CollectRows(rows, pgx.RowToStructByName[LeagueSnapshot])
+}
+
+func (s *PGStore) LatestKeySnapshot(ctx context.Context, key JewelKey) (LeagueSnapshot, error) {
+	rows, _ := s.pool.Query(ctx, SELECT_LATEST_KEY_SNAPSHOT_QUERY, key.Realm, key.League, key.JewelType, key.JewelClass, key.AllocatedNode)
+	snapshot, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[LeagueSnapshot])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return snapshot, ErrNotFound
+	}
+	return snapshot, err
+}
+
+func (s *PGStore) LatestNodeFlags(ctx context.Context, realm string, league string, jewelType string, allocatedNode string) ([]DBFlaggedListing, error) {
+	rows, _ := s.pool.Query(ctx, SELECT_LATEST_NODE_FLAGS_QUERY, realm, league, jewelType, allocatedNode)
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DBFlaggedListing])
+}
+
+func (s *PGStore) LatestForecasts(ctx context.Context, realm string, league string) ([]DBForecast, error) {
+	rows, _ := s.pool.Query(ctx, SELECT_LATEST_FORECASTS_QUERY, realm, league)
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DBForecast])
+}
+
+func (s *PGStore) LatestDiagnostics(ctx context.Context, key JewelKey) (DBSnapshotDiagnostics, error) {
+	rows, _ := s.pool.Query(ctx, SELECT_LATEST_DIAGNOSTICS_QUERY, key.Realm, key.League, key.JewelType, key.JewelClass, key.AllocatedNode)
+	d, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[DBSnapshotDiagnostics])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return d, ErrNotFound
+	}
+	return d, err
+}
+
+func (s *PGStore) RollupChangesets(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	var n int64
+	err := s.pool.QueryRow(ctx, ROLLUP_CHANGESETS_QUERY, cutoff, limit).Scan(&n)
+	return n, err
+}
+
+func (s *PGStore) OldestSnapshot(ctx context.Context, resolution string, cutoff time.Time) (time.Time, error) {
+	var oldest *time.Time
+	if err := s.pool.QueryRow(ctx, SELECT_OLDEST_SNAPSHOT_QUERY, resolution, cutoff).Scan(&oldest); err != nil {
+		return time.Time{}, err
+	}
+	if oldest == nil {
+		return time.Time{}, ErrNotFound
+	}
+	return *oldest, nil
+}
+
+func (s *PGStore) MergeSnapshots(ctx context.Context, from string, to string, start, end time.Time) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, MERGE_SNAPSHOT_BUCKET_QUERY, from, start, end, to); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, DELETE_MERGED_SNAPSHOTS_QUERY, from, start, end)
+		return err
+	})
+}
+
+func (s *PGStore) ExpiredHistory(ctx context.Context, cutoff time.Time, limit int) ([]DBJewelHistory, error) {
+	rows, _ := s.pool.Query(ctx, SELECT_EXPIRED_HISTORY_QUERY, cutoff, limit)
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DBJewelHistory])
+}
+
+func (s *PGStore) DeleteHistory(ctx context.Context, ids []int) error {
+	_, err := s.pool.Exec(ctx, "DELETE FROM jewel_history WHERE id = any($1)", ids)
+	return err
+}
+
+func (s *PGStore) DropPartitionsBefore(ctx context.Context, cutoff time.Time, l *log.Logger) (int, error) {
+	return DropPartitionsBefore(ctx, s.pool, cutoff, l)
+}
@@ -0,0 +1,146 @@
+-- SQLite equivalent of the Postgres migrations up to 0008, for running
+-- locally without a database server. Timestamps are unix microseconds, and
+-- arrays and JSON columns are stored as JSON text. Later schema changes go in
+-- their own numbered file here, alongside the matching Postgres migration.
+CREATE TABLE if not exists jewels(
+  id INTEGER PRIMARY KEY NOT NULL,
+  jewelType TEXT NOT NULL,
+  jewelClass TEXT NOT NULL,
+  allocatedNode TEXT NOT NULL,
+  stashId TEXT NOT NULL,
+  league TEXT NOT NULL,
+  itemId TEXT UNIQUE NOT NULL,
+  listPriceAmount REAL NOT NULL,
+  listPriceCurrency TEXT NOT NULL,
+  lastChangeId TEXT NOT NULL,
+  recordedAt INTEGER NOT NULL,
+  accountName TEXT NOT NULL DEFAULT '',
+  firstSeenAt INTEGER NOT NULL,
+  priceChanges INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX if not exists jewels_by_stash ON jewels (stashId);
+CREATE INDEX if not exists jewels_by_league_date ON jewels (league,recordedAt);
+CREATE INDEX if not exists jewels_by_date ON jewels (recordedAt);
+
+CREATE TABLE if not exists jewel_history(
+  id INTEGER PRIMARY KEY NOT NULL,
+  itemId TEXT NOT NULL,
+  accountName TEXT NOT NULL,
+  league TEXT NOT NULL,
+  jewelType TEXT NOT NULL,
+  jewelClass TEXT NOT NULL,
+  allocatedNode TEXT NOT NULL,
+  listPriceAmount REAL NOT NULL,
+  listPriceCurrency TEXT NOT NULL,
+  priceChanges INTEGER NOT NULL,
+  firstSeenAt INTEGER NOT NULL,
+  delistedAt INTEGER NOT NULL
+);
+
+CREATE INDEX if not exists jewel_history_by_league_date ON jewel_history (league,delistedAt);
+CREATE INDEX if not exists jewel_history_by_account ON jewel_history (accountName,delistedAt);
+
+CREATE TABLE if not exists changesets(
+  id INTEGER PRIMARY KEY NOT NULL,
+  changeId TEXT UNIQUE NOT NULL,
+  nextChangeId TEXT UNIQUE NOT NULL,
+  stashCount INTEGER NOT NULL,
+  processedAt INTEGER NOT NULL,
+  timeTaken INTEGER NOT NULL,
+  driftFromHead INTEGER
+);
+
+CREATE INDEX if not exists changesets_by_date ON changesets (processedAt);
+
+CREATE TABLE if not exists snapshot_sets(
+  id INTEGER PRIMARY KEY NOT NULL,
+  exchangeRates TEXT NOT NULL,
+  league TEXT NOT NULL,
+  generatedAt INTEGER NOT NULL
+);
+
+CREATE INDEX if not exists snapshot_sets_by_league ON snapshot_sets (league,generatedAt);
+
+CREATE TABLE if not exists snapshots(
+  id INTEGER PRIMARY KEY NOT NULL,
+  setId INTEGER NOT NULL REFERENCES snapshot_sets(id),
+  jewelType TEXT NOT NULL,
+  jewelClass TEXT NOT NULL,
+  allocatedNode TEXT NOT NULL,
+  minPrice REAL NOT NULL,
+  firstQuartilePrice REAL NOT NULL,
+  medianPrice REAL NOT NULL,
+  thirdQuartilePrice REAL NOT NULL,
+  maxPrice REAL NOT NULL,
+  windowPrice REAL NOT NULL,
+  confidence REAL NOT NULL DEFAULT 0,
+  stddev REAL NOT NULL,
+  numListed INTEGER NOT NULL,
+  numSellers INTEGER NOT NULL DEFAULT 0,
+  prices TEXT NOT NULL DEFAULT '[]',
+  inlierPrices TEXT NOT NULL DEFAULT '[]',
+  change1h REAL,
+  change24h REAL,
+  change7d REAL,
+  ewma REAL NOT NULL DEFAULT 0,
+  volatility REAL NOT NULL DEFAULT 0,
+  generatedAt INTEGER NOT NULL
+);
+
+CREATE INDEX if not exists snapshots_by_setid ON snapshots (setId);
+CREATE INDEX if not exists snapshots_by_generatedat ON snapshots (generatedAt);
+
+CREATE TABLE if not exists flagged_listings(
+  id INTEGER PRIMARY KEY NOT NULL,
+  setId INTEGER NOT NULL REFERENCES snapshot_sets(id),
+  itemId TEXT NOT NULL,
+  accountName TEXT NOT NULL,
+  jewelType TEXT NOT NULL,
+  jewelClass TEXT NOT NULL,
+  allocatedNode TEXT NOT NULL,
+  chaosPrice REAL NOT NULL,
+  windowPrice REAL NOT NULL,
+  reasons TEXT NOT NULL,
+  flaggedAt INTEGER NOT NULL
+);
+
+CREATE INDEX if not exists flagged_listings_by_setid ON flagged_listings (setId);
+CREATE INDEX if not exists flagged_listings_by_account ON flagged_listings (accountName,flaggedAt);
+
+CREATE TABLE if not exists forecasts(
+  id INTEGER PRIMARY KEY NOT NULL,
+  setId INTEGER NOT NULL REFERENCES snapshot_sets(id),
+  jewelType TEXT NOT NULL,
+  jewelClass TEXT NOT NULL,
+  allocatedNode TEXT NOT NULL,
+  horizonHours INTEGER NOT NULL,
+  forecastPrice REAL NOT NULL,
+  lowerPrice REAL NOT NULL,
+  upperPrice REAL NOT NULL,
+  seasonal INTEGER NOT NULL,
+  generatedAt INTEGER NOT NULL,
+  targetAt INTEGER NOT NULL
+);
+
+CREATE INDEX if not exists forecasts_by_setid ON forecasts (setId);
+
+CREATE TABLE if not exists snapshot_diagnostics(
+  id INTEGER PRIMARY KEY NOT NULL,
+  setId INTEGER NOT NULL REFERENCES snapshot_sets(id),
+  jewelType TEXT NOT NULL,
+  jewelClass TEXT NOT NULL,
+  allocatedNode TEXT NOT NULL,
+  estimator TEXT NOT NULL,
+  prices TEXT NOT NULL,
+  dendrogram TEXT,
+  silhouettes TEXT,
+  cutCriterion TEXT,
+  cutScores TEXT,
+  cutLevel INTEGER,
+  inlierPrices TEXT,
+  notes TEXT NOT NULL,
+  generatedAt INTEGER NOT NULL
+);
+
+CREATE INDEX if not exists snapshot_diagnostics_by_key ON snapshot_diagnostics (jewelType,jewelClass,allocatedNode,generatedAt);
@@ -0,0 +1,13 @@
+CREATE TABLE if not exists changeset_rollups(
+  hourStart INTEGER PRIMARY KEY NOT NULL,
+  pages INTEGER NOT NULL,
+  stashCount INTEGER NOT NULL,
+  timeTaken INTEGER NOT NULL,
+  minDrift INTEGER,
+  maxDrift INTEGER,
+  driftSum INTEGER NOT NULL,
+  driftSamples INTEGER NOT NULL
+);
+
+ALTER TABLE snapshots ADD COLUMN resolution TEXT NOT NULL DEFAULT 'raw';
+CREATE INDEX if not exists snapshots_by_resolution_date ON snapshots (resolution,generatedAt);
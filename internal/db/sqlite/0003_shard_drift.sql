@@ -0,0 +1,2 @@
+-- JSON array of the drift on each shard
+ALTER TABLE changesets ADD COLUMN shardDrift TEXT;
@@ -0,0 +1 @@
+ALTER TABLE changesets ADD COLUMN lagMinutes REAL;
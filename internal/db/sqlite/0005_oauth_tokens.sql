@@ -0,0 +1,8 @@
+CREATE TABLE if not exists oauth_tokens(
+  clientId TEXT NOT NULL,
+  scope TEXT NOT NULL,
+  accessToken TEXT NOT NULL,
+  obtainedAt INTEGER NOT NULL,
+  expiresAt INTEGER,
+  PRIMARY KEY (clientId,scope)
+);
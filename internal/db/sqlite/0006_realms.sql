@@ -0,0 +1,52 @@
+-- Realm of the public stash river each row came from; see the Postgres
+-- migration 0014_realms. SQLite can't drop the unique constraints on
+-- changesets in place, and change ids only need to be unique within a realm,
+-- so changesets and changeset_rollups are rebuilt.
+ALTER TABLE jewels ADD COLUMN realm TEXT NOT NULL DEFAULT 'pc';
+DROP INDEX if exists jewels_by_league_date;
+CREATE INDEX if not exists jewels_by_realm_league_date ON jewels (realm,league,recordedAt);
+
+ALTER TABLE jewel_history ADD COLUMN realm TEXT NOT NULL DEFAULT 'pc';
+DROP INDEX if exists jewel_history_by_league_date;
+CREATE INDEX if not exists jewel_history_by_realm_league_date ON jewel_history (realm,league,delistedAt);
+
+CREATE TABLE changesets_by_realm(
+  id INTEGER PRIMARY KEY NOT NULL,
+  changeId TEXT NOT NULL,
+  nextChangeId TEXT NOT NULL,
+  stashCount INTEGER NOT NULL,
+  processedAt INTEGER NOT NULL,
+  timeTaken INTEGER NOT NULL,
+  driftFromHead INTEGER,
+  shardDrift TEXT,
+  lagMinutes REAL,
+  realm TEXT NOT NULL DEFAULT 'pc',
+  UNIQUE (realm,changeId)
+);
+INSERT INTO changesets_by_realm(id,changeId,nextChangeId,stashCount,processedAt,timeTaken,driftFromHead,shardDrift,lagMinutes)
+  SELECT id,changeId,nextChangeId,stashCount,processedAt,timeTaken,driftFromHead,shardDrift,lagMinutes FROM changesets;
+DROP TABLE changesets;
+ALTER TABLE changesets_by_realm RENAME TO changesets;
+CREATE INDEX if not exists changesets_by_date ON changesets (processedAt);
+CREATE INDEX if not exists changesets_by_realm_date ON changesets (realm,processedAt);
+
+CREATE TABLE changeset_rollups_by_realm(
+  realm TEXT NOT NULL DEFAULT 'pc',
+  hourStart INTEGER NOT NULL,
+  pages INTEGER NOT NULL,
+  stashCount INTEGER NOT NULL,
+  timeTaken INTEGER NOT NULL,
+  minDrift INTEGER,
+  maxDrift INTEGER,
+  driftSum INTEGER NOT NULL,
+  driftSamples INTEGER NOT NULL,
+  PRIMARY KEY (realm,hourStart)
+);
+INSERT INTO changeset_rollups_by_realm(hourStart,pages,stashCount,timeTaken,minDrift,maxDrift,driftSum,driftSamples)
+  SELECT hourStart,pages,stashCount,timeTaken,minDrift,maxDrift,driftSum,driftSamples FROM changeset_rollups;
+DROP TABLE changeset_rollups;
+ALTER TABLE changeset_rollups_by_realm RENAME TO changeset_rollups;
+
+ALTER TABLE snapshot_sets ADD COLUMN realm TEXT NOT NULL DEFAULT 'pc';
+DROP INDEX if exists snapshot_sets_by_league;
+CREATE INDEX if not exists snapshot_sets_by_realm_league ON snapshot_sets (realm,league,generatedAt);
@@ -0,0 +1,3 @@
+-- See the Postgres migration 0015_snapshot_window
+ALTER TABLE snapshot_sets ADD COLUMN windowSeconds INTEGER;
+ALTER TABLE snapshot_sets ADD COLUMN halfLifeSeconds INTEGER;
@@ -0,0 +1,7 @@
+-- One row per role, held by the worker that last took it. Stands in for
+-- Postgres' advisory locks, which SQLite doesn't have.
+CREATE TABLE if not exists leader_locks(
+  role TEXT PRIMARY KEY,
+  workerId TEXT NOT NULL,
+  heartbeatAt INTEGER NOT NULL
+);
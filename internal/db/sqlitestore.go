@@ -0,0 +1,1129 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/faideww/ffff/internal/stats/robust"
+	"github.com/jackc/pgx/v5/pgtype"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+//go:embed sqlite/*.sql
+var sqliteSchemaFiles embed.FS
+
+// Schema files are named NNNN_name.sql; PRAGMA user_version records the
+// last one applied
+var sqliteSchemaPattern = regexp.MustCompile(`^(\d+)_\w+\.sql$`)
+
+// Array parameters are passed as JSON and expanded with json_each, in place
+// of Postgres' `= any($1)` and unnest
+const SQLITE_SELECT_STASH_JEWELS_QUERY = `
+SELECT * FROM jewels WHERE stashId IN (SELECT value FROM json_each(?))
+`
+
+const SQLITE_ARCHIVE_JEWEL_QUERY = `
+INSERT INTO jewel_history(itemId,accountName,realm,league,jewelType,jewelClass,allocatedNode,listPriceAmount,listPriceCurrency,priceChanges,firstSeenAt,delistedAt)
+  SELECT itemId,accountName,realm,league,jewelType,jewelClass,allocatedNode,listPriceAmount,listPriceCurrency,priceChanges,firstSeenAt,?
+  FROM jewels
+  WHERE id = ?
+`
+
+const SQLITE_UPDATE_JEWEL_PRICE_QUERY = `
+UPDATE jewels
+  SET stashId = @stashId, listPriceAmount = @amount, listPriceCurrency = @currency, lastChangeId = @changeId, recordedAt = @recordedAt, accountName = @accountName,
+    priceChanges = priceChanges + CASE WHEN listPriceAmount != @amount OR listPriceCurrency != @currency THEN 1 ELSE 0 END
+  WHERE id = @id
+`
+
+// Unqualified columns in the DO UPDATE clause refer to the existing row
+const SQLITE_UPSERT_JEWEL_QUERY = `
+INSERT INTO jewels(jewelType,jewelClass,allocatedNode,itemId,stashId,realm,league,listPriceAmount,listPriceCurrency,lastChangeId,recordedAt,accountName,firstSeenAt)
+  VALUES (@jewelType,@jewelClass,@allocatedNode,@itemId,@stashId,@realm,@league,@amount,@currency,@changeId,@recordedAt,@accountName,@recordedAt)
+  ON CONFLICT(itemId)
+  DO
+    UPDATE SET stashId = excluded.stashId, listPriceAmount = excluded.listPriceAmount, listPriceCurrency = excluded.listPriceCurrency,
+      lastChangeId = excluded.lastChangeId, recordedAt = excluded.recordedAt, accountName = excluded.accountName,
+      priceChanges = priceChanges + CASE WHEN listPriceAmount != excluded.listPriceAmount OR listPriceCurrency != excluded.listPriceCurrency THEN 1 ELSE 0 END
+`
+
+const SQLITE_SELECT_JEWELS_SINCE_QUERY = `
+SELECT j.*
+  FROM jewels j
+  JOIN json_each(?) w ON j.league = w.key
+  WHERE j.realm = ? AND j.recordedAt > w.value
+`
+
+const SQLITE_SELECT_JEWELS_BY_KEY_QUERY = `
+SELECT j.*
+  FROM jewels j
+  JOIN json_each(?) k
+    ON j.realm = k.value ->> '$.realm' AND j.league = k.value ->> '$.league' AND j.jewelType = k.value ->> '$.jewelType'
+    AND j.jewelClass = k.value ->> '$.jewelClass' AND j.allocatedNode = k.value ->> '$.allocatedNode'
+  WHERE j.recordedAt > k.value ->> '$.cutoff'
+`
+
+const SQLITE_SELECT_CHANGED_KEYS_QUERY = `
+SELECT realm, league, jewelType, jewelClass, allocatedNode
+  FROM jewels
+  WHERE realm = @realm AND league = @league AND (recordedAt > @since OR (recordedAt > @prevCutoff AND recordedAt <= @cutoff) OR listPriceCurrency IN (SELECT value FROM json_each(@currencies)))
+UNION
+SELECT realm, league, jewelType, jewelClass, allocatedNode
+  FROM jewel_history
+  WHERE realm = @realm AND league = @league AND delistedAt > @since
+`
+
+const SQLITE_SELECT_QUICK_DELISTINGS_QUERY = `
+SELECT *
+  FROM jewel_history
+  WHERE realm = ? AND league IN (SELECT value FROM json_each(?)) AND accountName != '' AND delistedAt > ? AND delistedAt - firstSeenAt < ?
+`
+
+const SQLITE_INSERT_CHANGESET_QUERY = `
+INSERT INTO changesets(realm,changeId,nextChangeId,stashCount,processedAt,timeTaken,driftFromHead,shardDrift,lagMinutes)
+  VALUES (@realm,@changeId,@nextChangeId,@stashCount,@processedAt,@timeTaken,@driftFromHead,@shardDrift,@lagMinutes)
+`
+
+const SQLITE_UPSERT_OAUTH_TOKEN_QUERY = `
+INSERT INTO oauth_tokens(clientId,scope,accessToken,obtainedAt,expiresAt)
+  VALUES (@clientId,@scope,@accessToken,@obtainedAt,@expiresAt)
+  ON CONFLICT(clientId,scope)
+  DO
+    UPDATE SET accessToken = excluded.accessToken, obtainedAt = excluded.obtainedAt, expiresAt = excluded.expiresAt
+`
+
+const SQLITE_SELECT_LATEST_SETS_QUERY = `
+SELECT ss.*
+  FROM snapshot_sets ss
+  WHERE ss.realm = ? AND ss.league IN (SELECT value FROM json_each(?))
+    AND ss.generatedAt = (SELECT max(generatedAt) FROM snapshot_sets WHERE realm = ss.realm AND league = ss.league)
+`
+
+const SQLITE_SELECT_PRIOR_FLAGS_QUERY = `
+SELECT f.accountName, count(DISTINCT f.itemId)
+  FROM flagged_listings f
+  JOIN snapshot_sets ss ON ss.id = f.setId
+  WHERE ss.realm = ? AND f.accountName != '' AND f.flaggedAt > ?
+  GROUP BY f.accountName
+`
+
+const SQLITE_SELECT_SNAPSHOT_HISTORY_QUERY = `
+SELECT ss.realm, ss.league, s.jewelType, s.jewelClass, s.allocatedNode, s.windowPrice, s.generatedAt
+  FROM snapshots s
+  JOIN snapshot_sets ss ON ss.id = s.setId
+  WHERE ss.realm = ? AND ss.league IN (SELECT value FROM json_each(?)) AND s.generatedAt > ?
+  ORDER BY s.generatedAt
+`
+
+const SQLITE_INSERT_SNAPSHOT_SET_QUERY = `
+INSERT INTO snapshot_sets(realm, league, exchangeRates, generatedAt, windowSeconds, halfLifeSeconds)
+  VALUES (@realm, @league, @exchangeRates, @generatedAt, @windowSeconds, @halfLifeSeconds)
+  RETURNING id
+`
+
+const SQLITE_INSERT_SNAPSHOT_QUERY = `
+INSERT INTO snapshots(setId,jewelType,jewelClass,allocatedNode,minPrice,firstQuartilePrice,medianPrice,thirdQuartilePrice,maxPrice,windowPrice,confidence,stddev,numListed,numSellers,prices,inlierPrices,change1h,change24h,change7d,ewma,volatility,generatedAt)
+  VALUES (@setId,@jewelType,@jewelClass,@allocatedNode,@minPrice,@q1Price,@medianPrice,@q3Price,@maxPrice,@windowPrice,@confidence,@stddev,@numListed,@numSellers,@prices,@inlierPrices,@change1h,@change24h,@change7d,@ewma,@volatility,@generatedAt)
+`
+
+const SQLITE_INSERT_FLAGGED_LISTING_QUERY = `
+INSERT INTO flagged_listings(setId,itemId,accountName,jewelType,jewelClass,allocatedNode,chaosPrice,windowPrice,reasons,flaggedAt)
+  VALUES (@setId,@itemId,@accountName,@jewelType,@jewelClass,@allocatedNode,@chaosPrice,@windowPrice,@reasons,@flaggedAt)
+`
+
+const SQLITE_INSERT_FORECAST_QUERY = `
+INSERT INTO forecasts(setId,jewelType,jewelClass,allocatedNode,horizonHours,forecastPrice,lowerPrice,upperPrice,seasonal,generatedAt,targetAt)
+  VALUES (@setId,@jewelType,@jewelClass,@allocatedNode,@horizonHours,@forecastPrice,@lowerPrice,@upperPrice,@seasonal,@generatedAt,@targetAt)
+`
+
+const SQLITE_INSERT_DIAGNOSTICS_QUERY = `
+INSERT INTO snapshot_diagnostics(setId,jewelType,jewelClass,allocatedNode,estimator,prices,dendrogram,silhouettes,cutCriterion,cutScores,cutLevel,inlierPrices,notes,generatedAt)
+  VALUES (@setId,@jewelType,@jewelClass,@allocatedNode,@estimator,@prices,@dendrogram,@silhouettes,@cutCriterion,@cutScores,@cutLevel,@inlierPrices,@notes,@generatedAt)
+`
+
+const SQLITE_SELECT_NODE_JEWELS_QUERY = `
+SELECT *
+  FROM jewels
+  WHERE realm = ? AND league = ? AND jewelType = ? AND allocatedNode = ?
+  ORDER BY recordedAt DESC
+`
+
+const SQLITE_SELECT_LATEST_SNAPSHOTS_QUERY = `
+SELECT s.*, ss.realm, ss.league
+  FROM snapshots s
+  JOIN snapshot_sets ss ON ss.id = s.setId
+  WHERE ss.generatedAt = (SELECT max(generatedAt) FROM snapshot_sets WHERE realm = ss.realm AND league = ss.league)
+  ORDER BY ss.realm, ss.league, s.jewelType, s.jewelClass, s.allocatedNode
+`
+
+const SQLITE_SELECT_LATEST_KEY_SNAPSHOT_QUERY = `
+SELECT s.*, ss.realm, ss.league
+  FROM snapshots s
+  JOIN snapshot_sets ss ON ss.id = s.setId
+  WHERE ss.realm = ? AND ss.league = ? AND s.jewelType = ? AND s.jewelClass = ? AND s.allocatedNode = ?
+  ORDER BY s.generatedAt DESC
+  LIMIT 1
+`
+
+const SQLITE_SELECT_LATEST_NODE_FLAGS_QUERY = `
+SELECT *
+  FROM flagged_listings
+  WHERE setId = (SELECT id FROM snapshot_sets WHERE realm = ? AND league = ? ORDER BY generatedAt DESC LIMIT 1)
+    AND jewelType = ? AND allocatedNode = ?
+`
+
+const SQLITE_SELECT_LATEST_FORECASTS_QUERY = `
+SELECT *
+  FROM forecasts
+  WHERE setId = (SELECT id FROM snapshot_sets WHERE realm = ? AND league = ? ORDER BY generatedAt DESC LIMIT 1)
+  ORDER BY jewelType, jewelClass, allocatedNode, horizonHours
+`
+
+const SQLITE_SELECT_LATEST_DIAGNOSTICS_QUERY = `
+SELECT d.*
+  FROM snapshot_diagnostics d
+  JOIN snapshot_sets ss ON ss.id = d.setId
+  WHERE ss.realm = ? AND ss.league = ? AND d.jewelType = ? AND d.jewelClass = ? AND d.allocatedNode = ?
+  ORDER BY d.generatedAt DESC
+  LIMIT 1
+`
+
+// Everything but each realm's newest changeset
+const SQLITE_SELECT_ROLLUP_BATCH_QUERY = `
+SELECT id
+  FROM changesets c
+  WHERE processedAt < ? AND processedAt < (SELECT max(processedAt) FROM changesets WHERE realm = c.realm)
+  ORDER BY processedAt
+  LIMIT ?
+`
+
+// Timestamps are unix microseconds, so an hour is 3600000000. SQLite's
+// two-argument min() is NULL if either side is, unlike Postgres' least().
+const SQLITE_ROLLUP_CHANGESETS_QUERY = `
+INSERT INTO changeset_rollups(realm,hourStart,pages,stashCount,timeTaken,minDrift,maxDrift,driftSum,driftSamples)
+  SELECT realm, processedAt - processedAt % 3600000000, count(*), sum(stashCount), sum(timeTaken), min(driftFromHead), max(driftFromHead), coalesce(sum(driftFromHead), 0), count(driftFromHead)
+  FROM changesets
+  WHERE id IN (SELECT value FROM json_each(?))
+  GROUP BY 1, 2
+  ON CONFLICT(realm,hourStart)
+  DO
+    UPDATE SET pages = pages + excluded.pages,
+      stashCount = stashCount + excluded.stashCount,
+      timeTaken = timeTaken + excluded.timeTaken,
+      minDrift = coalesce(min(minDrift, excluded.minDrift), minDrift, excluded.minDrift),
+      maxDrift = coalesce(max(maxDrift, excluded.maxDrift), maxDrift, excluded.maxDrift),
+      driftSum = driftSum + excluded.driftSum,
+      driftSamples = driftSamples + excluded.driftSamples
+`
+
+// SQLite has no percentile_cont, so buckets are merged in Go
+const SQLITE_SELECT_SNAPSHOT_BUCKET_QUERY = `
+SELECT s.id, ss.realm, ss.league, s.jewelType, s.jewelClass, s.allocatedNode, s.minPrice, s.medianPrice, s.windowPrice
+  FROM snapshots s
+  JOIN snapshot_sets ss ON ss.id = s.setId
+  WHERE s.resolution = ? AND s.generatedAt >= ? AND s.generatedAt < ?
+`
+
+// A leader that misses heartbeats for this long is presumed dead, and its
+// lock can be taken over
+const SQLITE_LEADER_LOCK_TIMEOUT = 3 * LEADER_HEARTBEAT_INTERVAL
+
+// Takes the role's lock if it's free, already ours, or held by a worker
+// whose heartbeat has lapsed. The statement runs in its own write
+// transaction, so two workers can't both see the lock free and take it.
+const SQLITE_TAKE_LEADER_LOCK_QUERY = `
+INSERT INTO leader_locks(role,workerId,heartbeatAt)
+  VALUES (?,?,?)
+  ON CONFLICT(role)
+  DO
+    UPDATE SET workerId = excluded.workerId, heartbeatAt = excluded.heartbeatAt
+    WHERE workerId = excluded.workerId OR heartbeatAt < ?
+`
+
+const SQLITE_HEARTBEAT_LEADER_LOCK_QUERY = `
+UPDATE leader_locks
+  SET heartbeatAt = ?
+  WHERE role = ? AND workerId = ?
+`
+
+const SQLITE_RELEASE_LEADER_LOCK_QUERY = `
+DELETE FROM leader_locks WHERE role = ? AND workerId = ?
+`
+
+type SQLiteConfig struct {
+	// Path to the database file; created if it doesn't exist
+	Path string
+}
+
+// Implements every store on top of a local SQLite file, for development and
+// single-machine deployments. Leadership is a heartbeated lock row, so
+// several workers can share the file with only one of them writing.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// Opens the database and brings its schema up to date
+func NewSQLiteStore(ctx context.Context, cfg SQLiteConfig) (*SQLiteStore, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)", cfg.Path)
+	handle, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; serialising here avoids SQLITE_BUSY
+	// between our own connections
+	handle.SetMaxOpenConns(1)
+
+	if err = upgradeSQLiteSchema(ctx, handle); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return &SQLiteStore{handle}, nil
+}
+
+// Applies every schema file newer than the database's user_version, in order
+func upgradeSQLiteSchema(ctx context.Context, handle *sql.DB) error {
+	entries, err := fs.ReadDir(sqliteSchemaFiles, "sqlite")
+	if err != nil {
+		return err
+	}
+
+	var version int
+	if err = handle.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	// ReadDir returns the files sorted by name, which is version order
+	for _, e := range entries {
+		match := sqliteSchemaPattern.FindStringSubmatch(e.Name())
+		if match == nil {
+			return fmt.Errorf("unexpected sqlite schema file %s", e.Name())
+		}
+		fileVersion, _ := strconv.Atoi(match[1])
+		if fileVersion <= version {
+			continue
+		}
+
+		body, err := fs.ReadFile(sqliteSchemaFiles, "sqlite/"+e.Name())
+		if err != nil {
+			return err
+		}
+		tx, err := handle.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, string(body)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite schema %s failed: %w", e.Name(), err)
+		}
+		// PRAGMA doesn't take parameters
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", fileVersion)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) CheckSchema(ctx context.Context) error {
+	return nil
+}
+
+// Blocks until this worker holds the lock row for `role` (or ctx is
+// cancelled)
+func (s *SQLiteStore) AcquireLeadership(ctx context.Context, role string, workerId string, l *log.Logger) (*Leader, error) {
+	waitingLogged := false
+	for {
+		now := time.Now()
+		res, err := s.db.ExecContext(ctx, SQLITE_TAKE_LEADER_LOCK_QUERY, role, workerId, sqliteTime(now), sqliteTime(now.Add(-SQLITE_LEADER_LOCK_TIMEOUT)))
+		if err != nil && !isSQLiteBusy(err) {
+			return nil, err
+		}
+		if err == nil {
+			taken, err := res.RowsAffected()
+			if err != nil {
+				return nil, err
+			}
+			if taken == 1 {
+				l.Printf("worker %s is now the leader for %s\n", workerId, role)
+				return newLeader(role, workerId, s.leaderLockHeartbeat(role, workerId, l), s.leaderLockRelease(role, workerId, l), l), nil
+			}
+		}
+
+		if !waitingLogged {
+			l.Printf("another worker is the leader for %s; waiting as standby\n", role)
+			waitingLogged = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(LEADER_POLL_INTERVAL):
+		}
+	}
+}
+
+// A heartbeat that finds the row taken over means the lock is lost. One
+// that fails (usually because a long write holds the database) is retried
+// at the next tick, until the row could have lapsed.
+func (s *SQLiteStore) leaderLockHeartbeat(role string, workerId string, l *log.Logger) func(ctx context.Context) error {
+	lastBeat := time.Now()
+	return func(ctx context.Context) error {
+		now := time.Now()
+		res, err := s.db.ExecContext(ctx, SQLITE_HEARTBEAT_LEADER_LOCK_QUERY, sqliteTime(now), role, workerId)
+		if err != nil {
+			if now.Sub(lastBeat) < SQLITE_LEADER_LOCK_TIMEOUT-LEADER_HEARTBEAT_INTERVAL {
+				l.Printf("leader heartbeat failed, retrying: %s\n", err)
+				return nil
+			}
+			return err
+		}
+		if held, err := res.RowsAffected(); err != nil || held == 0 {
+			return fmt.Errorf("lock for %s was taken over", role)
+		}
+		lastBeat = now
+		return nil
+	}
+}
+
+func (s *SQLiteStore) leaderLockRelease(role string, workerId string, l *log.Logger) func(ctx context.Context, lost bool) {
+	return func(ctx context.Context, lost bool) {
+		if lost {
+			return
+		}
+		if _, err := s.db.ExecContext(ctx, SQLITE_RELEASE_LEADER_LOCK_QUERY, role, workerId); err != nil {
+			l.Printf("failed to release leader lock: %s\n", err)
+		}
+	}
+}
+
+func isSQLiteBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code()&0xff == sqlite3.SQLITE_BUSY
+}
+
+// SQLite tables aren't partitioned
+func (s *SQLiteStore) PreparePartitions(ctx context.Context, now time.Time) error {
+	return nil
+}
+
+func (s *SQLiteStore) Close() {
+	s.db.Close()
+}
+
+func sqliteTime(t time.Time) int64 {
+	return t.UnixMicro()
+}
+
+// Scans a unix-microsecond column into a time.Time
+type sqliteTimestamp struct{ t *time.Time }
+
+func (ts sqliteTimestamp) Scan(src any) error {
+	v, ok := src.(int64)
+	if !ok {
+		return fmt.Errorf("expected a unix timestamp, got %T", src)
+	}
+	*ts.t = time.UnixMicro(v)
+	return nil
+}
+
+func sqliteJson(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// Scans a JSON text column into v; NULL leaves v untouched
+type sqliteJsonValue struct{ v any }
+
+func (j sqliteJsonValue) Scan(src any) error {
+	switch data := src.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(data), j.v)
+	case []byte:
+		return json.Unmarshal(data, j.v)
+	default:
+		return fmt.Errorf("expected JSON text, got %T", src)
+	}
+}
+
+func collectSQLite[T any](rows *sql.Rows, err error, scan func(rows *sql.Rows, dst *T) error) ([]T, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []T
+	for rows.Next() {
+		var dst T
+		if err = scan(rows, &dst); err != nil {
+			return nil, err
+		}
+		results = append(results, dst)
+	}
+	return results, rows.Err()
+}
+
+func scanSQLiteJewel(rows *sql.Rows, j *DBJewel) error {
+	return rows.Scan(&j.Id, &j.JewelType, &j.JewelClass, &j.AllocatedNode, &j.StashId, &j.League, &j.ItemId, &j.ListPriceAmount, &j.ListPriceCurrency, &j.LastChangeId, sqliteTimestamp{&j.RecordedAt}, &j.AccountName, sqliteTimestamp{&j.FirstSeenAt}, &j.PriceChanges, &j.Realm)
+}
+
+func scanSQLiteHistory(rows *sql.Rows, h *DBJewelHistory) error {
+	return rows.Scan(&h.Id, &h.ItemId, &h.AccountName, &h.League, &h.JewelType, &h.JewelClass, &h.AllocatedNode, &h.ListPriceAmount, &h.ListPriceCurrency, &h.PriceChanges, sqliteTimestamp{&h.FirstSeenAt}, sqliteTimestamp{&h.DelistedAt}, &h.Realm)
+}
+
+func scanSQLiteKey(rows *sql.Rows, k *JewelKey) error {
+	return rows.Scan(&k.Realm, &k.League, &k.JewelType, &k.JewelClass, &k.AllocatedNode)
+}
+
+func scanSQLiteChangeset(rows *sql.Rows, c *DBChangeset) error {
+	return rows.Scan(&c.Id, &c.ChangeId, &c.NextChangeId, &c.StashCount, sqliteTimestamp{&c.ProcessedAt}, &c.TimeTakenMs, &c.DriftFromHead, sqliteJsonValue{&c.ShardDrift}, &c.LagMinutes, &c.Realm)
+}
+
+func scanSQLiteSet(rows *sql.Rows, set *DBSnapshotSet) error {
+	return rows.Scan(&set.Id, sqliteJsonValue{&set.ExchangeRates}, &set.League, sqliteTimestamp{&set.GeneratedAt}, &set.Realm, &set.WindowSeconds, &set.HalfLifeSeconds)
+}
+
+func sqliteSnapshotColumns(s *DBJewelSnapshot) []any {
+	return []any{&s.Id, &s.SetId, &s.JewelType, &s.JewelClass, &s.AllocatedNode, &s.MinPrice, &s.FirstQuartilePrice, &s.MedianPrice, &s.ThirdQuartilePrice, &s.MaxPrice, &s.WindowPrice, &s.Confidence, &s.Stddev, &s.NumListed, &s.NumSellers, sqliteJsonValue{&s.Prices}, sqliteJsonValue{&s.InlierPrices}, &s.Change1h, &s.Change24h, &s.Change7d, &s.Ewma, &s.Volatility, sqliteTimestamp{&s.GeneratedAt}, &s.Resolution}
+}
+
+func scanSQLiteSnapshot(rows *sql.Rows, s *DBJewelSnapshot) error {
+	return rows.Scan(sqliteSnapshotColumns(s)...)
+}
+
+func scanSQLiteLeagueSnapshot(rows *sql.Rows, s *LeagueSnapshot) error {
+	return rows.Scan(append(sqliteSnapshotColumns(&s.DBJewelSnapshot), &s.Realm, &s.League)...)
+}
+
+func scanSQLiteFlag(rows *sql.Rows, f *DBFlaggedListing) error {
+	return rows.Scan(&f.Id, &f.SetId, &f.ItemId, &f.AccountName, &f.JewelType, &f.JewelClass, &f.AllocatedNode, &f.ChaosPrice, &f.WindowPrice, sqliteJsonValue{&f.Reasons}, sqliteTimestamp{&f.FlaggedAt})
+}
+
+func scanSQLiteForecast(rows *sql.Rows, f *DBForecast) error {
+	return rows.Scan(&f.Id, &f.SetId, &f.JewelType, &f.JewelClass, &f.AllocatedNode, &f.HorizonHours, &f.ForecastPrice, &f.LowerPrice, &f.UpperPrice, &f.Seasonal, sqliteTimestamp{&f.GeneratedAt}, sqliteTimestamp{&f.TargetAt})
+}
+
+func scanSQLiteDiagnostics(rows *sql.Rows, d *DBSnapshotDiagnostics) error {
+	return rows.Scan(&d.Id, &d.SetId, &d.JewelType, &d.JewelClass, &d.AllocatedNode, &d.Estimator, sqliteJsonValue{&d.Prices}, &d.Dendrogram, sqliteJsonValue{&d.Silhouettes}, &d.CutCriterion, sqliteJsonValue{&d.CutScores}, &d.CutLevel, sqliteJsonValue{&d.InlierPrices}, sqliteJsonValue{&d.Notes}, sqliteTimestamp{&d.GeneratedAt})
+}
+
+func (s *SQLiteStore) UpdateStashJewels(ctx context.Context, stashIds []string, diff func(existing []DBJewel) (JewelChanges, error)) error {
+	ids, err := sqliteJson(stashIds)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, SQLITE_SELECT_STASH_JEWELS_QUERY, ids)
+	existing, err := collectSQLite(rows, err, scanSQLiteJewel)
+	if err != nil {
+		return err
+	}
+	changes, err := diff(existing)
+	if err != nil {
+		return err
+	}
+	if err = applySQLiteJewelChanges(ctx, tx, changes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func applySQLiteJewelChanges(ctx context.Context, tx *sql.Tx, changes JewelChanges) error {
+	var err error
+	for _, d := range changes.Delisted {
+		if _, err = tx.ExecContext(ctx, SQLITE_ARCHIVE_JEWEL_QUERY, sqliteTime(d.DelistedAt), d.Id); err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, "DELETE FROM jewels WHERE id = ?", d.Id); err != nil {
+			return err
+		}
+	}
+	for _, j := range changes.Updated {
+		_, err = tx.ExecContext(ctx, SQLITE_UPDATE_JEWEL_PRICE_QUERY,
+			sql.Named("stashId", j.StashId),
+			sql.Named("amount", j.ListPriceAmount),
+			sql.Named("currency", j.ListPriceCurrency),
+			sql.Named("changeId", j.LastChangeId),
+			sql.Named("recordedAt", sqliteTime(j.RecordedAt)),
+			sql.Named("accountName", j.AccountName),
+			sql.Named("id", j.Id),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	for _, j := range changes.Upserted {
+		_, err = tx.ExecContext(ctx, SQLITE_UPSERT_JEWEL_QUERY,
+			sql.Named("jewelType", j.JewelType),
+			sql.Named("jewelClass", j.JewelClass),
+			sql.Named("allocatedNode", j.AllocatedNode),
+			sql.Named("itemId", j.ItemId),
+			sql.Named("stashId", j.StashId),
+			sql.Named("realm", j.Realm),
+			sql.Named("league", j.League),
+			sql.Named("amount", j.ListPriceAmount),
+			sql.Named("currency", j.ListPriceCurrency),
+			sql.Named("changeId", j.LastChangeId),
+			sql.Named("recordedAt", sqliteTime(j.RecordedAt)),
+			sql.Named("accountName", j.AccountName),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) JewelsSince(ctx context.Context, realm string, cutoffs map[string]time.Time) ([]DBJewel, error) {
+	leagueCutoffs := make(map[string]int64, len(cutoffs))
+	for league, cutoff := range cutoffs {
+		leagueCutoffs[league] = sqliteTime(cutoff)
+	}
+	param, err := sqliteJson(leagueCutoffs)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, SQLITE_SELECT_JEWELS_SINCE_QUERY, param, realm)
+	return collectSQLite(rows, err, scanSQLiteJewel)
+}
+
+func (s *SQLiteStore) JewelsForKeys(ctx context.Context, cutoffs map[JewelKey]time.Time) ([]DBJewel, error) {
+	type keyCutoff struct {
+		Realm         string `json:"realm"`
+		League        string `json:"league"`
+		JewelType     string `json:"jewelType"`
+		JewelClass    string `json:"jewelClass"`
+		AllocatedNode string `json:"allocatedNode"`
+		Cutoff        int64  `json:"cutoff"`
+	}
+	keys := make([]keyCutoff, 0, len(cutoffs))
+	for k, cutoff := range cutoffs {
+		keys = append(keys, keyCutoff{k.Realm, k.League, k.JewelType, k.JewelClass, k.AllocatedNode, sqliteTime(cutoff)})
+	}
+	param, err := sqliteJson(keys)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, SQLITE_SELECT_JEWELS_BY_KEY_QUERY, param)
+	return collectSQLite(rows, err, scanSQLiteJewel)
+}
+
+func (s *SQLiteStore) ChangedKeys(ctx context.Context, realm string, league string, since, prevCutoff, cutoff time.Time, currencies []string) ([]JewelKey, error) {
+	if currencies == nil {
+		currencies = []string{}
+	}
+	param, err := sqliteJson(currencies)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, SQLITE_SELECT_CHANGED_KEYS_QUERY,
+		sql.Named("realm", realm),
+		sql.Named("league", league),
+		sql.Named("since", sqliteTime(since)),
+		sql.Named("prevCutoff", sqliteTime(prevCutoff)),
+		sql.Named("cutoff", sqliteTime(cutoff)),
+		sql.Named("currencies", param),
+	)
+	return collectSQLite(rows, err, scanSQLiteKey)
+}
+
+func (s *SQLiteStore) QuickDelistings(ctx context.Context, realm string, leagues []string, since time.Time, maxLifetime time.Duration) ([]DBJewelHistory, error) {
+	param, err := sqliteJson(leagues)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, SQLITE_SELECT_QUICK_DELISTINGS_QUERY, realm, param, sqliteTime(since), maxLifetime.Microseconds())
+	return collectSQLite(rows, err, scanSQLiteHistory)
+}
+
+func (s *SQLiteStore) NodeJewels(ctx context.Context, realm string, league string, jewelType string, allocatedNode string) ([]DBJewel, error) {
+	rows, err := s.db.QueryContext(ctx, SQLITE_SELECT_NODE_JEWELS_QUERY, realm, league, jewelType, allocatedNode)
+	return collectSQLite(rows, err, scanSQLiteJewel)
+}
+
+func (s *SQLiteStore) LatestChangeset(ctx context.Context, realm string) (DBChangeset, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT * FROM changesets WHERE realm = ? ORDER BY processedAt DESC LIMIT 1", realm)
+	changesets, err := collectSQLite(rows, err, scanSQLiteChangeset)
+	if err != nil {
+		return DBChangeset{}, err
+	}
+	if len(changesets) == 0 {
+		return DBChangeset{}, ErrNotFound
+	}
+	return changesets[0], nil
+}
+
+func (s *SQLiteStore) InsertChangeset(ctx context.Context, c DBChangeset) error {
+	shardDrift, err := sqliteNullableJson(c.ShardDrift)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, SQLITE_INSERT_CHANGESET_QUERY,
+		sql.Named("realm", c.Realm),
+		sql.Named("changeId", c.ChangeId),
+		sql.Named("nextChangeId", c.NextChangeId),
+		sql.Named("stashCount", c.StashCount),
+		sql.Named("processedAt", sqliteTime(c.ProcessedAt)),
+		sql.Named("timeTaken", c.TimeTakenMs),
+		sql.Named("driftFromHead", c.DriftFromHead),
+		sql.Named("shardDrift", shardDrift),
+		sql.Named("lagMinutes", c.LagMinutes),
+	)
+	return err
+}
+
+func (s *SQLiteStore) LoadToken(ctx context.Context, clientId string, scope string) (DBOAuthToken, error) {
+	t := DBOAuthToken{ClientId: clientId, Scope: scope}
+	var expiresAt sql.NullInt64
+	err := s.db.QueryRowContext(ctx, "SELECT accessToken, obtainedAt, expiresAt FROM oauth_tokens WHERE clientId = ? AND scope = ?", clientId, scope).
+		Scan(&t.AccessToken, sqliteTimestamp{&t.ObtainedAt}, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, ErrNotFound
+	}
+	if expiresAt.Valid {
+		t.ExpiresAt = pgtype.Timestamptz{Time: time.UnixMicro(expiresAt.Int64), Valid: true}
+	}
+	return t, err
+}
+
+func (s *SQLiteStore) SaveToken(ctx context.Context, t DBOAuthToken) error {
+	var expiresAt sql.NullInt64
+	if t.ExpiresAt.Valid {
+		expiresAt = sql.NullInt64{Int64: sqliteTime(t.ExpiresAt.Time), Valid: true}
+	}
+	_, err := s.db.ExecContext(ctx, SQLITE_UPSERT_OAUTH_TOKEN_QUERY,
+		sql.Named("clientId", t.ClientId),
+		sql.Named("scope", t.Scope),
+		sql.Named("accessToken", t.AccessToken),
+		sql.Named("obtainedAt", sqliteTime(t.ObtainedAt)),
+		sql.Named("expiresAt", expiresAt),
+	)
+	return err
+}
+
+func (s *SQLiteStore) LatestSnapshotSets(ctx context.Context, realm string, leagues []string) ([]DBSnapshotSet, error) {
+	param, err := sqliteJson(leagues)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, SQLITE_SELECT_LATEST_SETS_QUERY, realm, param)
+	return collectSQLite(rows, err, scanSQLiteSet)
+}
+
+func (s *SQLiteStore) SnapshotsInSet(ctx context.Context, setId int) ([]DBJewelSnapshot, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT * FROM snapshots WHERE setId = ?", setId)
+	return collectSQLite(rows, err, scanSQLiteSnapshot)
+}
+
+func (s *SQLiteStore) FlagsInSet(ctx context.Context, setId int) ([]DBFlaggedListing, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT * FROM flagged_listings WHERE setId = ?", setId)
+	return collectSQLite(rows, err, scanSQLiteFlag)
+}
+
+func (s *SQLiteStore) PriorFlagCounts(ctx context.Context, realm string, since time.Time) (map[string]int, error) {
+	type sellerCount struct {
+		seller string
+		count  int
+	}
+	rows, err := s.db.QueryContext(ctx, SQLITE_SELECT_PRIOR_FLAGS_QUERY, realm, sqliteTime(since))
+	sellers, err := collectSQLite(rows, err, func(rows *sql.Rows, c *sellerCount) error {
+		return rows.Scan(&c.seller, &c.count)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(sellers))
+	for _, c := range sellers {
+		counts[c.seller] = c.count
+	}
+	return counts, nil
+}
+
+func (s *SQLiteStore) SnapshotHistory(ctx context.Context, realm string, leagues []string, since time.Time) ([]SnapshotPricePoint, error) {
+	param, err := sqliteJson(leagues)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, SQLITE_SELECT_SNAPSHOT_HISTORY_QUERY, realm, param, sqliteTime(since))
+	return collectSQLite(rows, err, func(rows *sql.Rows, p *SnapshotPricePoint) error {
+		return rows.Scan(&p.Key.Realm, &p.Key.League, &p.Key.JewelType, &p.Key.JewelClass, &p.Key.AllocatedNode, &p.WindowPrice, sqliteTimestamp{&p.GeneratedAt})
+	})
+}
+
+func (s *SQLiteStore) InsertSnapshotSets(ctx context.Context, sets []NewSnapshotSet) (map[string]int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	setIds := make(map[string]int, len(sets))
+	for _, set := range sets {
+		exchangeRates, err := sqliteJson(set.ExchangeRates)
+		if err != nil {
+			return nil, err
+		}
+		var setId int
+		err = tx.QueryRowContext(ctx, SQLITE_INSERT_SNAPSHOT_SET_QUERY,
+			sql.Named("realm", set.Realm),
+			sql.Named("league", set.League),
+			sql.Named("exchangeRates", exchangeRates),
+			sql.Named("generatedAt", sqliteTime(set.GeneratedAt)),
+			sql.Named("windowSeconds", int64(set.Window/time.Second)),
+			sql.Named("halfLifeSeconds", int64(set.HalfLife/time.Second)),
+		).Scan(&setId)
+		if err != nil {
+			return nil, err
+		}
+		setIds[set.League] = setId
+
+		for _, snap := range set.Snapshots {
+			prices, err := sqliteJson(nonNil(snap.Prices))
+			if err != nil {
+				return nil, err
+			}
+			inliers, err := sqliteJson(nonNil(snap.InlierPrices))
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.ExecContext(ctx, SQLITE_INSERT_SNAPSHOT_QUERY,
+				sql.Named("setId", setId),
+				sql.Named("jewelType", snap.JewelType),
+				sql.Named("jewelClass", snap.JewelClass),
+				sql.Named("allocatedNode", snap.AllocatedNode),
+				sql.Named("minPrice", snap.MinPrice),
+				sql.Named("q1Price", snap.FirstQuartilePrice),
+				sql.Named("medianPrice", snap.MedianPrice),
+				sql.Named("q3Price", snap.ThirdQuartilePrice),
+				sql.Named("maxPrice", snap.MaxPrice),
+				sql.Named("windowPrice", snap.WindowPrice),
+				sql.Named("confidence", snap.Confidence),
+				sql.Named("stddev", snap.Stddev),
+				sql.Named("numListed", snap.NumListed),
+				sql.Named("numSellers", snap.NumSellers),
+				sql.Named("prices", prices),
+				sql.Named("inlierPrices", inliers),
+				sql.Named("change1h", snap.Change1h),
+				sql.Named("change24h", snap.Change24h),
+				sql.Named("change7d", snap.Change7d),
+				sql.Named("ewma", snap.Ewma),
+				sql.Named("volatility", snap.Volatility),
+				sql.Named("generatedAt", sqliteTime(set.GeneratedAt)),
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, f := range set.Flags {
+			reasons, err := sqliteJson(nonNil(f.Reasons))
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.ExecContext(ctx, SQLITE_INSERT_FLAGGED_LISTING_QUERY,
+				sql.Named("setId", setId),
+				sql.Named("itemId", f.ItemId),
+				sql.Named("accountName", f.AccountName),
+				sql.Named("jewelType", f.JewelType),
+				sql.Named("jewelClass", f.JewelClass),
+				sql.Named("allocatedNode", f.AllocatedNode),
+				sql.Named("chaosPrice", f.ChaosPrice),
+				sql.Named("windowPrice", f.WindowPrice),
+				sql.Named("reasons", reasons),
+				sql.Named("flaggedAt", sqliteTime(set.GeneratedAt)),
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return setIds, tx.Commit()
+}
+
+func (s *SQLiteStore) InsertForecasts(ctx context.Context, forecasts []DBForecast) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, f := range forecasts {
+		_, err = tx.ExecContext(ctx, SQLITE_INSERT_FORECAST_QUERY,
+			sql.Named("setId", f.SetId),
+			sql.Named("jewelType", f.JewelType),
+			sql.Named("jewelClass", f.JewelClass),
+			sql.Named("allocatedNode", f.AllocatedNode),
+			sql.Named("horizonHours", f.HorizonHours),
+			sql.Named("forecastPrice", f.ForecastPrice),
+			sql.Named("lowerPrice", f.LowerPrice),
+			sql.Named("upperPrice", f.UpperPrice),
+			sql.Named("seasonal", f.Seasonal),
+			sql.Named("generatedAt", sqliteTime(f.GeneratedAt)),
+			sql.Named("targetAt", sqliteTime(f.TargetAt)),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// NULL for a nil slice, JSON text otherwise
+func sqliteNullableJson[T any](values []T) (sql.NullString, error) {
+	if values == nil {
+		return sql.NullString{}, nil
+	}
+	s, err := sqliteJson(values)
+	return sql.NullString{String: s, Valid: err == nil}, err
+}
+
+func (s *SQLiteStore) InsertDiagnostics(ctx context.Context, diagnostics []DBSnapshotDiagnostics) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, d := range diagnostics {
+		prices, err := sqliteJson(nonNil(d.Prices))
+		if err != nil {
+			return err
+		}
+		notes, err := sqliteJson(nonNil(d.Notes))
+		if err != nil {
+			return err
+		}
+		silhouettes, err := sqliteNullableJson(d.Silhouettes)
+		if err != nil {
+			return err
+		}
+		cutScores, err := sqliteNullableJson(d.CutScores)
+		if err != nil {
+			return err
+		}
+		inliers, err := sqliteNullableJson(d.InlierPrices)
+		if err != nil {
+			return err
+		}
+		dendrogram := sql.NullString{String: string(d.Dendrogram), Valid: d.Dendrogram != nil}
+
+		_, err = tx.ExecContext(ctx, SQLITE_INSERT_DIAGNOSTICS_QUERY,
+			sql.Named("setId", d.SetId),
+			sql.Named("jewelType", d.JewelType),
+			sql.Named("jewelClass", d.JewelClass),
+			sql.Named("allocatedNode", d.AllocatedNode),
+			sql.Named("estimator", d.Estimator),
+			sql.Named("prices", prices),
+			sql.Named("dendrogram", dendrogram),
+			sql.Named("silhouettes", silhouettes),
+			sql.Named("cutCriterion", d.CutCriterion),
+			sql.Named("cutScores", cutScores),
+			sql.Named("cutLevel", d.CutLevel),
+			sql.Named("inlierPrices", inliers),
+			sql.Named("notes", notes),
+			sql.Named("generatedAt", sqliteTime(d.GeneratedAt)),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) LatestSnapshots(ctx context.Context) ([]LeagueSnapshot, error) {
+	rows, err := s.db.QueryContext(ctx, SQLITE_SELECT_LATEST_SNAPSHOTS_QUERY)
+	return collectSQLite(rows, err, scanSQLiteLeagueSnapshot)
+}
+
+func (s *SQLiteStore) LatestKeySnapshot(ctx context.Context, key JewelKey) (LeagueSnapshot, error) {
+	rows, err := s.db.QueryContext(ctx, SQLITE_SELECT_LATEST_KEY_SNAPSHOT_QUERY, key.Realm, key.League, key.JewelType, key.JewelClass, key.AllocatedNode)
+	snapshots, err := collectSQLite(rows, err, scanSQLiteLeagueSnapshot)
+	if err != nil {
+		return LeagueSnapshot{}, err
+	}
+	if len(snapshots) == 0 {
+		return LeagueSnapshot{}, ErrNotFound
+	}
+	return snapshots[0], nil
+}
+
+func (s *SQLiteStore) LatestNodeFlags(ctx context.Context, realm string, league string, jewelType string, allocatedNode string) ([]DBFlaggedListing, error) {
+	rows, err := s.db.QueryContext(ctx, SQLITE_SELECT_LATEST_NODE_FLAGS_QUERY, realm, league, jewelType, allocatedNode)
+	return collectSQLite(rows, err, scanSQLiteFlag)
+}
+
+func (s *SQLiteStore) LatestForecasts(ctx context.Context, realm string, league string) ([]DBForecast, error) {
+	rows, err := s.db.QueryContext(ctx, SQLITE_SELECT_LATEST_FORECASTS_QUERY, realm, league)
+	return collectSQLite(rows, err, scanSQLiteForecast)
+}
+
+func (s *SQLiteStore) LatestDiagnostics(ctx context.Context, key JewelKey) (DBSnapshotDiagnostics, error) {
+	rows, err := s.db.QueryContext(ctx, SQLITE_SELECT_LATEST_DIAGNOSTICS_QUERY, key.Realm, key.League, key.JewelType, key.JewelClass, key.AllocatedNode)
+	diagnostics, err := collectSQLite(rows, err, scanSQLiteDiagnostics)
+	if err != nil {
+		return DBSnapshotDiagnostics{}, err
+	}
+	if len(diagnostics) == 0 {
+		return DBSnapshotDiagnostics{}, ErrNotFound
+	}
+	return diagnostics[0], nil
+}
+
+func (s *SQLiteStore) RollupChangesets(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, SQLITE_SELECT_ROLLUP_BATCH_QUERY, sqliteTime(cutoff), limit)
+	ids, err := collectSQLite(rows, err, func(rows *sql.Rows, id *int) error {
+		return rows.Scan(id)
+	})
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	param, err := sqliteJson(ids)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.ExecContext(ctx, SQLITE_ROLLUP_CHANGESETS_QUERY, param); err != nil {
+		return 0, err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM changesets WHERE id IN (SELECT value FROM json_each(?))", param); err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), tx.Commit()
+}
+
+func (s *SQLiteStore) OldestSnapshot(ctx context.Context, resolution string, cutoff time.Time) (time.Time, error) {
+	var oldest sql.NullInt64
+	err := s.db.QueryRowContext(ctx, "SELECT min(generatedAt) FROM snapshots WHERE resolution = ? AND generatedAt < ?", resolution, sqliteTime(cutoff)).Scan(&oldest)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !oldest.Valid {
+		return time.Time{}, ErrNotFound
+	}
+	return time.UnixMicro(oldest.Int64), nil
+}
+
+func (s *SQLiteStore) MergeSnapshots(ctx context.Context, from string, to string, start, end time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, SQLITE_SELECT_SNAPSHOT_BUCKET_QUERY, from, sqliteTime(start), sqliteTime(end))
+	bucket, err := collectSQLite(rows, err, func(rows *sql.Rows, b *bucketSnapshot) error {
+		return rows.Scan(&b.Id, &b.Key.Realm, &b.Key.League, &b.Key.JewelType, &b.Key.JewelClass, &b.Key.AllocatedNode, &b.MinPrice, &b.MedianPrice, &b.WindowPrice)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mergeSnapshotBucket(bucket) {
+		_, err = tx.ExecContext(ctx, "UPDATE snapshots SET minPrice = ?, medianPrice = ?, windowPrice = ?, resolution = ? WHERE id = ?",
+			m.MinPrice, m.MedianPrice, m.WindowPrice, to, m.Id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM snapshots WHERE resolution = ? AND generatedAt >= ? AND generatedAt < ?", from, sqliteTime(start), sqliteTime(end))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) ExpiredHistory(ctx context.Context, cutoff time.Time, limit int) ([]DBJewelHistory, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT * FROM jewel_history WHERE delistedAt < ? ORDER BY id LIMIT ?", sqliteTime(cutoff), limit)
+	return collectSQLite(rows, err, scanSQLiteHistory)
+}
+
+func (s *SQLiteStore) DeleteHistory(ctx context.Context, ids []int) error {
+	param, err := sqliteJson(ids)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, "DELETE FROM jewel_history WHERE id IN (SELECT value FROM json_each(?))", param)
+	return err
+}
+
+// SQLite tables aren't partitioned
+func (s *SQLiteStore) DropPartitionsBefore(ctx context.Context, cutoff time.Time, l *log.Logger) (int, error) {
+	return 0, nil
+}
+
+// One snapshot of a bucket being merged by MergeSnapshots
+type bucketSnapshot struct {
+	Id          int
+	Key         JewelKey
+	MinPrice    float64
+	MedianPrice float64
+	WindowPrice float64
+}
+
+// Merges a bucket the way MERGE_SNAPSHOT_BUCKET_QUERY does, for the stores
+// that can't do it in SQL: each key keeps its newest (highest id) snapshot,
+// holding the lowest minimum and the medians of the medians and window
+// prices
+func mergeSnapshotBucket(bucket []bucketSnapshot) []bucketSnapshot {
+	byKey := make(map[JewelKey][]bucketSnapshot)
+	var keys []JewelKey
+	for _, b := range bucket {
+		if _, ok := byKey[b.Key]; !ok {
+			keys = append(keys, b.Key)
+		}
+		byKey[b.Key] = append(byKey[b.Key], b)
+	}
+
+	merged := make([]bucketSnapshot, len(keys))
+	for i, k := range keys {
+		snapshots := byKey[k]
+		m := bucketSnapshot{Key: k, MinPrice: math.Inf(1)}
+		medians := make([]float64, len(snapshots))
+		windows := make([]float64, len(snapshots))
+		for j, b := range snapshots {
+			m.Id = max(m.Id, b.Id)
+			m.MinPrice = math.Min(m.MinPrice, b.MinPrice)
+			medians[j] = b.MedianPrice
+			windows[j] = b.WindowPrice
+		}
+		m.MedianPrice = robust.Median(robust.Sorted(medians))
+		m.WindowPrice = robust.Median(robust.Sorted(windows))
+		merged[i] = m
+	}
+	return merged
+}
+
+// Postgres arrays are NOT NULL; keep the JSON columns consistent with them
+func nonNil[T any](values []T) []T {
+	if values == nil {
+		return []T{}
+	}
+	return values
+}
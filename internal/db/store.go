@@ -0,0 +1,222 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Identifies the listings a snapshot is computed over
+type JewelKey struct {
+	Realm         string
+	League        string
+	JewelType     string
+	JewelClass    string
+	AllocatedNode string
+}
+
+type DBJewelHistory struct {
+	Id                int       `db:"id"`
+	ItemId            string    `db:"itemId"`
+	AccountName       string    `db:"accountName"`
+	Realm             string    `db:"realm"`
+	League            string    `db:"league"`
+	JewelType         string    `db:"jewelType"`
+	JewelClass        string    `db:"jewelClass"`
+	AllocatedNode     string    `db:"allocatedNode"`
+	ListPriceAmount   float64   `db:"listPriceAmount"`
+	ListPriceCurrency string    `db:"listPriceCurrency"`
+	PriceChanges      int       `db:"priceChanges"`
+	FirstSeenAt       time.Time `db:"firstSeenAt"`
+	DelistedAt        time.Time `db:"delistedAt"`
+}
+
+type JewelDelisting struct {
+	Id         int
+	DelistedAt time.Time
+}
+
+// The writes produced by one page of the river. They are applied atomically,
+// and a price or currency change bumps a listing's priceChanges.
+type JewelChanges struct {
+	// Listings that disappeared from their stash; moved to jewel_history
+	Delisted []JewelDelisting
+	// Existing rows, matched by Id: stash, price, seller, change id and
+	// recordedAt are overwritten
+	Updated []DBJewel
+	// New listings, matched by ItemId in case they moved in from a stash
+	// that wasn't part of the page
+	Upserted []DBJewel
+}
+
+// Every listing currently in a stash, as read from one page of the river
+type StashContents struct {
+	StashId    string
+	RecordedAt time.Time
+	Jewels     []DBJewel
+}
+
+// Stores that can apply a whole page as a few set-based statements rather
+// than diffing it against the stored listings first. Listings missing from their
+// stash are delisted, and every other listing is upserted by ItemId the same
+// way JewelChanges would.
+type BulkJewelStore interface {
+	ReplaceStashContents(ctx context.Context, stashes []StashContents) error
+}
+
+type JewelStore interface {
+	// Reads the listings currently recorded in any of the given stashes and
+	// applies the changes `diff` makes of them, in one transaction, so no
+	// other write lands between the read and the apply
+	UpdateStashJewels(ctx context.Context, stashIds []string, diff func(existing []DBJewel) (JewelChanges, error)) error
+	// Listings in each of the realm's leagues recorded after that league's
+	// cutoff
+	JewelsSince(ctx context.Context, realm string, cutoffs map[string]time.Time) ([]DBJewel, error)
+	// Listings for each key recorded after that key's cutoff
+	JewelsForKeys(ctx context.Context, cutoffs map[JewelKey]time.Time) ([]DBJewel, error)
+	// Keys in a realm's league with a listing recorded after `since`, a
+	// listing that fell out of the window between `prevCutoff` and `cutoff`,
+	// a listing priced in one of `currencies`, or a listing delisted after
+	// `since`
+	ChangedKeys(ctx context.Context, realm string, league string, since, prevCutoff, cutoff time.Time, currencies []string) ([]JewelKey, error)
+	// Seller listings in the realm delisted after `since` that were up for
+	// less than `maxLifetime`
+	QuickDelistings(ctx context.Context, realm string, leagues []string, since time.Time, maxLifetime time.Duration) ([]DBJewelHistory, error)
+	// Listings of a node in the realm's league, in any class, newest first
+	NodeJewels(ctx context.Context, realm string, league string, jewelType string, allocatedNode string) ([]DBJewel, error)
+}
+
+type ChangesetStore interface {
+	// The most recently processed changeset of the realm, or ErrNotFound
+	LatestChangeset(ctx context.Context, realm string) (DBChangeset, error)
+	InsertChangeset(ctx context.Context, c DBChangeset) error
+}
+
+type TokenStore interface {
+	// The saved token for the client and scope, or ErrNotFound
+	LoadToken(ctx context.Context, clientId string, scope string) (DBOAuthToken, error)
+	// Replaces any token saved for the same client and scope
+	SaveToken(ctx context.Context, t DBOAuthToken) error
+}
+
+// A window price from an earlier snapshot
+type SnapshotPricePoint struct {
+	Key         JewelKey
+	WindowPrice float64
+	GeneratedAt time.Time
+}
+
+// A snapshot along with the realm and league of its set
+type LeagueSnapshot struct {
+	DBJewelSnapshot
+	Realm  string `db:"realm"`
+	League string `db:"league"`
+}
+
+// A snapshot set along with everything generated for it
+type NewSnapshotSet struct {
+	Realm         string
+	League        string
+	ExchangeRates map[string]float64
+	GeneratedAt   time.Time
+	// The league's time window and recency half-life
+	Window    time.Duration
+	HalfLife  time.Duration
+	Snapshots []DBJewelSnapshot
+	Flags     []DBFlaggedListing
+}
+
+type SnapshotStore interface {
+	// The newest set of each of the realm's leagues that has one
+	LatestSnapshotSets(ctx context.Context, realm string, leagues []string) ([]DBSnapshotSet, error)
+	SnapshotsInSet(ctx context.Context, setId int) ([]DBJewelSnapshot, error)
+	FlagsInSet(ctx context.Context, setId int) ([]DBFlaggedListing, error)
+	// Distinct listings flagged per seller in the realm since `since`
+	PriorFlagCounts(ctx context.Context, realm string, since time.Time) (map[string]int, error)
+	// Window prices of every key in the realm's leagues since `since`,
+	// oldest first
+	SnapshotHistory(ctx context.Context, realm string, leagues []string, since time.Time) ([]SnapshotPricePoint, error)
+	// Inserts the sets, their snapshots and their flags atomically. Returns
+	// the new set ids by league, so the sets must all be from one realm.
+	InsertSnapshotSets(ctx context.Context, sets []NewSnapshotSet) (map[string]int, error)
+	InsertForecasts(ctx context.Context, forecasts []DBForecast) error
+	InsertDiagnostics(ctx context.Context, diagnostics []DBSnapshotDiagnostics) error
+	// Snapshots in the newest set of every realm and league, ordered by
+	// realm, league and key
+	LatestSnapshots(ctx context.Context) ([]LeagueSnapshot, error)
+	// The newest snapshot of the key, or ErrNotFound
+	LatestKeySnapshot(ctx context.Context, key JewelKey) (LeagueSnapshot, error)
+	// Listings of a node, in any class, flagged in the newest set of the
+	// realm's league
+	LatestNodeFlags(ctx context.Context, realm string, league string, jewelType string, allocatedNode string) ([]DBFlaggedListing, error)
+	// Forecasts generated with the newest set of the realm's league,
+	// ordered by key and horizon
+	LatestForecasts(ctx context.Context, realm string, league string) ([]DBForecast, error)
+	// The newest diagnostics recorded for the key, or ErrNotFound
+	LatestDiagnostics(ctx context.Context, key JewelKey) (DBSnapshotDiagnostics, error)
+}
+
+// What the retention command needs to shrink old data; see
+// internal/retention for the policies built on top
+type RetentionStore interface {
+	// Folds up to `limit` changesets processed before `cutoff` into hourly
+	// changeset_rollups. Each realm's newest changeset is kept, since its
+	// reader resumes from it. Returns how many were folded.
+	RollupChangesets(ctx context.Context, cutoff time.Time, limit int) (int64, error)
+	// When the oldest `resolution` snapshot generated before `cutoff` was
+	// generated, or ErrNotFound
+	OldestSnapshot(ctx context.Context, resolution string, cutoff time.Time) (time.Time, error)
+	// Atomically replaces the `from` snapshots generated in [start, end)
+	// with the newest of each key, relabelled `to`, holding the lowest
+	// minimum, the median of the medians and the median of the window
+	// prices across them
+	MergeSnapshots(ctx context.Context, from string, to string, start, end time.Time) error
+	// Up to `limit` listings delisted before `cutoff`, lowest id first
+	ExpiredHistory(ctx context.Context, cutoff time.Time, limit int) ([]DBJewelHistory, error)
+	DeleteHistory(ctx context.Context, ids []int) error
+	// Drops every monthly partition that ended before `cutoff`, where the
+	// backend partitions at all. Returns how many were dropped.
+	DropPartitionsBefore(ctx context.Context, cutoff time.Time, l *log.Logger) (int, error)
+}
+
+// A storage backend along with what the daemons need beyond the stores
+type Store interface {
+	JewelStore
+	ChangesetStore
+	SnapshotStore
+	TokenStore
+	RetentionStore
+	// Fails with ErrSchemaOutdated unless the schema is current
+	CheckSchema(ctx context.Context) error
+	// Blocks until this worker is the only one allowed to write for `role`
+	AcquireLeadership(ctx context.Context, role string, workerId string, l *log.Logger) (*Leader, error)
+	// Creates whatever storage writes up to a few months after `now` need
+	PreparePartitions(ctx context.Context, now time.Time) error
+	Close()
+}
+
+// Opens the backend selected with DB_BACKEND: "postgres" (the default)
+// connects to PG_DB_CONNSTR, "sqlite" opens the file at SQLITE_DB_PATH.
+func OpenStore(ctx context.Context) (Store, error) {
+	switch backend := os.Getenv("DB_BACKEND"); backend {
+	case "", "postgres":
+		pool, err := DBConnect(os.Getenv("PG_DB_CONNSTR"))
+		if err != nil {
+			return nil, err
+		}
+		return NewPGStore(pool), nil
+	case "sqlite":
+		path := os.Getenv("SQLITE_DB_PATH")
+		if path == "" {
+			path = "ffff.db"
+		}
+		return NewSQLiteStore(ctx, SQLiteConfig{Path: path})
+	default:
+		return nil, fmt.Errorf("unknown DB_BACKEND %q", backend)
+	}
+}
@@ -0,0 +1,129 @@
+// Helpers for walking large JSON documents with a json.Decoder, decoding
+// only the parts that are needed and skipping the rest token by token
+package jsonstream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrNotFound = errors.New("path not found")
+
+// Consumes the next token, failing unless it is `want`
+func Expect(d *json.Decoder, want json.Token) error {
+	t, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if t != want {
+		return fmt.Errorf("got token %v, expected token %v", t, want)
+	}
+	return nil
+}
+
+// Consumes the next value whole, whether it's a scalar, an object or an
+// array
+func Skip(d *json.Decoder) error {
+	depth := 0
+	for {
+		t, err := d.Token()
+		// Token fails on numbers too large for a float64, but only after
+		// consuming them, and they're as skippable as any other scalar
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			t, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t {
+		case json.Delim('['), json.Delim('{'):
+			depth++
+		case json.Delim(']'), json.Delim('}'):
+			depth--
+		}
+
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// Calls `fn` with each key of the object at the decoder's position, which
+// must consume the key's value (by decoding it or with Skip). Consumes the
+// closing brace.
+func Fields(d *json.Decoder, fn func(key string) error) error {
+	if err := Expect(d, json.Delim('{')); err != nil {
+		return err
+	}
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := t.(string)
+		if !ok {
+			return fmt.Errorf("got token %v, expected an object key", t)
+		}
+		if err = fn(key); err != nil {
+			return err
+		}
+	}
+	return Expect(d, json.Delim('}'))
+}
+
+// Calls `fn` for each element of the array at the decoder's position, which
+// must consume the element. Consumes the closing bracket.
+func Elements(d *json.Decoder, fn func() error) error {
+	if err := Expect(d, json.Delim('[')); err != nil {
+		return err
+	}
+	for d.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return Expect(d, json.Delim(']'))
+}
+
+// Advances the decoder to the value at `path`, a list of object keys from
+// the decoder's position, skipping everything before it. Fails with
+// ErrNotFound if an object along the way doesn't have the key.
+func Find(d *json.Decoder, path ...string) error {
+	for i, key := range path {
+		if err := Expect(d, json.Delim('{')); err != nil {
+			return fmt.Errorf("%v: %w", path[:i], err)
+		}
+		found := false
+		for d.More() {
+			t, err := d.Token()
+			if err != nil {
+				return err
+			}
+			if t == key {
+				found = true
+				break
+			}
+			if err = Skip(d); err != nil {
+				return err
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: %v", ErrNotFound, path[:i+1])
+		}
+	}
+	return nil
+}
+
+// Decodes the value at `path` in the document read from `r` into `v`,
+// without decoding anything else
+func Extract(r io.Reader, v any, path ...string) error {
+	d := json.NewDecoder(r)
+	if err := Find(d, path...); err != nil {
+		return err
+	}
+	return d.Decode(v)
+}
@@ -0,0 +1,195 @@
+package jsonstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+var skipCases = []struct {
+	name  string
+	value string
+}{
+	{"number", `-12.5e3`},
+	{"number too large for a float64", `1e400`},
+	{"string", `"forbidden"`},
+	{"true", `true`},
+	{"null", `null`},
+	{"empty object", `{}`},
+	{"empty array", `[]`},
+	{"nested", `{"a":[1,{"b":[[],{}]},"c"],"d":{"e":{"f":null}}}`},
+	{"escaped string", `"braces {[ and ]} and a \"quote\" and \\"`},
+	{"escaped key", `{"\"}":{"]":"["}}`},
+}
+
+func TestSkip(t *testing.T) {
+	for _, c := range skipCases {
+		t.Run(c.name, func(t *testing.T) {
+			// The value sits between two others, so Skip has to stop exactly
+			// at its end
+			d := json.NewDecoder(bytes.NewReader([]byte(`[` + c.value + `,"after"]`)))
+			if err := Expect(d, json.Delim('[')); err != nil {
+				t.Fatal(err)
+			}
+			if err := Skip(d); err != nil {
+				t.Fatal(err)
+			}
+			var after string
+			if err := d.Decode(&after); err != nil || after != "after" {
+				t.Fatalf("decoded %q after skipping, %v", after, err)
+			}
+		})
+	}
+}
+
+func TestSkipMalformed(t *testing.T) {
+	for _, doc := range []string{``, `{"a":1`, `[1,2}`, `{"a" 1}`, `[1,]`, `]`, `"unterminated`, `{1:2}`, `tru`} {
+		if err := Skip(json.NewDecoder(bytes.NewReader([]byte(doc)))); err == nil {
+			t.Errorf("skipped %q without an error", doc)
+		}
+	}
+}
+
+var extractCases = []struct {
+	name string
+	doc  string
+	path []string
+	want any
+	err  error
+}{
+	{"top level", `{"a":1}`, nil, map[string]any{"a": 1.0}, nil},
+	{"scalar", `{"psapi":"1-2-3","trade":"4-5-6"}`, []string{"psapi"}, "1-2-3", nil},
+	{"nested", `{"x":[1,{"a":2}],"a":{"y":{},"b":{"c":[true,null]}}}`, []string{"a", "b", "c"}, []any{true, nil}, nil},
+	{"escaped key", `{"a\"b":1,"c":{"d":"é"}}`, []string{"c", "d"}, "é", nil},
+	{"first of duplicates", `{"a":1,"a":2}`, []string{"a"}, 1.0, nil},
+	{"missing key", `{"a":{"b":1}}`, []string{"a", "c"}, nil, ErrNotFound},
+	{"through an array", `{"a":[{"b":1}]}`, []string{"a", "b"}, nil, errors.New("not an object")},
+	{"malformed before the key", `{"x":[1,}],"a":1}`, []string{"a"}, nil, errors.New("syntax")},
+	{"malformed value", `{"a":{"b":}`, []string{"a"}, nil, errors.New("syntax")},
+	{"skipping a huge number", `{"x":1e400,"a":[2]}`, []string{"a"}, []any{2.0}, nil},
+	{"empty document", ``, []string{"a"}, nil, io.EOF},
+}
+
+func TestExtract(t *testing.T) {
+	for _, c := range extractCases {
+		t.Run(c.name, func(t *testing.T) {
+			var got any
+			err := Extract(bytes.NewReader([]byte(c.doc)), &got, c.path...)
+			switch {
+			case c.err == nil && err != nil:
+				t.Fatalf("extracting %v: %s", c.path, err)
+			case c.err == nil && !reflect.DeepEqual(got, c.want):
+				t.Fatalf("extracted %#v, expected %#v", got, c.want)
+			case c.err != nil && err == nil:
+				t.Fatalf("extracted %#v, expected an error", got)
+			case (c.err == ErrNotFound || c.err == io.EOF) && !errors.Is(err, c.err):
+				t.Fatalf("failed with %s, expected %s", err, c.err)
+			}
+		})
+	}
+}
+
+func FuzzSkip(f *testing.F) {
+	for _, c := range skipCases {
+		f.Add([]byte(c.value))
+	}
+	f.Add([]byte(`{"a":1} {"b":2}`))
+	f.Add([]byte(`[1,2}`))
+
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		// A document is valid if and only if Skip consumes one value and
+		// nothing but whitespace follows it
+		d := json.NewDecoder(bytes.NewReader(doc))
+		err := Skip(d)
+		skipped := err == nil
+		if skipped {
+			_, err = d.Token()
+		}
+		if valid := json.Valid(doc); valid != (skipped && err == io.EOF) {
+			t.Fatalf("json.Valid is %t, but Skip gave %v for %q", valid, err, doc)
+		}
+		if !skipped {
+			return
+		}
+
+		// And it consumes exactly what decoding the value would
+		skipper := json.NewDecoder(bytes.NewReader(doc))
+		Skip(skipper)
+		decoder := json.NewDecoder(bytes.NewReader(doc))
+		var raw json.RawMessage
+		if err = decoder.Decode(&raw); err != nil {
+			t.Fatalf("Skip accepted %q, which doesn't decode: %s", doc, err)
+		}
+		if skipper.InputOffset() != decoder.InputOffset() {
+			t.Fatalf("Skip stopped at %d, decoding at %d in %q", skipper.InputOffset(), decoder.InputOffset(), doc)
+		}
+	})
+}
+
+func FuzzExtract(f *testing.F) {
+	for _, c := range extractCases {
+		var first, second string
+		if len(c.path) > 0 {
+			first = c.path[0]
+		}
+		if len(c.path) > 1 {
+			second = c.path[1]
+		}
+		f.Add([]byte(c.doc), first, second)
+	}
+
+	f.Fuzz(func(t *testing.T, doc []byte, first string, second string) {
+		var path []string
+		for _, key := range []string{first, second} {
+			if key != "" {
+				path = append(path, key)
+			}
+		}
+
+		// Arbitrary input must only ever fail, never panic
+		var v any
+		Extract(bytes.NewReader(doc), &v, path...)
+
+		// encoding/json keeps the last of duplicate keys where Extract
+		// takes the first, so the comparison runs on the document as
+		// encoding/json re-encodes it
+		var whole any
+		if err := json.Unmarshal(doc, &whole); err != nil {
+			return
+		}
+		canonical, err := json.Marshal(whole)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := whole
+		var wantErr error
+		for _, key := range path {
+			obj, ok := want.(map[string]any)
+			if !ok {
+				wantErr = errors.New("not an object")
+				break
+			}
+			if want, ok = obj[key]; !ok {
+				wantErr = ErrNotFound
+				break
+			}
+		}
+
+		var got any
+		err = Extract(bytes.NewReader(canonical), &got, path...)
+		switch {
+		case wantErr == nil && err != nil:
+			t.Fatalf("extracting %q from %s: %s", path, canonical, err)
+		case wantErr == nil && !reflect.DeepEqual(got, want):
+			t.Fatalf("extracted %#v from %s at %q, encoding/json found %#v", got, canonical, path, want)
+		case wantErr != nil && err == nil:
+			t.Fatalf("extracted %#v from %s at %q, which encoding/json can't reach", got, canonical, path)
+		case wantErr == ErrNotFound && !errors.Is(err, ErrNotFound):
+			t.Fatalf("extracting %q from %s failed with %s, expected ErrNotFound", path, canonical, err)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+// A minimal registry of gauges served in the Prometheus text format, for the
+// daemons that don't otherwise run an HTTP server
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Gauge struct {
+	name string
+	help string
+	// Rendered as {k="v",...}; empty for unlabelled gauges
+	labels string
+	bits   atomic.Uint64
+	set    atomic.Bool
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*Gauge)
+)
+
+// Registers a gauge under `name` and the given label name/value pairs, or
+// returns the one already registered with them
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	var rendered string
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+		}
+		rendered = "{" + strings.Join(pairs, ",") + "}"
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if g, ok := registry[name+rendered]; ok {
+		return g
+	}
+	g := &Gauge{name: name, help: help, labels: rendered}
+	registry[name+rendered] = g
+	return g
+}
+
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+	g.set.Store(true)
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Serves every gauge that has been set at least once
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMu.Lock()
+		gauges := make([]*Gauge, 0, len(registry))
+		for _, g := range registry {
+			gauges = append(gauges, g)
+		}
+		registryMu.Unlock()
+		sort.Slice(gauges, func(i, j int) bool {
+			if gauges[i].name != gauges[j].name {
+				return gauges[i].name < gauges[j].name
+			}
+			return gauges[i].labels < gauges[j].labels
+		})
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		described := ""
+		for _, g := range gauges {
+			if !g.set.Load() {
+				continue
+			}
+			// Every series of a metric shares one HELP and TYPE line
+			if g.name != described {
+				fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+				described = g.name
+			}
+			fmt.Fprintf(w, "%s%s %g\n", g.name, g.labels, g.Value())
+		}
+	})
+}
+
+// Serves /metrics on `addr` in the background
+func Serve(addr string, l *log.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", Handler())
+	go func() {
+		l.Printf("serving metrics on %s\n", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			l.Printf("metrics server stopped: %s\n", err)
+		}
+	}()
+}
@@ -1,62 +1,39 @@
 package poeninja
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
+
+	"github.com/faideww/ffff/internal/jsonstream"
 )
 
-func expect(d *json.Decoder, expectedT interface{}) error {
-	t, err := d.Token()
+func GetLatestPSChangeId(ctx context.Context, client *http.Client) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://poe.ninja/api/data/getstats", nil)
 	if err != nil {
-		return err
-	}
-	if t != expectedT {
-		return fmt.Errorf("got token %v, expected token %v", t, expectedT)
-	}
-	return nil
-}
-
-func skip(d *json.Decoder) error {
-	nestLevel := 0
-	for {
-		t, err := d.Token()
-		if err != nil {
-			return err
-		}
-
-		switch t {
-		case json.Delim('['), json.Delim('{'):
-			nestLevel++
-		case json.Delim(']'), json.Delim('}'):
-			nestLevel++
-		}
-
-		if nestLevel == 0 {
-			return nil
-		}
-	}
-}
-
-func GetLatestPSChangeId(client *http.Client) (string, error) {
-	type ChangeIdResponse struct {
-		NextChangeId string `json:"next_change_id"`
+		return "", err
 	}
-
-	req, _ := http.NewRequest("GET", "https://poe.ninja/api/data/getstats", nil)
 	// req.Header.Add("User-Agent", os.Getenv("GGG_USERAGENT"))
 	resp, err := client.Do(req)
-	// bodyBytes, _ := io.ReadAll(resp.Body)
-	// fmt.Printf("%+v\n", string(bodyBytes))
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
-	data := ChangeIdResponse{}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("poe.ninja returned %s", resp.Status)
+	}
 
-	json.NewDecoder(resp.Body).Decode(&data)
-	return data.NextChangeId, nil
+	var nextChangeId string
+	if err = jsonstream.Extract(resp.Body, &nextChangeId, "next_change_id"); err != nil {
+		return "", err
+	}
+	if nextChangeId == "" {
+		return "", errors.New("poe.ninja returned an empty change id")
+	}
+	return nextChangeId, nil
 }
 
 // poe.ninja API types
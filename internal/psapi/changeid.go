@@ -0,0 +1,101 @@
+package psapi
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrShardCountChanged = errors.New("change ids have different numbers of shards")
+
+// Returned by Compare when one id is ahead on some shards and behind on others
+var ErrUnordered = errors.New("change ids are ahead of each other on different shards")
+
+// A position in the public stash river: one counter per shard, written as
+// the counters joined with '-'. GGG has added shards before, so two ids
+// aren't guaranteed to have the same number.
+type ChangeId struct {
+	Shards []int64
+}
+
+func ParseChangeId(s string) (ChangeId, error) {
+	if s == "" {
+		return ChangeId{}, errors.New("empty change id")
+	}
+	parts := strings.Split(s, "-")
+	shards := make([]int64, len(parts))
+	for i, p := range parts {
+		// ParseInt takes a leading '+', which would break the round trip
+		// through String
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || n < 0 || strings.HasPrefix(p, "+") {
+			return ChangeId{}, fmt.Errorf("invalid change id %q: shard %d is %q", s, i, p)
+		}
+		shards[i] = n
+	}
+	return ChangeId{shards}, nil
+}
+
+func (c ChangeId) String() string {
+	parts := make([]string, len(c.Shards))
+	for i, n := range c.Shards {
+		parts[i] = strconv.FormatInt(n, 10)
+	}
+	return strings.Join(parts, "-")
+}
+
+func (c ChangeId) checkShards(o ChangeId) error {
+	if len(c.Shards) != len(o.Shards) {
+		return fmt.Errorf("%w (%d and %d)", ErrShardCountChanged, len(c.Shards), len(o.Shards))
+	}
+	return nil
+}
+
+// How far `o` is ahead of `c` on each shard; negative where it's behind
+func (c ChangeId) Deltas(o ChangeId) ([]int64, error) {
+	if err := c.checkShards(o); err != nil {
+		return nil, err
+	}
+	deltas := make([]int64, len(c.Shards))
+	for i := range c.Shards {
+		deltas[i] = o.Shards[i] - c.Shards[i]
+	}
+	return deltas, nil
+}
+
+// -1 if `c` is behind `o` on at least one shard and ahead on none, 1 if
+// it's ahead, 0 if they're equal
+func (c ChangeId) Compare(o ChangeId) (int, error) {
+	deltas, err := c.Deltas(o)
+	if err != nil {
+		return 0, err
+	}
+	behind, ahead := false, false
+	for _, d := range deltas {
+		behind = behind || d > 0
+		ahead = ahead || d < 0
+	}
+	switch {
+	case behind && ahead:
+		return 0, ErrUnordered
+	case behind:
+		return -1, nil
+	case ahead:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// How far `c` lags `head`, in total and on each shard
+func (c ChangeId) Drift(head ChangeId) (int64, []int64, error) {
+	deltas, err := c.Deltas(head)
+	if err != nil {
+		return 0, nil, err
+	}
+	var total int64
+	for _, d := range deltas {
+		total += d
+	}
+	return total, deltas, nil
+}
@@ -0,0 +1,78 @@
+package psapi
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func mustParseChangeId(t *testing.T, s string) ChangeId {
+	t.Helper()
+	id, err := ParseChangeId(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestParseChangeId(t *testing.T) {
+	for s, want := range map[string][]int64{
+		"42":                 {42},
+		"1-2-3":              {1, 2, 3},
+		"0-0":                {0, 0},
+		"2411817395-2418540": {2411817395, 2418540},
+	} {
+		id := mustParseChangeId(t, s)
+		if !slices.Equal(id.Shards, want) || id.String() != s {
+			t.Errorf("parsed %q as %v (%s), expected %v", s, id.Shards, id, want)
+		}
+	}
+
+	for _, s := range []string{"", "-", "1--2", "-1-2", "1-2-", "1-a", "1-+2", "1-2.5", "1-99999999999999999999", " 1-2"} {
+		if id, err := ParseChangeId(s); err == nil {
+			t.Errorf("parsed malformed %q as %v", s, id.Shards)
+		}
+	}
+}
+
+var compareCases = []struct {
+	name string
+	c, o string
+	want int
+	err  error
+	// Drift of c from o
+	total  int64
+	deltas []int64
+}{
+	{"equal", "10-20-30", "10-20-30", 0, nil, 0, []int64{0, 0, 0}},
+	{"one shard behind", "10-20-30", "10-25-30", -1, nil, 5, []int64{0, 5, 0}},
+	{"one shard ahead", "10-25-30", "10-20-30", 1, nil, -5, []int64{0, -5, 0}},
+	{"every shard behind", "10-20", "15-22", -1, nil, 7, []int64{5, 2}},
+	{"mixed", "10-20", "12-18", 0, ErrUnordered, 0, []int64{2, -2}},
+	{"different shard counts", "10-20", "10-20-30", 0, ErrShardCountChanged, 0, nil},
+}
+
+func TestChangeIdCompareAndDrift(t *testing.T) {
+	for _, c := range compareCases {
+		t.Run(c.name, func(t *testing.T) {
+			id, other := mustParseChangeId(t, c.c), mustParseChangeId(t, c.o)
+			order, err := id.Compare(other)
+			if order != c.want || !errors.Is(err, c.err) {
+				t.Errorf("Compare gave %d, %v, expected %d, %v", order, err, c.want, c.err)
+			}
+
+			// Drift has no order to get wrong, so only a change in the
+			// number of shards fails it
+			total, deltas, err := id.Drift(other)
+			if c.err == ErrShardCountChanged {
+				if !errors.Is(err, ErrShardCountChanged) {
+					t.Errorf("Drift gave %d, %v, %v across different shard counts", total, deltas, err)
+				}
+				return
+			}
+			if err != nil || total != c.total || !slices.Equal(deltas, c.deltas) {
+				t.Errorf("Drift gave %d, %v, %v, expected %d, %v", total, deltas, err, c.total, c.deltas)
+			}
+		})
+	}
+}
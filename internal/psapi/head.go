@@ -0,0 +1,153 @@
+package psapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/faideww/ffff/internal/poeninja"
+)
+
+// How long the last good head is handed out while every provider is failing
+const HEAD_CACHE_MAX_AGE = 15 * time.Minute
+
+// A source of the latest change id at the head of the river
+type HeadProvider interface {
+	Name() string
+	LatestChangeId(ctx context.Context) (string, error)
+}
+
+type poeNinjaHead struct{ client *http.Client }
+
+func (p poeNinjaHead) Name() string { return "poeninja" }
+
+func (p poeNinjaHead) LatestChangeId(ctx context.Context) (string, error) {
+	return poeninja.GetLatestPSChangeId(ctx, p.client)
+}
+
+// pathofexile.com tends to refuse requests from cloud IPs, so this is
+// usually the fallback
+type gggHead struct{ client *http.Client }
+
+func (p gggHead) Name() string { return "ggg" }
+
+func (p gggHead) LatestChangeId(ctx context.Context) (string, error) {
+	return GetLatestChangeIdGGG(ctx, p.client)
+}
+
+// Builds providers from a comma-separated list of names, in order
+func ParseHeadProviders(names string, client *http.Client) ([]HeadProvider, error) {
+	var providers []HeadProvider
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "poeninja":
+			providers = append(providers, poeNinjaHead{client})
+		case "ggg":
+			providers = append(providers, gggHead{client})
+		default:
+			return nil, fmt.Errorf("unknown head provider %q", name)
+		}
+	}
+	return providers, nil
+}
+
+type Head struct {
+	Id     ChangeId
+	Source string
+	// When the head was fetched
+	At time.Time
+	// Set when every provider failed and this is the last good head
+	Cached bool
+}
+
+// Asks each provider in turn for the head, keeping the first valid answer
+type HeadChain struct {
+	Providers []HeadProvider
+	// Per provider
+	Timeout time.Duration
+	last    *Head
+	l       *log.Logger
+}
+
+func NewHeadChain(providers []HeadProvider, timeout time.Duration, l *log.Logger) *HeadChain {
+	return &HeadChain{Providers: providers, Timeout: timeout, l: l}
+}
+
+// Returns the head from the first provider that gives a well-formed change
+// id that isn't behind `cursor` (when given) and has as many shards. If none
+// does, the last good head is returned for up to HEAD_CACHE_MAX_AGE.
+func (c *HeadChain) Latest(ctx context.Context, cursor string) (Head, error) {
+	var current ChangeId
+	var err error
+	if cursor != "" {
+		if current, err = ParseChangeId(cursor); err != nil {
+			return Head{}, err
+		}
+	}
+
+	var errs []error
+	for _, p := range c.Providers {
+		head, err := c.fetch(ctx, p, current)
+		if err != nil {
+			c.l.Printf("head provider %s failed: %s\n", p.Name(), err)
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		c.last = &head
+		return head, nil
+	}
+
+	// The cursor may have moved past the last good head since it was
+	// fetched, or crossed a reshard, so it's held to the same checks
+	if c.last != nil && time.Since(c.last.At) < HEAD_CACHE_MAX_AGE {
+		if err := checkHead(c.last.Id, current); err != nil {
+			errs = append(errs, fmt.Errorf("cached head from %s: %w", c.last.Source, err))
+		} else {
+			c.l.Printf("using the head from %s fetched at %s\n", c.last.Source, c.last.At.Format(time.TimeOnly))
+			cached := *c.last
+			cached.Cached = true
+			return cached, nil
+		}
+	}
+	return Head{}, errors.Join(errs...)
+}
+
+func (c *HeadChain) fetch(ctx context.Context, p HeadProvider, current ChangeId) (Head, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	raw, err := p.LatestChangeId(ctx)
+	if err != nil {
+		return Head{}, err
+	}
+	id, err := ParseChangeId(raw)
+	if err != nil {
+		return Head{}, err
+	}
+	if err = checkHead(id, current); err != nil {
+		return Head{}, err
+	}
+	return Head{Id: id, Source: p.Name(), At: time.Now()}, nil
+}
+
+// Fails if `id` is behind the cursor `current` (when given) or has a
+// different number of shards. A head with a different number of shards is
+// most likely GGG resharding ahead of the cursor. Drift can't be measured
+// across that, so it goes unmeasured until the reader reaches the new
+// shards.
+func checkHead(id ChangeId, current ChangeId) error {
+	if len(current.Shards) == 0 {
+		return nil
+	}
+	order, err := id.Compare(current)
+	if errors.Is(err, ErrShardCountChanged) {
+		return fmt.Errorf("head %s can't be compared to our cursor %s, the river may have been resharded: %w", id, current, err)
+	} else if err == nil && order < 0 {
+		return fmt.Errorf("head %s is behind our cursor %s", id, current)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package psapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+const TEST_HEAD_TIMEOUT = 20 * time.Millisecond
+
+type fakeHead struct {
+	name  string
+	id    string
+	err   error
+	delay time.Duration
+	calls int
+}
+
+func (p *fakeHead) Name() string { return p.name }
+
+func (p *fakeHead) LatestChangeId(ctx context.Context) (string, error) {
+	p.calls++
+	select {
+	case <-time.After(p.delay):
+		return p.id, p.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func testHeadChain(providers ...*fakeHead) *HeadChain {
+	chain := make([]HeadProvider, len(providers))
+	for i, p := range providers {
+		chain[i] = p
+	}
+	return NewHeadChain(chain, TEST_HEAD_TIMEOUT, log.New(io.Discard, "", 0))
+}
+
+func expectHead(t *testing.T, head Head, err error, source string, id string, cached bool) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Source != source || head.Id.String() != id || head.Cached != cached {
+		t.Fatalf("head %s from %s (cached %t), expected %s from %s (cached %t)", head.Id, head.Source, head.Cached, id, source, cached)
+	}
+}
+
+func TestHeadChainOrder(t *testing.T) {
+	first := &fakeHead{name: "first", id: "10-20"}
+	second := &fakeHead{name: "second", id: "30-40"}
+	chain := testHeadChain(first, second)
+
+	head, err := chain.Latest(context.Background(), "")
+	expectHead(t, head, err, "first", "10-20", false)
+	if second.calls != 0 {
+		t.Errorf("asked the second provider after the first answered")
+	}
+
+	for _, bad := range []*fakeHead{{name: "first", err: errors.New("down")}, {name: "first", id: "not-a-change-id"}} {
+		chain = testHeadChain(bad, second)
+		head, err = chain.Latest(context.Background(), "")
+		expectHead(t, head, err, "second", "30-40", false)
+	}
+}
+
+func TestHeadChainTimeout(t *testing.T) {
+	slow := &fakeHead{name: "slow", id: "10-20", delay: time.Minute}
+	fast := &fakeHead{name: "fast", id: "30-40"}
+	chain := testHeadChain(slow, fast)
+
+	start := time.Now()
+	head, err := chain.Latest(context.Background(), "")
+	expectHead(t, head, err, "fast", "30-40", false)
+	if elapsed := time.Since(start); elapsed > 10*TEST_HEAD_TIMEOUT {
+		t.Errorf("took %s to give up on a provider with a %s timeout", elapsed, TEST_HEAD_TIMEOUT)
+	}
+}
+
+func TestHeadChainRejectsStaleHead(t *testing.T) {
+	behind := &fakeHead{name: "behind", id: "10-20"}
+	resharded := &fakeHead{name: "resharded", id: "200-300-5"}
+	ahead := &fakeHead{name: "ahead", id: "100-200"}
+
+	head, err := testHeadChain(behind, resharded, ahead).Latest(context.Background(), "50-60")
+	expectHead(t, head, err, "ahead", "100-200", false)
+
+	// Ahead on one shard and behind on another can't be ordered, so it's
+	// given the benefit of the doubt
+	unordered := &fakeHead{name: "unordered", id: "40-70"}
+	head, err = testHeadChain(unordered, ahead).Latest(context.Background(), "50-60")
+	expectHead(t, head, err, "unordered", "40-70", false)
+
+	_, err = testHeadChain(behind, resharded).Latest(context.Background(), "50-60")
+	if !errors.Is(err, ErrShardCountChanged) {
+		t.Errorf("got %v with no usable head, expected the reshard to be reported", err)
+	}
+}
+
+func TestHeadChainCacheExpiry(t *testing.T) {
+	provider := &fakeHead{name: "flaky", id: "100-200"}
+	chain := testHeadChain(provider)
+	head, err := chain.Latest(context.Background(), "50-60")
+	expectHead(t, head, err, "flaky", "100-200", false)
+
+	provider.id, provider.err = "", errors.New("down")
+	head, err = chain.Latest(context.Background(), "50-60")
+	expectHead(t, head, err, "flaky", "100-200", true)
+
+	// The cached head has two shards, so it can't be used once the cursor
+	// has three
+	if _, err = chain.Latest(context.Background(), "50-60-5"); err == nil {
+		t.Errorf("handed out a cached head with a different number of shards to the cursor")
+	}
+
+	chain.last.At = time.Now().Add(-HEAD_CACHE_MAX_AGE)
+	if _, err = chain.Latest(context.Background(), "50-60"); err == nil {
+		t.Errorf("handed out a cached head older than HEAD_CACHE_MAX_AGE")
+	}
+}
+
+func TestHeadChainCacheBehindCursor(t *testing.T) {
+	provider := &fakeHead{name: "flaky", id: "100-200"}
+	chain := testHeadChain(provider)
+	head, err := chain.Latest(context.Background(), "50-60")
+	expectHead(t, head, err, "flaky", "100-200", false)
+	provider.id, provider.err = "", errors.New("down")
+
+	// The reader catching up to the cached head, or passing it on one shard
+	// only, still leaves it usable
+	for _, cursor := range []string{"100-200", "120-150"} {
+		head, err = chain.Latest(context.Background(), cursor)
+		expectHead(t, head, err, "flaky", "100-200", true)
+	}
+
+	// Once the cursor has moved ahead of it, it would report negative drift
+	if head, err = chain.Latest(context.Background(), "120-210"); err == nil {
+		t.Errorf("handed out cached head %s behind the cursor", head.Id)
+	}
+}
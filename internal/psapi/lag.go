@@ -0,0 +1,115 @@
+package psapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Weight of the newest sample in the smoothed head rate
+const HEAD_RATE_SMOOTHING = 0.3
+
+// Learns how fast the river head advances, in shard counter increments per
+// second, from successive head samples, so drift can be turned into time
+type HeadRateModel struct {
+	last   ChangeId
+	lastAt time.Time
+	rate   float64
+	known  bool
+}
+
+func (m *HeadRateModel) Observe(head ChangeId, at time.Time) {
+	prev, prevAt := m.last, m.lastAt
+	m.last, m.lastAt = head, at
+	if prevAt.IsZero() || !at.After(prevAt) {
+		return
+	}
+
+	// A sample across a shard count change says nothing about the rate, but
+	// the old rate is still the best guess until the next sample
+	total, _, err := prev.Drift(head)
+	if err != nil || total < 0 {
+		return
+	}
+
+	rate := float64(total) / at.Sub(prevAt).Seconds()
+	if !m.known {
+		m.rate = rate
+		m.known = true
+		return
+	}
+	m.rate = HEAD_RATE_SMOOTHING*rate + (1-HEAD_RATE_SMOOTHING)*m.rate
+}
+
+// Head advancement in shard counter increments per second, once two
+// samples have been seen
+func (m *HeadRateModel) Rate() (float64, bool) {
+	return m.rate, m.known && m.rate > 0
+}
+
+// How many minutes it takes the head to advance by `drift`
+func (m *HeadRateModel) LagMinutes(drift int64) (float64, bool) {
+	rate, ok := m.Rate()
+	if !ok {
+		return 0, false
+	}
+	return float64(drift) / rate / 60, true
+}
+
+// Raises an alert once lag goes over the threshold and again once it has
+// recovered, rather than on every page
+type LagAlert struct {
+	Realm            string
+	ThresholdMinutes float64
+	// Optional; alerts are always logged. The message is posted as both
+	// "text" and "content" so Slack and Discord webhooks accept it.
+	WebhookUrl string
+	firing     bool
+	client     *http.Client
+}
+
+func NewLagAlert(realm string, thresholdMinutes float64) *LagAlert {
+	return &LagAlert{
+		Realm:            realm,
+		ThresholdMinutes: thresholdMinutes,
+		WebhookUrl:       os.Getenv("LAG_ALERT_WEBHOOK_URL"),
+		client:           &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (a *LagAlert) Check(lagMinutes float64, l *log.Logger) {
+	if a.ThresholdMinutes <= 0 {
+		return
+	}
+
+	var msg string
+	switch {
+	case !a.firing && lagMinutes > a.ThresholdMinutes:
+		a.firing = true
+		msg = fmt.Sprintf("read-river is %.0f minutes behind the %s river head (threshold %.0f)", lagMinutes, a.Realm, a.ThresholdMinutes)
+	case a.firing && lagMinutes <= a.ThresholdMinutes:
+		a.firing = false
+		msg = fmt.Sprintf("read-river has caught up to %.0f minutes behind the %s river head", lagMinutes, a.Realm)
+	default:
+		return
+	}
+
+	l.Printf("ALERT: %s\n", msg)
+	if a.WebhookUrl == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"text": msg, "content": msg})
+	resp, err := a.client.Post(a.WebhookUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		l.Printf("failed to send lag alert: %s\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		l.Printf("lag alert webhook returned %s\n", resp.Status)
+	}
+}
@@ -0,0 +1,124 @@
+package psapi
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Feeds the model heads at offsets from a fixed start, each one moved on
+// from the last by `advance` (one per shard)
+type headSamples struct {
+	t     *testing.T
+	model *HeadRateModel
+	start time.Time
+	head  ChangeId
+}
+
+func newHeadSamples(t *testing.T, head string) *headSamples {
+	return &headSamples{t: t, model: &HeadRateModel{}, start: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC), head: mustParseChangeId(t, head)}
+}
+
+func (s *headSamples) observe(at time.Duration, advance ...int64) {
+	next := ChangeId{make([]int64, len(s.head.Shards))}
+	for i, n := range s.head.Shards {
+		next.Shards[i] = n + advance[i]
+	}
+	s.head = next
+	s.model.Observe(next, s.start.Add(at))
+}
+
+func (s *headSamples) expectRate(want float64) {
+	s.t.Helper()
+	rate, ok := s.model.Rate()
+	if !ok || math.Abs(rate-want) > 1e-9 {
+		s.t.Fatalf("rate %v (known %t), expected %v", rate, ok, want)
+	}
+}
+
+func (s *headSamples) expectUnknown() {
+	s.t.Helper()
+	if rate, ok := s.model.Rate(); ok {
+		s.t.Fatalf("rate %v known, expected unknown", rate)
+	}
+	if lag, ok := s.model.LagMinutes(100); ok {
+		s.t.Fatalf("lag %v minutes known, expected unknown", lag)
+	}
+}
+
+func TestHeadRateNoSamples(t *testing.T) {
+	s := newHeadSamples(t, "100-200")
+	s.expectUnknown()
+
+	// One sample has nothing to measure against
+	s.observe(0, 0, 0)
+	s.expectUnknown()
+
+	// Nor does a second at the same instant, or one from the past
+	s.observe(0, 30, 30)
+	s.observe(-time.Minute, 30, 30)
+	s.expectUnknown()
+}
+
+func TestHeadRateSteady(t *testing.T) {
+	s := newHeadSamples(t, "100-200")
+	s.observe(0, 0, 0)
+	// 600 increments a minute over the two shards
+	for i := 1; i <= 5; i++ {
+		s.observe(time.Duration(i)*time.Minute, 200, 400)
+		s.expectRate(10)
+	}
+
+	// A late sample covers a longer interval, but at the same rate
+	s.observe(15*time.Minute, 2000, 4000)
+	s.expectRate(10)
+
+	if lag, ok := s.model.LagMinutes(1200); !ok || lag != 2 {
+		t.Errorf("1200 increments behind is %v minutes (known %t), expected 2", lag, ok)
+	}
+
+	// A reshard or a head going backwards can't be measured, so the rate
+	// stands
+	s.model.Observe(mustParseChangeId(t, "1-2-3"), s.start.Add(16*time.Minute))
+	s.expectRate(10)
+	s.head = mustParseChangeId(t, "1-2-3")
+	s.observe(17*time.Minute, -1, -1, -1)
+	s.expectRate(10)
+}
+
+func TestHeadRateRecoversAfterStall(t *testing.T) {
+	s := newHeadSamples(t, "100-200")
+	s.observe(0, 0, 0)
+	s.observe(time.Minute, 200, 400)
+	s.expectRate(10)
+
+	// The head stops; the rate decays towards 0 but is still usable
+	want := 10.0
+	for i := 2; i <= 4; i++ {
+		s.observe(time.Duration(i)*time.Minute, 0, 0)
+		want *= 1 - HEAD_RATE_SMOOTHING
+		s.expectRate(want)
+	}
+
+	// Once it moves again the rate climbs back
+	for i := 5; i <= 20; i++ {
+		s.observe(time.Duration(i)*time.Minute, 200, 400)
+		want = HEAD_RATE_SMOOTHING*10 + (1-HEAD_RATE_SMOOTHING)*want
+		s.expectRate(want)
+	}
+	if want < 9.9 {
+		t.Errorf("rate only recovered to %v", want)
+	}
+}
+
+func TestHeadRateStartingStalled(t *testing.T) {
+	// A head that hasn't moved between the first two samples gives a rate of
+	// 0, which can't turn drift into time
+	s := newHeadSamples(t, "100-200")
+	s.observe(0, 0, 0)
+	s.observe(time.Minute, 0, 0)
+	s.expectUnknown()
+
+	s.observe(2*time.Minute, 200, 400)
+	s.expectRate(HEAD_RATE_SMOOTHING * 10)
+}
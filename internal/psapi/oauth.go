@@ -0,0 +1,214 @@
+package psapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	db "github.com/faideww/ffff/internal/db"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const GGG_TOKEN_URL = "https://www.pathofexile.com/oauth/token"
+const PSAPI_SCOPE = "service:psapi"
+
+// Tokens are replaced this long before they expire, or halfway through
+// their lifetime if that's shorter
+const TOKEN_REFRESH_MARGIN = 10 * time.Minute
+
+// Supplies the bearer token sent with psapi requests
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+	// Called when psapi rejects the token with a 401
+	Invalidate()
+}
+
+// A token set in GGG_OAUTH_TOKEN, for setups without client credentials
+type staticToken string
+
+func (t staticToken) Token(ctx context.Context) (string, error) {
+	if t == "" {
+		return "", errors.New("neither GGG_CLIENT_ID nor GGG_OAUTH_TOKEN is set")
+	}
+	return string(t), nil
+}
+
+func (t staticToken) Invalidate() {}
+
+// Uses the client_credentials grant when GGG_CLIENT_ID and GGG_CLIENT_SECRET
+// are set, and the static GGG_OAUTH_TOKEN otherwise. GGG_TOKEN_URL points
+// the grant at another token endpoint, such as a local fake.
+func NewTokenSource(store db.TokenStore, client *http.Client, l *log.Logger) (TokenSource, error) {
+	clientId := os.Getenv("GGG_CLIENT_ID")
+	if clientId == "" {
+		return staticToken(os.Getenv("GGG_OAUTH_TOKEN")), nil
+	}
+	secret := os.Getenv("GGG_CLIENT_SECRET")
+	if secret == "" {
+		return nil, errors.New("GGG_CLIENT_ID is set but GGG_CLIENT_SECRET isn't")
+	}
+	tokenUrl := os.Getenv("GGG_TOKEN_URL")
+	if tokenUrl == "" {
+		tokenUrl = GGG_TOKEN_URL
+	}
+	return NewOAuthClient(tokenUrl, clientId, secret, PSAPI_SCOPE, store, client, l), nil
+}
+
+// Gets tokens with the client_credentials grant and keeps the current one
+// in a TokenStore, so restarts reuse it instead of requesting another
+type OAuthClient struct {
+	TokenUrl     string
+	ClientId     string
+	ClientSecret string
+	Scope        string
+
+	mu     sync.Mutex
+	client *http.Client
+	store  db.TokenStore
+	token  *db.DBOAuthToken
+	loaded bool
+	// The last token psapi rejected, which isn't handed out again even if
+	// it's still the one in the store, until a fresh grant succeeds
+	rejected string
+	l        *log.Logger
+}
+
+func NewOAuthClient(tokenUrl string, clientId string, clientSecret string, scope string, store db.TokenStore, client *http.Client, l *log.Logger) *OAuthClient {
+	return &OAuthClient{
+		TokenUrl:     tokenUrl,
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		Scope:        scope,
+		client:       client,
+		store:        store,
+		l:            l,
+	}
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	// Absent or null for tokens that don't expire
+	ExpiresIn *int64 `json:"expires_in"`
+	TokenType string `json:"token_type"`
+	Scope     string `json:"scope"`
+}
+
+func (c *OAuthClient) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.loaded {
+		t, err := c.store.LoadToken(ctx, c.ClientId, c.Scope)
+		if err == nil {
+			c.token = &t
+		} else if !errors.Is(err, db.ErrNotFound) {
+			return "", err
+		}
+		c.loaded = true
+	}
+
+	now := time.Now()
+	if c.token != nil && !c.dueForRefresh(*c.token, now) {
+		return c.token.AccessToken, nil
+	}
+
+	t, err := c.requestToken(ctx, now)
+	if err != nil {
+		// A token that's due for refresh may still have a while left
+		if c.token != nil && c.valid(*c.token, now) {
+			c.l.Printf("failed to refresh oauth token, using the current one: %s\n", err)
+			return c.token.AccessToken, nil
+		}
+		return "", err
+	}
+	c.token = &t
+	// The endpoint may hand the rejected token back; having asked for a new
+	// one, it's used rather than re-requested on every call
+	c.rejected = ""
+	c.l.Printf("obtained a new oauth token for %s\n", c.Scope)
+	if err = c.store.SaveToken(ctx, t); err != nil {
+		c.l.Printf("failed to save oauth token: %s\n", err)
+	}
+	return t.AccessToken, nil
+}
+
+func (c *OAuthClient) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != nil {
+		c.rejected = c.token.AccessToken
+		c.token = nil
+	}
+}
+
+func (c *OAuthClient) valid(t db.DBOAuthToken, now time.Time) bool {
+	if t.AccessToken == c.rejected {
+		return false
+	}
+	return !t.ExpiresAt.Valid || now.Before(t.ExpiresAt.Time)
+}
+
+func (c *OAuthClient) dueForRefresh(t db.DBOAuthToken, now time.Time) bool {
+	if !c.valid(t, now) {
+		return true
+	}
+	if !t.ExpiresAt.Valid {
+		return false
+	}
+	margin := min(TOKEN_REFRESH_MARGIN, t.ExpiresAt.Time.Sub(t.ObtainedAt)/2)
+	return !now.Before(t.ExpiresAt.Time.Add(-margin))
+}
+
+func (c *OAuthClient) requestToken(ctx context.Context, now time.Time) (db.DBOAuthToken, error) {
+	form := url.Values{
+		"client_id":     {c.ClientId},
+		"client_secret": {c.ClientSecret},
+		"grant_type":    {"client_credentials"},
+		"scope":         {c.Scope},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return db.DBOAuthToken{}, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("User-Agent", os.Getenv("GGG_USERAGENT"))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return db.DBOAuthToken{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return db.DBOAuthToken{}, fmt.Errorf("token endpoint returned %s: %s", resp.Status, body)
+	}
+
+	var data tokenResponse
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return db.DBOAuthToken{}, err
+	}
+	if data.AccessToken == "" {
+		return db.DBOAuthToken{}, errors.New("token endpoint returned no access token")
+	}
+
+	t := db.DBOAuthToken{
+		ClientId:    c.ClientId,
+		Scope:       c.Scope,
+		AccessToken: data.AccessToken,
+		ObtainedAt:  now,
+	}
+	if data.ExpiresIn != nil {
+		t.ExpiresAt = pgtype.Timestamptz{Time: now.Add(time.Duration(*data.ExpiresIn) * time.Second), Valid: true}
+	}
+	return t, nil
+}
@@ -0,0 +1,190 @@
+package psapi
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	db "github.com/faideww/ffff/internal/db"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	TEST_CLIENT_ID     = "ffff-test"
+	TEST_CLIENT_SECRET = "hunter2"
+)
+
+// A client_credentials token endpoint that hands out `tokens` in turn,
+// repeating the last, or fails with `status` when it's set
+type fakeTokenEndpoint struct {
+	t        *testing.T
+	mu       sync.Mutex
+	tokens   []string
+	status   int
+	requests int
+}
+
+func (e *fakeTokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests++
+
+	if r.Method != "POST" || r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		e.t.Errorf("token requested with %s and content type %q", r.Method, r.Header.Get("Content-Type"))
+	}
+	if err := r.ParseForm(); err != nil {
+		e.t.Error(err)
+	}
+	want := map[string]string{
+		"client_id":     TEST_CLIENT_ID,
+		"client_secret": TEST_CLIENT_SECRET,
+		"grant_type":    "client_credentials",
+		"scope":         PSAPI_SCOPE,
+	}
+	for key, value := range want {
+		if got := r.PostForm.Get(key); got != value {
+			e.t.Errorf("form %s is %q, expected %q", key, got, value)
+		}
+	}
+	if len(r.PostForm) != len(want) {
+		e.t.Errorf("form has %d fields, expected %d: %v", len(r.PostForm), len(want), r.PostForm)
+	}
+
+	if e.status != 0 {
+		http.Error(w, "unavailable", e.status)
+		return
+	}
+	token := e.tokens[min(e.requests, len(e.tokens))-1]
+	json.NewEncoder(w).Encode(map[string]any{"access_token": token, "expires_in": 3600, "token_type": "bearer", "scope": PSAPI_SCOPE})
+}
+
+func (e *fakeTokenEndpoint) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.requests
+}
+
+func testOAuthClient(t *testing.T, store db.TokenStore, tokens ...string) (*OAuthClient, *fakeTokenEndpoint) {
+	endpoint := &fakeTokenEndpoint{t: t, tokens: tokens}
+	server := httptest.NewServer(endpoint)
+	t.Cleanup(server.Close)
+	return NewOAuthClient(server.URL, TEST_CLIENT_ID, TEST_CLIENT_SECRET, PSAPI_SCOPE, store, server.Client(), log.New(io.Discard, "", 0)), endpoint
+}
+
+// Saves a token obtained `age` ago that expires in `left`
+func storeToken(store db.TokenStore, token string, age time.Duration, left time.Duration) {
+	now := time.Now()
+	store.SaveToken(context.Background(), db.DBOAuthToken{
+		ClientId:    TEST_CLIENT_ID,
+		Scope:       PSAPI_SCOPE,
+		AccessToken: token,
+		ObtainedAt:  now.Add(-age),
+		ExpiresAt:   pgtype.Timestamptz{Time: now.Add(left), Valid: true},
+	})
+}
+
+func expectToken(t *testing.T, c *OAuthClient, endpoint *fakeTokenEndpoint, want string, requests int) {
+	t.Helper()
+	got, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want || endpoint.count() != requests {
+		t.Fatalf("token %q after %d requests, expected %q after %d", got, endpoint.count(), want, requests)
+	}
+}
+
+func TestOAuthCachesToken(t *testing.T) {
+	store := db.NewMemoryStore()
+	c, endpoint := testOAuthClient(t, store, "first", "second")
+	expectToken(t, c, endpoint, "first", 1)
+	expectToken(t, c, endpoint, "first", 1)
+
+	saved, err := store.LoadToken(context.Background(), TEST_CLIENT_ID, PSAPI_SCOPE)
+	if err != nil || saved.AccessToken != "first" || !saved.ExpiresAt.Valid {
+		t.Fatalf("saved %+v, %v", saved, err)
+	}
+
+	// A restart picks the saved token up rather than requesting another
+	restarted, endpoint := testOAuthClient(t, store, "second")
+	expectToken(t, restarted, endpoint, "first", 0)
+}
+
+func TestOAuthRefreshesAtMargin(t *testing.T) {
+	store := db.NewMemoryStore()
+	storeToken(store, "fresh", 40*time.Minute, TOKEN_REFRESH_MARGIN+time.Minute)
+	c, endpoint := testOAuthClient(t, store, "next")
+	expectToken(t, c, endpoint, "fresh", 0)
+
+	storeToken(store, "expiring", 50*time.Minute, TOKEN_REFRESH_MARGIN-time.Minute)
+	c, endpoint = testOAuthClient(t, store, "next")
+	expectToken(t, c, endpoint, "next", 1)
+
+	// Short-lived tokens are refreshed halfway through instead
+	storeToken(store, "short", 3*time.Minute, 2*time.Minute)
+	c, endpoint = testOAuthClient(t, store, "next")
+	expectToken(t, c, endpoint, "next", 1)
+}
+
+func TestOAuthInvalidateRegrants(t *testing.T) {
+	c, endpoint := testOAuthClient(t, db.NewMemoryStore(), "first", "second")
+	expectToken(t, c, endpoint, "first", 1)
+	c.Invalidate()
+	expectToken(t, c, endpoint, "second", 2)
+	expectToken(t, c, endpoint, "second", 2)
+
+	// An endpoint that hands the rejected token back is only asked once
+	c, endpoint = testOAuthClient(t, db.NewMemoryStore(), "same")
+	expectToken(t, c, endpoint, "same", 1)
+	c.Invalidate()
+	expectToken(t, c, endpoint, "same", 2)
+	expectToken(t, c, endpoint, "same", 2)
+}
+
+func TestOAuthFallsBackWhenRefreshFails(t *testing.T) {
+	store := db.NewMemoryStore()
+	storeToken(store, "expiring", 50*time.Minute, TOKEN_REFRESH_MARGIN-time.Minute)
+	c, endpoint := testOAuthClient(t, store)
+	endpoint.status = http.StatusServiceUnavailable
+	expectToken(t, c, endpoint, "expiring", 1)
+
+	// A rejected token isn't a fallback, however long it has left
+	c.Invalidate()
+	if token, err := c.Token(context.Background()); err == nil {
+		t.Errorf("handed out %q after it was rejected and the refresh failed", token)
+	}
+
+	storeToken(store, "expired", time.Hour, -time.Minute)
+	c, endpoint = testOAuthClient(t, store)
+	endpoint.status = http.StatusServiceUnavailable
+	if token, err := c.Token(context.Background()); err == nil {
+		t.Errorf("handed out %q after it expired and the refresh failed", token)
+	}
+}
+
+func TestOAuthRecoversAfterFailedRegrant(t *testing.T) {
+	c, endpoint := testOAuthClient(t, db.NewMemoryStore(), "first", "never sent", "second")
+	expectToken(t, c, endpoint, "first", 1)
+
+	// The endpoint is down when the token is rejected, so there's nothing to
+	// hand out until it's back
+	c.Invalidate()
+	endpoint.mu.Lock()
+	endpoint.status = http.StatusServiceUnavailable
+	endpoint.mu.Unlock()
+	if token, err := c.Token(context.Background()); err == nil {
+		t.Fatalf("handed out %q with the token endpoint down", token)
+	}
+
+	endpoint.mu.Lock()
+	endpoint.status = 0
+	endpoint.mu.Unlock()
+	expectToken(t, c, endpoint, "second", 3)
+	expectToken(t, c, endpoint, "second", 3)
+}
@@ -0,0 +1,63 @@
+package psapi
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// GGG runs a separate public stash river for each realm
+const (
+	REALM_PC   = "pc"
+	REALM_XBOX = "xbox"
+	REALM_SONY = "sony"
+)
+
+var Realms = []string{REALM_PC, REALM_XBOX, REALM_SONY}
+
+const PUBLIC_STASH_URL = "https://api.pathofexile.com/public-stash-tabs"
+
+// PC's river is served at the bare endpoint, the consoles' under their
+// realm name
+func publicStashUrl(realm string) string {
+	if realm == REALM_PC {
+		return PUBLIC_STASH_URL
+	}
+	return PUBLIC_STASH_URL + "/" + realm
+}
+
+// Parses a comma-separated list of realms, keeping the first of any repeats
+func ParseRealms(names string) ([]string, error) {
+	var realms []string
+	for _, name := range strings.Split(names, ",") {
+		realm := strings.ToLower(strings.TrimSpace(name))
+		if !slices.Contains(Realms, realm) {
+			return nil, fmt.Errorf("unknown realm %q", name)
+		}
+		if !slices.Contains(realms, realm) {
+			realms = append(realms, realm)
+		}
+	}
+	return realms, nil
+}
+
+// Each realm has its own writer. PC keeps the role read-river had before
+// realms were read, so a reader from before then still stands by for it.
+func leaderRole(realm string) string {
+	if realm == REALM_PC {
+		return "read-river"
+	}
+	return "read-river-" + realm
+}
+
+// INITIAL_CHANGE_ID_<REALM> if set; INITIAL_CHANGE_ID also applies to PC
+func initialChangeId(realm string) string {
+	if id := os.Getenv("INITIAL_CHANGE_ID_" + strings.ToUpper(realm)); id != "" {
+		return id
+	}
+	if realm == REALM_PC {
+		return os.Getenv("INITIAL_CHANGE_ID")
+	}
+	return ""
+}
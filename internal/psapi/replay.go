@@ -0,0 +1,132 @@
+package psapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	db "github.com/faideww/ffff/internal/db"
+	"github.com/faideww/ffff/internal/jsonstream"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Recorded pages are named <unix nanos>_<change id>.json, so sorting the
+// names sorts the pages into the order they were read
+var recordedPagePattern = regexp.MustCompile(`^(\d+)_(.+)\.json$`)
+
+type recordedPage struct {
+	Path     string
+	ChangeId string
+}
+
+// Saves a page read from the API under `dir` and hands back a reader over
+// the same bytes
+func recordPage(dir string, changeId string, body io.Reader, at time.Time) (io.ReadCloser, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%019d_%s.json", at.UnixNano(), changeId)
+	if err = os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func listRecordedPages(dir string) ([]recordedPage, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pages []recordedPage
+	for _, e := range entries {
+		match := recordedPagePattern.FindStringSubmatch(e.Name())
+		if e.IsDir() || match == nil {
+			continue
+		}
+		pages = append(pages, recordedPage{filepath.Join(dir, e.Name()), match[2]})
+	}
+	slices.SortFunc(pages, func(a, b recordedPage) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return pages, nil
+}
+
+// Feeds pages recorded with -record from `realm`'s river through the same
+// pipeline as the live river, as fast as they can be processed. Starts at
+// `startId` if given, otherwise resumes after the realm's last changeset in
+// the store, otherwise starts at the first page.
+func ReplayRiver(ctx context.Context, store db.Store, realm string, dir string, startId string, l *log.Logger) error {
+	pages, err := listRecordedPages(dir)
+	if err != nil {
+		return err
+	}
+
+	cursor := startId
+	if cursor == "" {
+		latest, err := store.LatestChangeset(ctx, realm)
+		if err == nil {
+			cursor = latest.NextChangeId
+		} else if !errors.Is(err, db.ErrNotFound) {
+			return err
+		}
+	}
+	if cursor != "" {
+		start := slices.IndexFunc(pages, func(p recordedPage) bool { return p.ChangeId == cursor })
+		if start < 0 {
+			l.Printf("change id %s is not in the recording; nothing to replay\n", cursor)
+			return nil
+		}
+		pages = pages[start:]
+	}
+	l.Printf("replaying %d pages from %s\n", len(pages), dir)
+
+	for _, page := range pages {
+		processStart := time.Now()
+		data, err := os.ReadFile(page.Path)
+		if err != nil {
+			return err
+		}
+
+		var nextChangeId string
+		if err = jsonstream.Extract(bytes.NewReader(data), &nextChangeId, "next_change_id"); err != nil {
+			return fmt.Errorf("%s: %w", page.Path, err)
+		}
+
+		tabs, err := FindFFJewels(io.NopCloser(bytes.NewReader(data)), l, page.ChangeId)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %w", page.Path, err)
+		}
+		if len(tabs) == 0 {
+			continue
+		}
+		if err = UpdateDb(ctx, store, realm, tabs, pgtype.Int4{}); err != nil {
+			return err
+		}
+
+		err = store.InsertChangeset(ctx, db.DBChangeset{
+			Realm:        realm,
+			ChangeId:     page.ChangeId,
+			NextChangeId: nextChangeId,
+			StashCount:   len(tabs),
+			ProcessedAt:  processStart,
+			TimeTakenMs:  time.Since(processStart).Milliseconds(),
+		})
+		if err != nil {
+			return err
+		}
+		l.Printf("replayed %s: %d stash tabs\n", page.ChangeId, len(tabs))
+	}
+
+	return nil
+}
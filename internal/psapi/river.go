@@ -11,84 +11,239 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	db "github.com/faideww/ffff/internal/db"
-	"github.com/faideww/ffff/internal/poeninja"
-	"github.com/jackc/pgx/v5"
+	"github.com/faideww/ffff/internal/metrics"
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
 type CliFlags struct {
 	StartFromHead bool
+	// Directory of recorded pages to read instead of the live API
+	Replay string
+	// Directory to record every page read from the live API into
+	Record string
+	// Address to serve /metrics on; empty disables it
+	MetricsAddr string
+	// Alert when the estimated lag behind the head exceeds this; 0 disables it
+	LagAlertMinutes float64
+	// Comma-separated head providers to try in order: poeninja, ggg
+	HeadProviders string
+	// How long each head provider gets to answer
+	HeadTimeout time.Duration
+	// Comma-separated realms to read: pc, xbox, sony
+	Realms string
 }
 
 const MAX_BACKOFFS = 6
 const MAX_RETRIES = 10
-const POENINJA_POLL_RATE = 60 // Every 60 iterations (~30s)
+const RETRY_WAIT_MS = 5 * 60 * 1000
+const MAX_REAUTHS = 3
+const HEAD_POLL_RATE = 60 // Every 60 iterations (~30s)
+const PARTITION_CHECK_INTERVAL = time.Hour
 
 func ConsumeRiver(f *CliFlags) {
 	l := log.New(os.Stdout, "", log.Ldate|log.Ltime)
 
+	realms, err := ParseRealms(f.Realms)
+	if err != nil {
+		log.Panic(err)
+	}
+
 	// Init connection to the database
-	dbHandle, err := db.DBConnect(os.Getenv("PG_DB_CONNSTR"))
+	store, err := db.OpenStore(context.Background())
 	if err != nil {
 		log.Panic(err)
 	}
-	defer dbHandle.Close()
+	defer store.Close()
+
+	if err = store.CheckSchema(context.Background()); err != nil {
+		log.Panic(err)
+	}
+	if err = store.PreparePartitions(context.Background(), time.Now()); err != nil {
+		log.Panic(err)
+	}
+
+	if f.Replay != "" || f.Record != "" {
+		// A recording holds the pages of a single river
+		if len(realms) != 1 {
+			log.Panic(errors.New("-replay and -record read one realm at a time"))
+		}
+	}
+	if f.Replay != "" {
+		leader, err := store.AcquireLeadership(context.Background(), leaderRole(realms[0]), db.WorkerId(), l)
+		if err != nil {
+			log.Panic(err)
+		}
+		defer leader.Release(context.Background())
+		if err = ReplayRiver(context.Background(), store, realms[0], f.Replay, initialChangeId(realms[0]), l); err != nil {
+			log.Panic(err)
+		}
+		return
+	}
 
 	client := &http.Client{Timeout: 30 * time.Second}
-	nextCursor := os.Getenv("INITIAL_CHANGE_ID")
+	providers, err := ParseHeadProviders(f.HeadProviders, client)
+	if err != nil {
+		log.Panic(err)
+	}
+	if f.MetricsAddr != "" {
+		metrics.Serve(f.MetricsAddr, l)
+	}
+
+	tokens, err := NewTokenSource(store, client, l)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	go func() {
+		for range time.Tick(PARTITION_CHECK_INTERVAL) {
+			if err := store.PreparePartitions(context.Background(), time.Now()); err != nil {
+				log.Panic(err)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, realm := range realms {
+		r := &realmReader{
+			realm:  realm,
+			f:      f,
+			store:  store,
+			client: client,
+			tokens: tokens,
+			l:      log.New(os.Stdout, "["+strings.ToUpper(realm)+"]", log.Ldate|log.Ltime),
+		}
+		// The head providers only know PC's river
+		if realm == REALM_PC {
+			r.heads = NewHeadChain(providers, f.HeadTimeout, r.l)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.run()
+		}()
+	}
+	wg.Wait()
+}
+
+// Reads one realm's river. GGG rate limits each realm's endpoint on its own,
+// so every reader keeps its own waits, backoffs and retries.
+type realmReader struct {
+	realm  string
+	f      *CliFlags
+	store  db.Store
+	client *http.Client
+	tokens TokenSource
+	// Nil when no provider knows the realm's head; drift goes unmeasured
+	heads *HeadChain
+	l     *log.Logger
+}
+
+// Waits to lead the realm, then reads its river until something panics
+func (r *realmReader) run() {
+	f, store, l := r.f, r.store, r.l
+
+	// Only one reader may advance the cursor at a time. Block here as a
+	// standby until we hold the lock, and only then read the cursor, since
+	// the previous leader may have written more changesets while we waited.
+	// The workers table has a row per worker id, so each realm's reader
+	// registers under its own
+	workerId := db.WorkerId()
+	if r.realm != REALM_PC {
+		workerId += "-" + r.realm
+	}
+	leader, err := store.AcquireLeadership(context.Background(), leaderRole(r.realm), workerId, l)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer leader.Release(context.Background())
+
+	nextCursor := initialChangeId(r.realm)
 	if nextCursor == "" {
 		l.Printf("No change id found in environment\n")
 		l.Printf("args: %+v\n", f)
 		if f.StartFromHead {
+			if r.heads == nil {
+				log.Panic(fmt.Errorf("no head provider for realm %s; set INITIAL_CHANGE_ID_%s instead of startFromHead", r.realm, strings.ToUpper(r.realm)))
+			}
 			l.Printf("fetching latest id from API\n")
-			nextCursor, err = poeninja.GetLatestPSChangeId(client)
+			head, err := r.heads.Latest(context.Background(), "")
 			if err != nil {
 				log.Panic(err)
 			}
+			nextCursor = head.Id.String()
 		} else {
 			l.Printf("resuming from last changeset id\n")
-			row := dbHandle.QueryRow(context.Background(), "SELECT nextChangeId FROM changesets ORDER BY processedAt DESC LIMIT 1")
-			err = row.Scan(&nextCursor)
+			latest, err := store.LatestChangeset(context.Background(), r.realm)
 			if err != nil {
-
-				if errors.Is(err, pgx.ErrNoRows) {
+				if errors.Is(err, db.ErrNotFound) {
 					l.Printf("no changesets found to resume from; exiting\n")
 				}
 				log.Panic(err)
 			}
+			nextCursor = latest.NextChangeId
 		}
 	} else if f.StartFromHead {
 		if err != nil {
 			log.Panic(errors.New("both startFromHead and INITIAL_CHANGE_ID were set, this is probably not intended. exiting"))
 		}
 	}
+	if nextCursor != "" {
+		if _, err = ParseChangeId(nextCursor); err != nil {
+			log.Panic(err)
+		}
+	}
 	l.Printf("Starting change id: %s\n", nextCursor)
 
 	nextWaitMs := 0
 	backoffs := 0
-	poeNinjaPollIndex := 0
+	headPollIndex := 0
 	retries := 0
+	// The latest drift measured, which is only refreshed every
+	// HEAD_POLL_RATE iterations. Never valid for realms without a HeadChain.
+	var lastDrift pgtype.Int4
+	headRate := &HeadRateModel{}
+	lagAlert := NewLagAlert(r.realm, f.LagAlertMinutes)
+	driftGauge := metrics.NewGauge("ffff_river_drift", "Sum of shard counters between the last page read and the river head", "realm", r.realm)
+	lagGauge := metrics.NewGauge("ffff_river_lag_minutes", "Estimated minutes between the last page read and the river head", "realm", r.realm)
+	headRateGauge := metrics.NewGauge("ffff_river_head_rate", "Shard counter increments per second at the river head", "realm", r.realm)
+	// 401s in a row; a fresh token that's rejected too won't get better
+	reauths := 0
 
 	for {
 		func() {
-			url := "https://api.pathofexile.com/public-stash-tabs"
+			if err := leader.Check(); err != nil {
+				log.Panic(err)
+			}
+
+			url := publicStashUrl(r.realm)
 			if len(nextCursor) > 0 {
 				url = url + "?id=" + nextCursor
 			}
 
 			req, err := http.NewRequest("GET", url, nil)
-			req.Header.Add("Authorization", "Bearer "+os.Getenv("GGG_OAUTH_TOKEN"))
-			req.Header.Add("User-Agent", os.Getenv("GGG_USERAGENT"))
-
 			if err != nil {
 				log.Panic(err)
 			}
+			token, err := r.tokens.Token(context.Background())
+			if err != nil {
+				// The token endpoint failing is retried like psapi failing
+				l.Printf("failed to get an access token - retrying after 5min: %s\n", err)
+				retries++
+				if retries >= MAX_RETRIES {
+					log.Panic(fmt.Errorf("max retries reached - panicing: %w", err))
+				}
+				time.Sleep(RETRY_WAIT_MS * time.Millisecond)
+				return
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+			req.Header.Add("User-Agent", os.Getenv("GGG_USERAGENT"))
 
 			l.Println("Polling psapi...")
-			resp, err := client.Do(req)
+			resp, err := r.client.Do(req)
 			reqHandleStart := time.Now()
 			if err != nil {
 				l.Printf("request errored out: %s\n", err)
@@ -116,13 +271,23 @@ func ConsumeRiver(f *CliFlags) {
 					log.Panic(retryErr)
 				}
 				nextWaitMs = retryS * 1000
+			case 401:
+				l.Printf("psapi returned 401 (Unauthorized); re-authenticating\n")
+				readOk = false
+				r.tokens.Invalidate()
+				nextWaitMs = 1000
+				reauths++
+				if reauths > MAX_REAUTHS {
+					log.Panic(errors.New("psapi keeps rejecting new tokens - panicing"))
+				}
 			case 200:
 				nextWaitMs = 0
 				retries = 0
+				reauths = 0
 			default:
 				l.Printf("psapi returned %s - retrying after 5min\n", resp.Status)
 				readOk = false
-				nextWaitMs = 5 * 60 * 1000
+				nextWaitMs = RETRY_WAIT_MS
 				retries++
 				if retries >= MAX_RETRIES {
 					log.Panic(errors.New("max retries reached - panicing"))
@@ -168,6 +333,7 @@ func ConsumeRiver(f *CliFlags) {
 				nextCursor = resp.Header.Get("x-next-change-id")
 				if nextCursor != "" {
 					l.Printf("Next stash change id: %s\n", nextCursor)
+					checkShardCount(currentCursor, nextCursor, l)
 				}
 				if nextCursor == "" && nextWaitMs == 0 {
 					// We've reached the end, pause the reader (if it hasn't been paused already
@@ -176,22 +342,29 @@ func ConsumeRiver(f *CliFlags) {
 				}
 
 				type HeadResponse struct {
-					id   string
+					head Head
 					skip bool
 					err  error
 				}
 				headCh := make(chan HeadResponse, 1)
 				go func(ch chan HeadResponse) {
-					if poeNinjaPollIndex == 0 {
-						res, ninjaErr := poeninja.GetLatestPSChangeId(client)
-						ch <- HeadResponse{res, false, ninjaErr}
+					if r.heads != nil && headPollIndex == 0 {
+						head, headErr := r.heads.Latest(context.Background(), currentCursor)
+						ch <- HeadResponse{head, false, headErr}
 					} else {
-						ch <- HeadResponse{"", true, nil}
+						ch <- HeadResponse{Head{}, true, nil}
 					}
 				}(headCh)
 
 				decodeStart := time.Now()
-				tabs, decodeErr := FindFFJewels(resp.Body, l, currentCursor)
+				var body io.ReadCloser = resp.Body
+				if f.Record != "" {
+					body, err = recordPage(f.Record, currentCursor, resp.Body, decodeStart)
+					if err != nil {
+						log.Panic(err)
+					}
+				}
+				tabs, decodeErr := FindFFJewels(body, l, currentCursor)
 				if decodeErr != nil && decodeErr != io.EOF {
 					log.Panic(decodeErr)
 				}
@@ -200,6 +373,50 @@ func ConsumeRiver(f *CliFlags) {
 				l.Printf("Response: processed %d stash tabs in %s\n", len(tabs), decodeEnd)
 				ctx := context.TODO()
 
+				// Drift is measured before the page is written, so a poll's
+				// measurement decides how its own page is written
+				headRes := <-headCh
+				if headRes.err != nil {
+					// Drift just goes unmeasured until a provider recovers
+					l.Printf("could not fetch latest change id: %s\n", headRes.err)
+					headRes.skip = true
+				}
+
+				var pgDrift pgtype.Int4
+				var shardDrift []int64
+				var pgLag pgtype.Float8
+				if !headRes.skip {
+					// Re-observing a cached head would read as the head standing still
+					if !headRes.head.Cached {
+						headRate.Observe(headRes.head.Id, headRes.head.At)
+						if rate, ok := headRate.Rate(); ok {
+							headRateGauge.Set(rate)
+						}
+					}
+
+					// calculate drift from the river head
+					drift, shards, driftErr := CalculateRiverDrift(headRes.head.Id.String(), currentCursor)
+					if driftErr != nil {
+						l.Printf("failed to calculate river drift: %s\n", driftErr)
+						lastDrift = pgtype.Int4{}
+					} else {
+						l.Printf("drift from head: %d (by shard: %v)\n", drift, shards)
+						pgDrift.Int32 = int32(drift)
+						pgDrift.Valid = true
+						shardDrift = shards
+						lastDrift = pgDrift
+						driftGauge.Set(float64(drift))
+
+						if lag, ok := headRate.LagMinutes(drift); ok {
+							l.Printf("estimated lag: %.1f minutes\n", lag)
+							pgLag.Float64 = lag
+							pgLag.Valid = true
+							lagGauge.Set(lag)
+							lagAlert.Check(lag, l)
+						}
+					}
+				}
+
 				// Slowly back off if we're at the front of the river
 				if len(tabs) == 0 && !rateLimitExceeded {
 					nextWaitMs = nextWaitMs * IntPow(2, backoffs)
@@ -210,7 +427,10 @@ func ConsumeRiver(f *CliFlags) {
 					backoffs = 0
 					dbStart := time.Now()
 					// TODO: make this a goroutine? or if it's really slow, add a message broker here
-					err = UpdateDb(ctx, dbHandle, tabs)
+					if err = leader.Check(); err != nil {
+						log.Panic(err)
+					}
+					err = UpdateDb(ctx, store, r.realm, tabs, lastDrift)
 					if err != nil {
 						log.Panic(err)
 					}
@@ -220,29 +440,9 @@ func ConsumeRiver(f *CliFlags) {
 
 				reqHandleEnd = time.Since(reqHandleStart)
 
-				headRes := <-headCh
-				if headRes.err != nil {
-					l.Printf("could not fetch latest change id: %s\n", headRes.err)
-					log.Panic(headRes.err)
-				}
-
-				var pgDrift pgtype.Int4
-				if !headRes.skip {
-
-					// calculate drift from the river head
-					drift, driftErr := CalculateRiverDrift(headRes.id, currentCursor)
-					if driftErr != nil {
-						l.Printf("failed to calculate river drift: %s\n", driftErr)
-						// log.Panic(driftErr)
-					}
-					pgDrift.Int32 = int32(drift)
-					pgDrift.Valid = true
-				} else {
-					pgDrift.Int32 = 0
-					pgDrift.Valid = false
-				}
 				if len(tabs) > 0 {
 					c := db.DBChangeset{
+						Realm:        r.realm,
 						ChangeId:     currentCursor,
 						NextChangeId: nextCursor,
 						StashCount:   len(tabs),
@@ -250,16 +450,11 @@ func ConsumeRiver(f *CliFlags) {
 						ProcessedAt:   decodeStart,
 						TimeTakenMs:   reqHandleEnd.Milliseconds(),
 						DriftFromHead: pgDrift,
+						ShardDrift:    shardDrift,
+						LagMinutes:    pgLag,
 					}
 
-					_, err = dbHandle.Exec(ctx, "INSERT INTO changesets(changeId,nextChangeId,stashCount,processedAt,timeTaken,driftFromHead) VALUES (@changeId,@nextChangeId,@stashCount,@processedAt,@timeTaken,@driftFromHead)", pgx.NamedArgs{
-						"changeId":      c.ChangeId,
-						"nextChangeId":  c.NextChangeId,
-						"stashCount":    c.StashCount,
-						"processedAt":   c.ProcessedAt,
-						"timeTaken":     c.TimeTakenMs,
-						"driftFromHead": c.DriftFromHead,
-					})
+					err = store.InsertChangeset(ctx, c)
 					if err != nil {
 						log.Panic(err)
 					}
@@ -274,7 +469,7 @@ func ConsumeRiver(f *CliFlags) {
 				l.Printf("waiting %s...\n", waitDuration)
 				time.Sleep(waitDuration)
 			}
-			poeNinjaPollIndex = (poeNinjaPollIndex + 1) % POENINJA_POLL_RATE
+			headPollIndex = (headPollIndex + 1) % HEAD_POLL_RATE
 		}()
 	}
 }
@@ -290,38 +485,32 @@ func IntPow(n, m int) int {
 	return result
 }
 
-func CalculateRiverDrift(head string, current string) (int, error) {
-	headShards := strings.Split(head, "-")
-	currentShards := strings.Split(current, "-")
-
-	if len(headShards) != len(currentShards) {
-		fmt.Printf("head: %s\n", head)
-		fmt.Printf("current: %s\n", current)
-		return 0, errors.New("change ids have different number of shards")
+// How far `current` lags the river `head`, in total and on each shard
+func CalculateRiverDrift(head string, current string) (int64, []int64, error) {
+	headId, err := ParseChangeId(head)
+	if err != nil {
+		return 0, nil, err
 	}
-
-	headInts := make([]int64, len(headShards))
-	for i, s := range headShards {
-		n, err := strconv.ParseInt(s, 10, 64)
-		if err != nil {
-			return 0, err
-		}
-		headInts[i] = n
+	currentId, err := ParseChangeId(current)
+	if err != nil {
+		return 0, nil, err
 	}
+	return currentId.Drift(headId)
+}
 
-	currentInts := make([]int64, len(currentShards))
-	for i, s := range currentShards {
-		n, err := strconv.ParseInt(s, 10, 64)
-		if err != nil {
-			return 0, err
-		}
-		currentInts[i] = n
+// Logs when GGG changes the number of shards between one change id and the
+// next, since drift can't be measured across the change
+func checkShardCount(current string, next string, l *log.Logger) {
+	currentId, err := ParseChangeId(current)
+	if err != nil {
+		return
 	}
-
-	sum := 0
-	for i := 0; i < len(headInts); i++ {
-		sum += int(headInts[i] - currentInts[i])
+	nextId, err := ParseChangeId(next)
+	if err != nil {
+		l.Printf("psapi returned an invalid next change id: %s\n", err)
+		return
+	}
+	if len(currentId.Shards) != len(nextId.Shards) {
+		l.Printf("psapi changed from %d to %d shards at %s\n", len(currentId.Shards), len(nextId.Shards), next)
 	}
-
-	return sum, nil
 }
@@ -1,6 +1,10 @@
 package psapi
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +16,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/faideww/ffff/internal/jsonstream"
 )
 
 // GGG API types
@@ -51,11 +57,12 @@ func (i *RawItemPropValue) UnmarshalJSON(data []byte) error {
 // application types
 
 type StashSnapshot struct {
-	Id         string
-	League     string
-	Items      []JewelEntry
-	ChangeId   string
-	RecordedAt time.Time
+	Id          string
+	League      string
+	AccountName string
+	Items       []JewelEntry
+	ChangeId    string
+	RecordedAt  time.Time
 }
 
 type JewelEntry struct {
@@ -75,42 +82,79 @@ type Price struct {
 	Currency string
 }
 
+// Forbidden jewels are found by name, so a stash whose JSON doesn't contain
+// either name (as a complete string) can't hold one
+var ffItemNames = [][]byte{[]byte(`"Forbidden Flame"`), []byte(`"Forbidden Flesh"`)}
+
+// The fields of a stash we still need when it holds no Forbidden jewels, so
+// its listings can be delisted
+type rawStashHeader struct {
+	Id          string `json:"id"`
+	AccountName string `json:"accountName"`
+	League      string `json:"league,omitempty"`
+}
+
+func mayHoldFFJewels(raw []byte) bool {
+	for _, name := range ffItemNames {
+		if bytes.Contains(raw, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds every priced Forbidden jewel in a page of the river. Stashes that
+// can't hold one are only decoded as far as their id, seller and league.
 func FindFFJewels(r io.ReadCloser, l *log.Logger, changeId string) ([]StashSnapshot, error) {
+	return findFFJewels(r, l, changeId, true)
+}
+
+// Like FindFFJewels, but fully decodes every stash. Used to check that the
+// byte-level filter doesn't change the result.
+func findFFJewelsUnfiltered(r io.ReadCloser, l *log.Logger, changeId string) ([]StashSnapshot, error) {
+	return findFFJewels(r, l, changeId, false)
+}
+
+func findFFJewels(r io.ReadCloser, l *log.Logger, changeId string, prefilter bool) ([]StashSnapshot, error) {
 	nodeRe := regexp.MustCompile("^Allocates (.+) if you have the matching modifier")
 	timestamp := time.Now()
 	tabsChecked := 0
 	var stashes []StashSnapshot
 	d := json.NewDecoder(r)
 
-	// consume the opening brace
-	if err := expect(d, json.Delim('{')); err != nil {
-		return stashes, err
-	}
-
-	for d.More() {
-		t, err := d.Token()
-		if err != nil {
-			return stashes, err
+	// Everything but the stashes array is skipped, so new top-level fields
+	// don't matter
+	err := jsonstream.Fields(d, func(key string) error {
+		if key != "stashes" {
+			return jsonstream.Skip(d)
 		}
 
-		if t != "stashes" {
-			if err := skip(d); err != nil {
-				return stashes, err
+		return jsonstream.Elements(d, func() error {
+			var raw json.RawMessage
+			if err := d.Decode(&raw); err != nil {
+				return err
 			}
-			continue
-		}
+			tabsChecked++
 
-		// stashes should be an array; consume the opening square bracket
-		if err := expect(d, json.Delim('[')); err != nil {
-			return stashes, err
-		}
+			if prefilter && !mayHoldFFJewels(raw) {
+				var h rawStashHeader
+				if err := json.Unmarshal(raw, &h); err != nil {
+					return err
+				}
+				stashes = append(stashes, StashSnapshot{
+					Id:          h.Id,
+					League:      h.League,
+					AccountName: SellerIdentity(h.AccountName),
+					ChangeId:    changeId,
+					RecordedAt:  timestamp,
+				})
+				return nil
+			}
 
-		for d.More() {
 			var s RawStashTab
-			if err := d.Decode(&s); err != nil {
-				return stashes, err
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return err
 			}
-			tabsChecked++
 
 			var jewels []JewelEntry
 			for _, item := range s.Items {
@@ -138,70 +182,58 @@ func FindFFJewels(r io.ReadCloser, l *log.Logger, changeId string) ([]StashSnaps
 			}
 
 			stash := StashSnapshot{
-				Id:         s.Id,
-				League:     s.League,
-				Items:      jewels,
-				ChangeId:   changeId,
-				RecordedAt: timestamp,
+				Id:          s.Id,
+				League:      s.League,
+				AccountName: SellerIdentity(s.AccountName),
+				Items:       jewels,
+				ChangeId:    changeId,
+				RecordedAt:  timestamp,
 			}
 
 			stashes = append(stashes, stash)
-		}
+			return nil
+		})
+	})
+	return stashes, err
+}
+
+// Returns the value stored for a seller. When HASH_ACCOUNT_NAMES is set, the
+// account name is replaced by a salted hash so sellers can still be told
+// apart without keeping their names around.
+func SellerIdentity(accountName string) string {
+	if accountName == "" || os.Getenv("HASH_ACCOUNT_NAMES") != "true" {
+		return accountName
 	}
-	return stashes, nil
+	sum := sha256.Sum256([]byte(os.Getenv("ACCOUNT_NAME_SALT") + accountName))
+	return hex.EncodeToString(sum[:16])
 }
 
 // Fetches the official latest change id from pathofexile.com. This doesn't
 // work (in my experience) from a cloud-based IP, so the "unofficial" latest
 // change id from poe.ninja is preferred
-func GetLatestChangeIdGGG(client *http.Client) (string, error) {
-	type ChangeIdResponse struct {
-		Psapi string `json:"psapi"`
+func GetLatestChangeIdGGG(ctx context.Context, client *http.Client) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://www.pathofexile.com/api/trade/data/change-ids", nil)
+	if err != nil {
+		return "", err
 	}
-
-	req, _ := http.NewRequest("GET", "https://www.pathofexile.com/api/trade/data/change-ids", nil)
 	req.Header.Add("User-Agent", os.Getenv("GGG_USERAGENT"))
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
-	data := ChangeIdResponse{}
-
-	json.NewDecoder(resp.Body).Decode(&data)
-	return data.Psapi, nil
-}
-
-func expect(d *json.Decoder, expectedT interface{}) error {
-	t, err := d.Token()
-	if err != nil {
-		return err
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("pathofexile.com returned %s", resp.Status)
 	}
-	if t != expectedT {
-		return fmt.Errorf("got token %v, expected token %v", t, expectedT)
-	}
-	return nil
-}
-
-func skip(d *json.Decoder) error {
-	nestLevel := 0
-	for {
-		t, err := d.Token()
-		if err != nil {
-			return err
-		}
-
-		switch t {
-		case json.Delim('['), json.Delim('{'):
-			nestLevel++
-		case json.Delim(']'), json.Delim('}'):
-			nestLevel++
-		}
 
-		if nestLevel == 0 {
-			return nil
-		}
+	var psapi string
+	if err = jsonstream.Extract(resp.Body, &psapi, "psapi"); err != nil {
+		return "", err
+	}
+	if psapi == "" {
+		return "", errors.New("pathofexile.com returned an empty change id")
 	}
+	return psapi, nil
 }
 
 func FindPrice(item *RawItem, s *RawStashTab) (Price, error) {
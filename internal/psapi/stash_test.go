@@ -0,0 +1,93 @@
+package psapi
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Pages recorded with read-river -record
+const RECORDED_PAGES_DIR = "testdata"
+
+type pageData struct {
+	recordedPage
+	data []byte
+}
+
+func loadRecordedPages(tb testing.TB) []pageData {
+	tb.Helper()
+	pages, err := listRecordedPages(RECORDED_PAGES_DIR)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(pages) == 0 {
+		tb.Fatalf("no recorded pages in %s", RECORDED_PAGES_DIR)
+	}
+	loaded := make([]pageData, len(pages))
+	for i, page := range pages {
+		data, err := os.ReadFile(page.Path)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		loaded[i] = pageData{page, data}
+	}
+	return loaded
+}
+
+func decodePage(tb testing.TB, find func(io.ReadCloser, *log.Logger, string) ([]StashSnapshot, error), page pageData) []StashSnapshot {
+	tb.Helper()
+	stashes, err := find(io.NopCloser(bytes.NewReader(page.data)), log.New(io.Discard, "", 0), page.ChangeId)
+	if err != nil && err != io.EOF {
+		tb.Fatalf("%s: %s", page.Path, err)
+	}
+	return stashes
+}
+
+func TestFindFFJewelsMatchesUnfiltered(t *testing.T) {
+	jewels := 0
+	for _, page := range loadRecordedPages(t) {
+		want := decodePage(t, findFFJewelsUnfiltered, page)
+		got := decodePage(t, FindFFJewels, page)
+		if len(got) != len(want) {
+			t.Fatalf("%s: decoded %d stash tabs, expected %d", page.Path, len(got), len(want))
+		}
+		for i := range want {
+			// Each decode stamps its own RecordedAt
+			w, g := want[i], got[i]
+			w.RecordedAt, g.RecordedAt = time.Time{}, time.Time{}
+			if !reflect.DeepEqual(w, g) {
+				t.Errorf("%s: stash tab %s decoded as %+v, expected %+v", page.Path, w.Id, g, w)
+			}
+			jewels += len(w.Items)
+		}
+	}
+	if jewels == 0 {
+		t.Errorf("no priced jewels in the recorded pages, so the filter went untested")
+	}
+}
+
+func BenchmarkFindFFJewels(b *testing.B) {
+	pages := loadRecordedPages(b)
+	var size int64
+	for _, page := range pages {
+		size += int64(len(page.data))
+	}
+
+	for _, bench := range []struct {
+		name string
+		find func(io.ReadCloser, *log.Logger, string) ([]StashSnapshot, error)
+	}{{"filtered", FindFFJewels}, {"unfiltered", findFFJewelsUnfiltered}} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				for _, page := range pages {
+					decodePage(b, bench.find, page)
+				}
+			}
+		})
+	}
+}
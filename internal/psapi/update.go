@@ -5,46 +5,34 @@ import (
 	"errors"
 	"log"
 	"os"
+	"strconv"
 
 	db "github.com/faideww/ffff/internal/db"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
-const SELECT_JEWELS_QUERY = `
-SELECT * 
-  FROM jewels 
-  WHERE stashId = any($1)
-  `
-
-const DELETE_JEWEL_QUERY = `
-DELETE 
-  FROM jewels 
-  WHERE id = $1
-  `
-
-const UPDATE_JEWEL_PRICE_QUERY = `
-UPDATE jewels 
-  SET stashId = $1, listPriceAmount = $2, listPriceCurrency = $3, lastChangeId = $4, recordedAt = $5 
-  WHERE id = $6
-  `
-
-const UPSERT_JEWEL_QUERY = `
-INSERT INTO jewels(jewelType,jewelClass,allocatedNode,itemId,stashId,league,listPriceAmount,listPriceCurrency,lastChangeId,recordedAt) 
-  VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) 
-  ON CONFLICT(itemId)
-  DO
-    UPDATE SET stashId = $5, listPriceAmount = $7, listPriceCurrency = $8, lastChangeId = $9, recordedAt = $10
-`
-
-func UpdateDb(ctx context.Context, dbHandle *pgxpool.Pool, stashes []StashSnapshot) error {
+// Pages at least this large, or read at least this far behind the river
+// head, are written through the store's bulk path when it has one. Diffing
+// in Go only pays off for the small pages seen near the head.
+const BULK_INGEST_MIN_STASHES = 1000
+const BULK_INGEST_MIN_DRIFT = 100000
+
+// Writes a page of stashes read from `realm`'s river to the store. `drift`
+// is the latest measurement of how far behind the head the reader is, and
+// is invalid when it hasn't been measured. Realms without a head provider
+// never measure it, so they switch to the bulk path on page size only.
+func UpdateDb(ctx context.Context, store db.JewelStore, realm string, stashes []StashSnapshot, drift pgtype.Int4) error {
 	l := log.New(os.Stdout, "[DB]", log.Ldate|log.Ltime)
-	tx, err := dbHandle.BeginTx(ctx, pgx.TxOptions{})
-	if err != nil {
-		l.Printf("failed to begin transaction\n")
-		return err
+
+	farBehind := drift.Valid && drift.Int32 >= BULK_INGEST_MIN_DRIFT
+	if bulk, ok := store.(db.BulkJewelStore); ok && (len(stashes) >= BULK_INGEST_MIN_STASHES || farBehind) {
+		l.Printf("catching up: writing %d stash tabs in bulk (drift %v)\n", len(stashes), driftString(drift))
+		if err := bulk.ReplaceStashContents(ctx, stashContents(realm, stashes)); err != nil {
+			l.Printf("failed to apply changes in bulk\n")
+			return err
+		}
+		return nil
 	}
-	defer tx.Rollback(ctx)
 
 	changesetStashesById := make(map[string]StashSnapshot)
 	changesetJewelsById := make(map[string]JewelEntry)
@@ -57,24 +45,29 @@ func UpdateDb(ctx context.Context, dbHandle *pgxpool.Pool, stashes []StashSnapsh
 		}
 	}
 
-	rows, _ := tx.Query(ctx, SELECT_JEWELS_QUERY, changesetStashIds)
-	// if err != nil {
-	// l.Printf("failed once\n")
-	// 	rows, err = tx.Query(ctx, SELECT_JEWELS_QUERY, changesetStashIds)
-	// if err != nil {
-	// l.Printf("failed again\n")
-	// }
-	// }
-	defer rows.Close()
-
-	checkedJewels := make(map[string]bool)
-	dbJewels, err := pgx.CollectRows(rows, pgx.RowToStructByName[db.DBJewel])
+	err := store.UpdateStashJewels(ctx, changesetStashIds, func(dbJewels []db.DBJewel) (db.JewelChanges, error) {
+		return diffStashes(realm, stashes, changesetStashesById, changesetJewelsById, dbJewels, l)
+	})
 	if err != nil {
-		l.Printf("failed to fetch entries\n")
+		l.Printf("failed to apply changes\n")
 		return err
 	}
 
-	batch := &pgx.Batch{}
+	return nil
+}
+
+func driftString(drift pgtype.Int4) string {
+	if !drift.Valid {
+		return "unknown"
+	}
+	return strconv.Itoa(int(drift.Int32))
+}
+
+// The changes that bring the listings recorded for a page's stashes in line
+// with the page
+func diffStashes(realm string, stashes []StashSnapshot, changesetStashesById map[string]StashSnapshot, changesetJewelsById map[string]JewelEntry, dbJewels []db.DBJewel, l *log.Logger) (db.JewelChanges, error) {
+	checkedJewels := make(map[string]bool)
+	var changes db.JewelChanges
 
 	for _, dbJewel := range dbJewels {
 		csJewel, jewelOk := changesetJewelsById[dbJewel.ItemId]
@@ -82,23 +75,30 @@ func UpdateDb(ctx context.Context, dbHandle *pgxpool.Pool, stashes []StashSnapsh
 		if tabOk && !jewelOk {
 			// if the tab is found but not the jewel, we can assume it has been delisted and it's safe to delete the row
 			l.Printf("Item %s has been delisted, deleting entry\n", dbJewel.ItemId)
-			batch.Queue(DELETE_JEWEL_QUERY, dbJewel.Id)
+			changes.Delisted = append(changes.Delisted, db.JewelDelisting{Id: dbJewel.Id, DelistedAt: csTab.RecordedAt})
 		}
 
 		// this should never happen, but just in case...
 		if !tabOk && !jewelOk {
-			return errors.New("somehow found a jewel with a non-indexed stash id (itemId=" + dbJewel.ItemId + ", stashId=" + dbJewel.StashId + ")")
+			return changes, errors.New("somehow found a jewel with a non-indexed stash id (itemId=" + dbJewel.ItemId + ", stashId=" + dbJewel.StashId + ")")
 		}
 
 		// check if anything needs to be updated
-		if tabOk && jewelOk && csJewel.Price.Count != dbJewel.ListPriceAmount || csJewel.Price.Currency != dbJewel.ListPriceCurrency || csTab.Id != dbJewel.StashId {
+		if tabOk && jewelOk && (csJewel.Price.Count != dbJewel.ListPriceAmount || csJewel.Price.Currency != dbJewel.ListPriceCurrency || csTab.Id != dbJewel.StashId || csTab.AccountName != dbJewel.AccountName) {
 			l.Printf("Price has changed for item %s (%f %s -> %f %s)\n", csJewel, csJewel.Price.Count, csJewel.Price.Currency, dbJewel.ListPriceAmount, dbJewel.ListPriceCurrency)
-			batch.Queue(UPDATE_JEWEL_PRICE_QUERY, csTab.Id, csJewel.Price.Count, csJewel.Price.Currency, csTab.ChangeId, csTab.RecordedAt, dbJewel.Id)
+			changes.Updated = append(changes.Updated, db.DBJewel{
+				Id:                dbJewel.Id,
+				StashId:           csTab.Id,
+				ListPriceAmount:   csJewel.Price.Count,
+				ListPriceCurrency: csJewel.Price.Currency,
+				LastChangeId:      csTab.ChangeId,
+				RecordedAt:        csTab.RecordedAt,
+				AccountName:       csTab.AccountName,
+			})
 		}
 
 		checkedJewels[dbJewel.ItemId] = true
 	}
-	rows.Close()
 
 	for _, tab := range stashes {
 		// loop through stash and insert any remaining Items
@@ -108,24 +108,47 @@ func UpdateDb(ctx context.Context, dbHandle *pgxpool.Pool, stashes []StashSnapsh
 			}
 
 			l.Printf("Adding new item %s, at price %f %s\n", item, item.Price.Count, item.Price.Currency)
-			batch.Queue(UPSERT_JEWEL_QUERY, item.Type, item.Class, item.Node, item.Id, tab.Id, tab.League, item.Price.Count, item.Price.Currency, tab.ChangeId, tab.RecordedAt)
-			// nInsert, err := res.RowsAffected()
+			changes.Upserted = append(changes.Upserted, db.DBJewel{
+				JewelType:         item.Type,
+				JewelClass:        item.Class,
+				AllocatedNode:     item.Node,
+				ItemId:            item.Id,
+				StashId:           tab.Id,
+				Realm:             realm,
+				League:            tab.League,
+				ListPriceAmount:   item.Price.Count,
+				ListPriceCurrency: item.Price.Currency,
+				LastChangeId:      tab.ChangeId,
+				RecordedAt:        tab.RecordedAt,
+				AccountName:       tab.AccountName,
+			})
 		}
 	}
 
-	// TODO: error handling for batch requests
-	results := tx.SendBatch(ctx, batch)
-	results.Close()
-	// if err != nil {
-	//   l.Printf("failed to insert\n")
-	//   return err
-	// }
+	return changes, nil
+}
 
-	err = tx.Commit(ctx)
-	if err != nil {
-		l.Printf("failed to commit transaction\n")
-		return err
+func stashContents(realm string, stashes []StashSnapshot) []db.StashContents {
+	contents := make([]db.StashContents, len(stashes))
+	for i, tab := range stashes {
+		jewels := make([]db.DBJewel, len(tab.Items))
+		for k, item := range tab.Items {
+			jewels[k] = db.DBJewel{
+				JewelType:         item.Type,
+				JewelClass:        item.Class,
+				AllocatedNode:     item.Node,
+				ItemId:            item.Id,
+				StashId:           tab.Id,
+				Realm:             realm,
+				League:            tab.League,
+				ListPriceAmount:   item.Price.Count,
+				ListPriceCurrency: item.Price.Currency,
+				LastChangeId:      tab.ChangeId,
+				RecordedAt:        tab.RecordedAt,
+				AccountName:       tab.AccountName,
+			}
+		}
+		contents[i] = db.StashContents{StashId: tab.Id, RecordedAt: tab.RecordedAt, Jewels: jewels}
 	}
-
-	return nil
+	return contents
 }
@@ -0,0 +1,181 @@
+package retention
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	db "github.com/faideww/ffff/internal/db"
+)
+
+type Policy struct {
+	// Changesets older than this are merged into hourly rollups
+	ChangesetRollupAfter time.Duration
+	// Snapshots older than these are merged into one per key per hour, and
+	// then one per key per day
+	HourlySnapshotsAfter time.Duration
+	DailySnapshotsAfter  time.Duration
+	// Delisted listings older than this are exported to ArchiveDir and then
+	// deleted
+	ArchiveHistoryAfter time.Duration
+	ArchiveDir          string
+	// Monthly partitions that ended longer ago than this are dropped outright
+	DropPartitionsAfter time.Duration
+	// Rows per statement, so no single statement holds locks for long
+	BatchSize int
+}
+
+// Applies every policy whose age is non-zero
+func Run(ctx context.Context, store db.RetentionStore, p Policy, now time.Time, l *log.Logger) error {
+	if p.ChangesetRollupAfter > 0 {
+		n, err := RollupChangesets(ctx, store, now.Add(-p.ChangesetRollupAfter), p.BatchSize)
+		if err != nil {
+			return fmt.Errorf("rolling up changesets: %w", err)
+		}
+		l.Printf("rolled %d changesets into hourly summaries\n", n)
+	}
+
+	if p.HourlySnapshotsAfter > 0 {
+		n, err := DownsampleSnapshots(ctx, store, "raw", "hourly", time.Hour, now.Add(-p.HourlySnapshotsAfter))
+		if err != nil {
+			return fmt.Errorf("downsampling snapshots to hourly: %w", err)
+		}
+		l.Printf("merged %d hours of snapshots\n", n)
+	}
+	if p.DailySnapshotsAfter > 0 {
+		n, err := DownsampleSnapshots(ctx, store, "hourly", "daily", 24*time.Hour, now.Add(-p.DailySnapshotsAfter))
+		if err != nil {
+			return fmt.Errorf("downsampling snapshots to daily: %w", err)
+		}
+		l.Printf("merged %d days of snapshots\n", n)
+	}
+
+	if p.ArchiveHistoryAfter > 0 {
+		n, err := ArchiveHistory(ctx, store, now.Add(-p.ArchiveHistoryAfter), p.ArchiveDir, p.BatchSize, l)
+		if err != nil {
+			return fmt.Errorf("archiving listing history: %w", err)
+		}
+		l.Printf("archived %d delisted listings\n", n)
+	}
+
+	if p.DropPartitionsAfter > 0 {
+		n, err := store.DropPartitionsBefore(ctx, now.Add(-p.DropPartitionsAfter), l)
+		if err != nil {
+			return fmt.Errorf("dropping old partitions: %w", err)
+		}
+		l.Printf("dropped %d partitions\n", n)
+	}
+
+	return nil
+}
+
+// Folds changesets processed before `cutoff` into changeset_rollups, at most
+// `batchSize` per transaction. Returns how many were folded.
+func RollupChangesets(ctx context.Context, store db.RetentionStore, cutoff time.Time, batchSize int) (int64, error) {
+	var total int64
+	for {
+		n, err := store.RollupChangesets(ctx, cutoff, batchSize)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < int64(batchSize) {
+			return total, nil
+		}
+	}
+}
+
+// Merges `from` snapshots generated before `cutoff` into one `to` snapshot
+// per key per `bucket`, one bucket per transaction. Only whole buckets are
+// merged. Returns how many buckets were merged.
+func DownsampleSnapshots(ctx context.Context, store db.RetentionStore, from string, to string, bucket time.Duration, cutoff time.Time) (int, error) {
+	cutoff = cutoff.Truncate(bucket)
+	merged := 0
+	for {
+		oldest, err := store.OldestSnapshot(ctx, from, cutoff)
+		if errors.Is(err, db.ErrNotFound) {
+			return merged, nil
+		} else if err != nil {
+			return merged, err
+		}
+
+		start := oldest.Truncate(bucket)
+		if err = store.MergeSnapshots(ctx, from, to, start, start.Add(bucket)); err != nil {
+			return merged, err
+		}
+		merged++
+	}
+}
+
+// Writes delisted listings older than `cutoff` to gzipped JSON-lines files
+// in `dir`, one file per batch, deleting each batch once its file is safely
+// on disk. Returns how many listings were archived.
+func ArchiveHistory(ctx context.Context, store db.RetentionStore, cutoff time.Time, dir string, batchSize int, l *log.Logger) (int, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+
+	archived := 0
+	for {
+		batch, err := store.ExpiredHistory(ctx, cutoff, batchSize)
+		if err != nil {
+			return archived, err
+		}
+		if len(batch) == 0 {
+			return archived, nil
+		}
+
+		first, last := batch[0].Id, batch[len(batch)-1].Id
+		path := filepath.Join(dir, fmt.Sprintf("jewel_history-%d-%d.jsonl.gz", first, last))
+		if err = writeArchive(path, batch); err != nil {
+			return archived, err
+		}
+
+		ids := make([]int, len(batch))
+		for i, h := range batch {
+			ids[i] = h.Id
+		}
+		if err = store.DeleteHistory(ctx, ids); err != nil {
+			return archived, err
+		}
+		l.Printf("archived %d listings to %s\n", len(batch), path)
+		archived += len(batch)
+	}
+}
+
+// Writes to a temporary file and renames it into place, so a crash never
+// leaves a truncated archive behind for rows that are then deleted
+func writeArchive(path string, rows []db.DBJewelHistory) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	gz := gzip.NewWriter(tmp)
+	enc := json.NewEncoder(gz)
+	for _, r := range rows {
+		if err = enc.Encode(r); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err = gz.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
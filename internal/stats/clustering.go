@@ -1,13 +1,11 @@
 package stats
 
 import (
-	"bufio"
-	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
 	"math"
-	"os"
 	"slices"
+
+	"github.com/faideww/ffff/internal/stats/robust"
 )
 
 type IndexCluster []int
@@ -17,21 +15,41 @@ type DendrogramStrata struct {
 	Height   float64        `json:"height"`
 }
 
-// Performs hierarchical clustering using average linkage
+type ClusterResult struct {
+	Dendrogram []DendrogramStrata
+	// Silhouette score of each stratum, whatever the criterion; NaN where
+	// undefined
+	Silhouettes []float64
+	// The criterion used to pick the cut, and its score for each stratum
+	Criterion CutCriterion
+	CutScores []float64
+	// Every stratum's clusters mapped back to data values, and the stratum
+	// chosen as the cut point
+	Strata   [][][]float64
+	CutLevel int
+}
+
+// Clusters `data` and cuts the dendrogram where `criterion` says the
+// clustering is best
+func HCluster(data []float64, criterion CutCriterion) ClusterResult {
+	dendrogram := buildDendrogram(data)
+	strata := mapStrata(dendrogram, data)
+
+	silhouettes := make([]float64, len(strata))
+	for i, clusters := range strata {
+		silhouettes[i] = computeSilhouetteScore(clusters)
+	}
+
+	cutLevel, scores := chooseCut(criterion, data, dendrogram, strata, silhouettes)
+	return ClusterResult{dendrogram, silhouettes, criterion, scores, strata, cutLevel}
+}
+
+// Performs hierarchical clustering using complete linkage
 // https://beginningwithml.wordpress.com/2019/04/17/11-3-hierarchical-clustering/
-func HCluster(data []float64) [][]float64 {
+func buildDendrogram(data []float64) []DendrogramStrata {
 	n := len(data)
 	distMtx := NewMatrix2D(n, n)
 
-	f, err := os.Create("clusters.txt")
-	if err != nil {
-		fmt.Printf("failed to create file\n")
-		log.Panic(err)
-	}
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	defer w.Flush()
-
 	for i := 0; i < n*n; i++ {
 		x := i % n
 		y := i / n
@@ -89,38 +107,14 @@ func HCluster(data []float64) [][]float64 {
 	}
 
 	// fmt.Printf("\n%+v\n", dendrogram)
-	dendrogramJson, err := json.Marshal(dendrogram)
-	if err != nil {
-		fmt.Printf("failed to marshal dendrogram to json\n")
-		log.Panic(err)
-	}
-	w.Write(dendrogramJson)
 	// fmt.Printf("Final clusters: %v\n", clusters)
 
-	// diffIdx := 0
-	// largestDiff := 0.0
-
-	// for i := 1; i < len(dendrogram); i++ {
-	// 	prev := dendrogram[i-1].Height
-	// 	curr := dendrogram[i].Height
-	// 	diff := curr - prev
-	// 	if diff > largestDiff {
-	// 		largestDiff = diff
-	// 		diffIdx = i - 1
-	// 	}
-	// }
-
-	// finalClusters := dendrogram[diffIdx].Clusters
-
-	// priceClusters := make([][]float64, len(finalClusters))
-	// for i, c := range finalClusters {
-	// 	priceClusters[i] = make([]float64, len(c))
-	// 	for j, idx := range c {
-	// 		priceClusters[i][j] = data[idx]
-	// 	}
-	// }
-
-	// Map the cluster indices back to their values in the source data
+	return dendrogram
+}
+
+// Maps the cluster indices of every stratum back to their values in the
+// source data
+func mapStrata(dendrogram []DendrogramStrata, data []float64) [][][]float64 {
 	mappedClusters := make([][][]float64, len(dendrogram))
 	for i, s := range dendrogram {
 		mappedClusters[i] = make([][]float64, len(s.Clusters))
@@ -131,11 +125,7 @@ func HCluster(data []float64) [][]float64 {
 			}
 		}
 	}
-
-	optimalCluster := analyzeClusters(mappedClusters)
-
-	// fmt.Printf("Final clusters: %v\n", dendrogram[diffIdx].Clusters)
-	return optimalCluster
+	return mappedClusters
 }
 
 func removeIndices[T any](s []T, is []int) []T {
@@ -194,35 +184,28 @@ func WardMethodLink(mat *Matrix2D, i, j, k, ni, nj, nk int) float64 {
 	return update(mat, i, j, k, alpha1, alpha2, beta, 0)
 }
 
-// Evaluates a dendrogram to find the optimal cut point that maximizes
-// cluster validity (minimize intra-cluster variance while maintaining
-// sufficient separation between clusters)
-func analyzeClusters(clusters [][][]float64) [][]float64 {
-	maxScore := math.Inf(-1)
-	bestClusterIdx := -1
-	scores := make([]float64, len(clusters))
-	for i, clusters := range clusters {
-		scores[i] = computeSilhouetteScore(clusters)
-		if scores[i] > maxScore {
-			maxScore = scores[i]
-			bestClusterIdx = i
-		}
+// Mean silhouette coefficient of a clustering (Rousseeuw, 1987). Each
+// point compares its mean distance to the rest of its own cluster (a) with
+// its mean distance to the nearest other cluster (b). Points in singleton
+// clusters score 0 by convention. The score is undefined (NaN) with fewer
+// than two clusters, or when every point is its own cluster, since the
+// singleton convention would otherwise make the trivial split score 0 and
+// beat any real clustering with some overlap.
+func computeSilhouetteScore(clusters [][]float64) float64 {
+	n := 0
+	for _, c := range clusters {
+		n += len(c)
+	}
+	if len(clusters) < 2 || len(clusters) >= n {
+		return math.NaN()
 	}
 
-	return clusters[bestClusterIdx]
-}
-
-func computeSilhouetteScore(clusters [][]float64) float64 {
-	var coefficients []float64
-	// fmt.Printf("analyzing cluster group: %v\n", clusters)
+	total := 0.0
 	for i, c := range clusters {
-		// scoresByCluster[i] = make([]float64, len(c))
+		if len(c) == 1 {
+			continue
+		}
 		for j, point := range c {
-			if len(c) == 1 {
-				coefficients = append(coefficients, 0.0)
-				continue
-			}
-
 			avgDist := 0.0
 			for n_j, neighbor := range c {
 				if j == n_j {
@@ -230,7 +213,7 @@ func computeSilhouetteScore(clusters [][]float64) float64 {
 				}
 				avgDist += math.Abs(neighbor - point)
 			}
-			avgDist /= float64(len(c)) - 1.0
+			avgDist /= float64(len(c) - 1)
 
 			minClusterDist := math.Inf(1)
 			for n_i, neighborCluster := range clusters {
@@ -242,52 +225,291 @@ func computeSilhouetteScore(clusters [][]float64) float64 {
 				for _, neighbor := range neighborCluster {
 					neighborDist += math.Abs(neighbor - point)
 				}
-				neighborDist /= float64(len(c))
-				if minClusterDist > neighborDist {
-					minClusterDist = neighborDist
-				}
+				neighborDist /= float64(len(neighborCluster))
+				minClusterDist = math.Min(minClusterDist, neighborDist)
 			}
 
-			silhouetteScore := (minClusterDist - avgDist) / math.Max(minClusterDist, avgDist)
-			coefficients = append(coefficients, silhouetteScore)
+			// Duplicate prices split across clusters are as ambiguous as
+			// a point can be
+			if denom := math.Max(minClusterDist, avgDist); denom > 0 {
+				total += (minClusterDist - avgDist) / denom
+			}
 		}
 	}
 
-	meanScore := 0.0
-	for _, coef := range coefficients {
-		meanScore += coef
+	return total / float64(n)
+}
+
+// Number of points the density is evaluated at
+const KDE_GRID_SIZE = 512
+
+// A density mode must stand out from its surroundings by at least this
+// fraction of the tallest mode to count as significant
+const KDE_MIN_PROMINENCE = 0.1
+
+// ...and its basin must contain at least this many listings
+const KDE_MIN_MODE_LISTINGS = 3
+
+// Mode prominence (relative to its height) at which confidence saturates
+const KDE_HIGH_CONF_PROMINENCE = 0.5
+
+// Confidence ceiling for the median fallback used when no mode is
+// significant
+const KDE_FALLBACK_CONFIDENCE = 0.2
+
+type KDEBandwidth string
+
+const (
+	BANDWIDTH_SILVERMAN      KDEBandwidth = "silverman"
+	BANDWIDTH_SHEATHER_JONES KDEBandwidth = "sj"
+)
+
+type densityMode struct {
+	X          float64
+	Height     float64
+	Prominence float64
+	// Grid indices of the nearest valleys either side of the mode, which
+	// bound the listings that belong to it
+	Left, Right int
+}
+
+// Estimates the window price as the lowest significant mode of a kernel
+// density estimate over log prices. Working in log space makes a 10c
+// spread at 50c and a 100c spread at 500c look alike, which matches how
+// listings actually scatter. The lowest significant mode is where the bulk
+// of sellers who actually want to sell are priced; higher modes are
+// optimists, and low blips are baits or mistakes. When no mode is
+// significant (too few listings, or all of them scattered) it falls back to
+// the median of every listing with low confidence.
+func calculateWindowPriceKDE(prices []int, weights []float64, d *KeyDiagnostics) (float64, float64, []float64, error) {
+	if len(prices) == 0 {
+		return 0, 0, nil, errors.New("no prices")
+	}
+
+	logPrices := make([]float64, len(prices))
+	for i, p := range prices {
+		logPrices[i] = math.Log(math.Max(float64(p), 1))
 	}
-	meanScore /= float64(len(coefficients))
 
-	return meanScore
+	h := kdeBandwidth(logPrices, BANDWIDTH_SHEATHER_JONES)
+	if h <= 0 {
+		// Every listing is at the same price
+		d.Inliers = toFloats(prices)
+		return float64(prices[0]), math.Min(float64(len(prices))/KDE_MIN_MODE_LISTINGS, 1.0), toFloats(prices), nil
+	}
+
+	lo := logPrices[0] - 3*h
+	hi := logPrices[len(logPrices)-1] + 3*h
+	grid := make([]float64, KDE_GRID_SIZE)
+	density := make([]float64, KDE_GRID_SIZE)
+	for i := range grid {
+		grid[i] = lerp(lo, hi, float64(i)/float64(KDE_GRID_SIZE-1))
+		density[i] = kernelDensityEstimator(grid[i], h, logPrices, weights, gaussianKernel)
+	}
+
+	modes := findDensityModes(density, grid)
+	maxHeight := 0.0
+	for _, m := range modes {
+		maxHeight = math.Max(maxHeight, m.Height)
+	}
+
+	d.Logf("bandwidth (log): %.4f", h)
+
+	for _, m := range modes {
+		var basin []float64
+		for i, lp := range logPrices {
+			if lp >= grid[m.Left] && lp <= grid[m.Right] {
+				basin = append(basin, float64(prices[i]))
+			}
+		}
+		d.Logf("mode at %.1f: height %.4f, prominence %.4f, %d listings", math.Exp(m.X), m.Height, m.Prominence, len(basin))
+
+		minListings := min(KDE_MIN_MODE_LISTINGS, len(prices))
+		if m.Prominence < KDE_MIN_PROMINENCE*maxHeight || len(basin) < minListings {
+			continue
+		}
+
+		relProminence := m.Prominence / m.Height
+		confidence := math.Min(relProminence/KDE_HIGH_CONF_PROMINENCE, 1.0) * math.Min(float64(len(basin))/10.0, 1.0)
+		d.Inliers = basin
+		return math.Exp(m.X), confidence, basin, nil
+	}
+
+	d.Logf("found no significant density modes, falling back to the median")
+	d.Inliers = toFloats(prices)
+	confidence := KDE_FALLBACK_CONFIDENCE * math.Min(float64(len(prices))/10.0, 1.0)
+	return robust.WeightedQuantile(d.Inliers, weights, 0.5), confidence, d.Inliers, nil
+}
+
+// Local maxima of the density, lowest price first, with their topographic
+// prominence: how far the density has to drop before reaching a taller
+// mode (or the edge of the grid)
+func findDensityModes(density []float64, grid []float64) []densityMode {
+	var modes []densityMode
+	n := len(density)
+	for i := 1; i < n-1; i++ {
+		if density[i] <= density[i-1] || density[i] < density[i+1] {
+			continue
+		}
+
+		// The mode's basin runs downhill to the nearest valley each side.
+		// The prominence walk below can run far past those, over smaller
+		// modes, so it doesn't bound the basin.
+		left := i
+		for left > 0 && density[left-1] <= density[left] {
+			left--
+		}
+		right := i
+		for right < n-1 && density[right+1] <= density[right] {
+			right++
+		}
+
+		// Walk outwards until we hit taller ground, tracking the lowest valley
+		leftMin := density[i]
+		for j := i - 1; j >= 0 && density[j] <= density[i]; j-- {
+			leftMin = math.Min(leftMin, density[j])
+		}
+		rightMin := density[i]
+		for j := i + 1; j < n && density[j] <= density[i]; j++ {
+			rightMin = math.Min(rightMin, density[j])
+		}
+
+		modes = append(modes, densityMode{
+			X:          grid[i],
+			Height:     density[i],
+			Prominence: density[i] - math.Max(leftMin, rightMin),
+			Left:       left,
+			Right:      right,
+		})
+	}
+	return modes
+}
+
+func lerp(start, end, t float64) float64 {
+	return start + ((end - start) * t)
+}
+
+// `weights` may be nil, in which case every point counts equally
+func kernelDensityEstimator(x, h float64, data []float64, weights []float64, kernel func(x float64) float64) float64 {
+	kernelSum := 0.0
+	total := 0.0
+	for i, xi := range data {
+		weight := 1.0
+		if weights != nil {
+			weight = weights[i]
+		}
+		kernelSum += weight * kernel((x-xi)/h)
+		total += weight
+	}
+
+	return 1 / (total * h) * kernelSum
+}
+
+func gaussianKernel(x float64) float64 {
+	return (1 / (math.Sqrt(2 * math.Pi))) * math.Exp(-(x*x)/2)
+}
+
+// `data` must be sorted
+func kdeBandwidth(data []float64, method KDEBandwidth) float64 {
+	silverman := silvermanBandwidth(data)
+	if method == BANDWIDTH_SHEATHER_JONES && silverman > 0 {
+		if h, ok := sheatherJonesBandwidth(data, silverman); ok {
+			return h
+		}
+	}
+	return silverman
+}
+
+// Silverman's rule of thumb, using the more robust of the standard
+// deviation and IQR as the scale estimate
+func silvermanBandwidth(data []float64) float64 {
+	n := float64(len(data))
+	scale := robust.StdDev(data)
+	iqr := (robust.Quantile(data, 0.75) - robust.Quantile(data, 0.25)) / 1.34
+	if iqr > 0 && iqr < scale {
+		scale = iqr
+	}
+	if n < 2 || scale <= 0 || math.IsNaN(scale) {
+		return 0
+	}
+	return 0.9 * scale * math.Pow(n, -0.2)
+}
+
+// Sheather-Jones "solve-the-equation" plug-in bandwidth for a Gaussian
+// kernel (Sheather & Jones 1991; as in R's bw.SJ(method = "ste")). Returns
+// false if no root is found near the Silverman bandwidth.
+func sheatherJonesBandwidth(data []float64, silverman float64) (float64, bool) {
+	n := float64(len(data))
+	scale := (robust.Quantile(data, 0.75) - robust.Quantile(data, 0.25)) / 1.349
+	if sd := robust.StdDev(data); scale <= 0 || sd < scale {
+		scale = sd
+	}
+	if scale <= 0 {
+		return 0, false
+	}
+
+	// Pilot estimates of the integrated squared 2nd and 3rd density
+	// derivatives
+	a := 0.920 * scale * math.Pow(n, -1.0/7)
+	b := 0.912 * scale * math.Pow(n, -1.0/9)
+	sdA := densityFunctional(data, a, 4)
+	tdB := -densityFunctional(data, b, 6)
+	if sdA <= 0 || tdB <= 0 {
+		return 0, false
+	}
+	alpha2 := 1.357 * math.Pow(sdA/tdB, 1.0/7)
+
+	const rK = 0.28209479177387814 // 1 / (2 * sqrt(pi))
+	equation := func(h float64) float64 {
+		sd := densityFunctional(data, alpha2*math.Pow(h, 5.0/7), 4)
+		if sd <= 0 {
+			return math.Inf(-1)
+		}
+		return math.Pow(rK/(n*sd), 0.2) - h
+	}
+
+	lower, upper := 0.1*silverman, 4*silverman
+	fLower, fUpper := equation(lower), equation(upper)
+	if math.IsInf(fLower, 0) || math.IsInf(fUpper, 0) || fLower*fUpper > 0 {
+		return 0, false
+	}
+	for i := 0; i < 60; i++ {
+		mid := (lower + upper) / 2
+		fMid := equation(mid)
+		if fMid*fLower > 0 {
+			lower, fLower = mid, fMid
+		} else {
+			upper = mid
+		}
+	}
+	return (lower + upper) / 2, true
 }
 
-// func clusterKDE(data []float64) {
-//   h := 3.0
-//   fn := func (x float64) float64 {
-//     return kernelDensityEstimator(x, h, data, gaussianKernel)
-//   }
-
-//   nSamples := 50
-//   samples := make([]float64, nSamples)
-//   for i := range samples {
-//     t := float64(i) / float64(nSamples)
-//   }
-// }
-// func lerp(start, end, t float64) float64 {
-//   return start + ((end - start) * t)
-// }
-
-// func kernelDensityEstimator(x, h float64, data []float64, kernel func(x float64) float64) float64 {
-// 	kernelSum := 0.0
-// 	for _, xi := range data {
-// 		kernelSum += kernel((x - xi) / h)
-// 	}
-
-// 	n := float64(len(data))
-// 	return 1 / (n * h) * kernelSum
-// }
-
-// func gaussianKernel(x float64) float64 {
-// 	return (1 / (math.Sqrt(2 * math.Pi))) * math.Exp(-(x*x)/2)
-// }
+// Estimates the integral of f^(r) * f by summing the r'th derivative of the
+// Gaussian kernel over all pairs: (1 / (n^2 h^(r+1))) * sum phi^(r)((xi-xj)/h).
+// Only r = 4 and r = 6 are needed.
+func densityFunctional(data []float64, h float64, r int) float64 {
+	n := float64(len(data))
+	derivative := phi4
+	if r == 6 {
+		derivative = phi6
+	}
+
+	sum := 0.0
+	for i := range data {
+		for j := range data {
+			sum += derivative((data[i] - data[j]) / h)
+		}
+	}
+	return sum / (n * n * math.Pow(h, float64(r+1)))
+}
+
+func phi4(u float64) float64 {
+	u2 := u * u
+	return (u2*u2 - 6*u2 + 3) * gaussianKernel(u)
+}
+
+func phi6(u float64) float64 {
+	u2 := u * u
+	return (u2*u2*u2 - 15*u2*u2 + 45*u2 - 15) * gaussianKernel(u)
+}
@@ -0,0 +1,87 @@
+package stats
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+var kdeCases = []struct {
+	name    string
+	prices  []int
+	inliers []float64
+	// The window price must land in [low, high]
+	low, high float64
+	// Whether the price came from the median fallback, so its confidence
+	// must stay at or under KDE_FALLBACK_CONFIDENCE
+	fallback bool
+}{
+	{
+		name:    "bimodal",
+		prices:  []int{50, 52, 55, 55, 58, 60, 300, 310, 320, 320, 330},
+		inliers: []float64{50, 52, 55, 55, 58, 60},
+		low:     52, high: 58,
+	},
+	{
+		name:    "bait under the bulk",
+		prices:  []int{1, 55, 58, 60, 60, 62, 65},
+		inliers: []float64{55, 58, 60, 60, 62, 65},
+		low:     58, high: 62,
+	},
+	{
+		name:    "single price",
+		prices:  []int{7, 7, 7},
+		inliers: []float64{7, 7, 7},
+		low:     7, high: 7,
+	},
+	{
+		// Neither listing backs the other up, so neither price wins
+		name:    "two points",
+		prices:  []int{1, 1000},
+		inliers: []float64{1, 1000},
+		low:     500.5, high: 500.5,
+		fallback: true,
+	},
+	{
+		name:    "sparse pairs",
+		prices:  []int{5, 5, 500, 500},
+		inliers: []float64{5, 5, 500, 500},
+		low:     252.5, high: 252.5,
+		fallback: true,
+	},
+	{
+		name:    "scattered",
+		prices:  []int{10, 200, 900},
+		inliers: []float64{10, 200, 900},
+		low:     200, high: 200,
+		fallback: true,
+	},
+}
+
+func TestWindowPriceKDE(t *testing.T) {
+	for _, c := range kdeCases {
+		t.Run(c.name, func(t *testing.T) {
+			var d KeyDiagnostics
+			price, confidence, inliers, err := calculateWindowPriceKDE(c.prices, nil, &d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if price < c.low || price > c.high {
+				t.Errorf("priced at %.2f, expected [%v, %v]", price, c.low, c.high)
+			}
+			if !slices.Equal(inliers, c.inliers) || !slices.Equal(d.Inliers, c.inliers) {
+				t.Errorf("inliers %v (diagnostics %v), expected %v", inliers, d.Inliers, c.inliers)
+			}
+			if confidence <= 0 || confidence > 1 || math.IsNaN(confidence) {
+				t.Errorf("confidence %v out of range", confidence)
+			}
+			if c.fallback && confidence > KDE_FALLBACK_CONFIDENCE {
+				t.Errorf("confidence %v for the median fallback", confidence)
+			}
+		})
+	}
+
+	if _, _, _, err := calculateWindowPriceKDE(nil, nil, &KeyDiagnostics{}); err == nil {
+		t.Errorf("priced a key with no listings")
+	}
+}
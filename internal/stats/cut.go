@@ -0,0 +1,232 @@
+package stats
+
+import (
+	"math"
+	"math/rand"
+	"os"
+)
+
+// How to decide where to cut the dendrogram
+type CutCriterion string
+
+const (
+	// Highest mean silhouette coefficient
+	CUT_SILHOUETTE CutCriterion = "silhouette"
+	// Smallest k within one standard error of the next gap (Tibshirani et al.)
+	CUT_GAP CutCriterion = "gap"
+	// Highest ratio of between- to within-cluster variance
+	CUT_CALINSKI_HARABASZ CutCriterion = "ch"
+	// Just below the largest jump in merge height
+	CUT_HEIGHT_JUMP CutCriterion = "jump"
+)
+
+// Number of uniform reference datasets the gap statistic is averaged over
+const GAP_REFERENCE_SAMPLES = 10
+
+// The gap statistic is only evaluated for up to this many clusters; a price
+// distribution with more modes than this isn't worth splitting finely
+const GAP_MAX_CLUSTERS = 10
+
+// Fixed so the same prices always produce the same cut
+const GAP_SEED = 1
+
+// Calinski-Harabasz keeps rising as near-singleton clusters split off a
+// small sample, so it's only evaluated up to this many clusters: enough for
+// baits, the bulk and optimists
+const CH_MAX_CLUSTERS = 3
+
+// Below this mean silhouette the structure is "weak and could be
+// artificial" (Kaufman & Rousseeuw, 1990), so the prices are left whole
+const SILHOUETTE_MIN_STRUCTURE = 0.5
+
+// With complete linkage a merge height is the diameter of the merged
+// cluster. Unless the merge after the largest jump at least doubles the
+// height, the gap between the groups is narrower than the groups themselves
+// and they are left joined.
+const HEIGHT_JUMP_MIN_RATIO = 2.0
+
+// Selected with CLUSTER_CUT_CRITERION; defaults to silhouette
+func cutCriterion() CutCriterion {
+	switch c := CutCriterion(os.Getenv("CLUSTER_CUT_CRITERION")); c {
+	case CUT_GAP, CUT_CALINSKI_HARABASZ, CUT_HEIGHT_JUMP:
+		return c
+	default:
+		return CUT_SILHOUETTE
+	}
+}
+
+// Scores every stratum of the dendrogram under `criterion` and returns the
+// stratum to cut at along with the scores (NaN where a stratum can't be
+// scored). Falls back to the root - everything in one cluster - if no
+// stratum can be scored at all, or if the best split is too weak to trust.
+func chooseCut(criterion CutCriterion, data []float64, dendrogram []DendrogramStrata, strata [][][]float64, silhouettes []float64) (int, []float64) {
+	var scores []float64
+	switch criterion {
+	case CUT_GAP:
+		return gapCut(data, strata)
+	case CUT_CALINSKI_HARABASZ:
+		scores = make([]float64, len(strata))
+		for i, clusters := range strata {
+			scores[i] = calinskiHarabasz(clusters)
+		}
+	case CUT_HEIGHT_JUMP:
+		scores = heightJumps(dendrogram)
+	default:
+		scores = silhouettes
+	}
+
+	// Strata run from finest to coarsest; walk them coarsest first so ties
+	// go to the fewest clusters
+	best := len(strata) - 1
+	bestScore := math.Inf(-1)
+	for i := len(scores) - 1; i >= 0; i-- {
+		if !math.IsNaN(scores[i]) && scores[i] > bestScore {
+			best, bestScore = i, scores[i]
+		}
+	}
+
+	root := len(strata) - 1
+	switch criterion {
+	case CUT_HEIGHT_JUMP:
+		if best < root && dendrogram[best+1].Height < HEIGHT_JUMP_MIN_RATIO*dendrogram[best].Height {
+			return root, scores
+		}
+	case CUT_SILHOUETTE:
+		if bestScore < SILHOUETTE_MIN_STRUCTURE {
+			return root, scores
+		}
+	}
+	return best, scores
+}
+
+// Sum of squared distances from each point to its cluster's mean
+func withinClusterSS(clusters [][]float64) float64 {
+	w := 0.0
+	for _, c := range clusters {
+		mean := 0.0
+		for _, v := range c {
+			mean += v
+		}
+		mean /= float64(len(c))
+		for _, v := range c {
+			w += (v - mean) * (v - mean)
+		}
+	}
+	return w
+}
+
+// Calinski-Harabasz index: (B / (k-1)) / (W / (n-k)). Undefined for a
+// single cluster, or for more than CH_MAX_CLUSTERS clusters or half the
+// points, where splitting off stragglers makes any split look good.
+func calinskiHarabasz(clusters [][]float64) float64 {
+	k := len(clusters)
+	n := 0
+	total := 0.0
+	for _, c := range clusters {
+		n += len(c)
+		for _, v := range c {
+			total += v
+		}
+	}
+	if k < 2 || k > CH_MAX_CLUSTERS || k > n/2 {
+		return math.NaN()
+	}
+	grandMean := total / float64(n)
+
+	between := 0.0
+	for _, c := range clusters {
+		mean := 0.0
+		for _, v := range c {
+			mean += v
+		}
+		mean /= float64(len(c))
+		between += float64(len(c)) * (mean - grandMean) * (mean - grandMean)
+	}
+
+	within := withinClusterSS(clusters)
+	if within == 0 {
+		// Only happens when every cluster is one repeated price, which
+		// repeated listings make common among the finest strata
+		return math.NaN()
+	}
+	return (between / float64(k-1)) / (within / float64(n-k))
+}
+
+// Height gained by the merge right after each stratum; cutting at the
+// stratum before the largest jump keeps apart the groups that were
+// hardest to join. The root has no merge after it.
+func heightJumps(dendrogram []DendrogramStrata) []float64 {
+	jumps := make([]float64, len(dendrogram))
+	for i := range dendrogram {
+		if i+1 < len(dendrogram) {
+			jumps[i] = dendrogram[i+1].Height - dendrogram[i].Height
+		} else {
+			jumps[i] = math.NaN()
+		}
+	}
+	return jumps
+}
+
+// Gap statistic (Tibshirani, Walther & Hastie, 2001). Compares log W_k for
+// the data against its expectation under uniform reference data over the
+// same range, and picks the smallest k with Gap(k) >= Gap(k+1) - s(k+1).
+// Stratum i of a dendrogram over n points has n-i clusters.
+func gapCut(data []float64, strata [][][]float64) (int, []float64) {
+	n := len(data)
+	scores := make([]float64, len(strata))
+	for i := range scores {
+		scores[i] = math.NaN()
+	}
+	maxK := min(GAP_MAX_CLUSTERS, n-1)
+	if maxK < 1 {
+		return len(strata) - 1, scores
+	}
+
+	lo, hi := data[0], data[0]
+	for _, v := range data {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+
+	// W_k is 0 whenever every cluster holds a single repeated price, so
+	// offset it to keep the logs finite
+	const epsilon = 1e-9
+
+	rng := rand.New(rand.NewSource(GAP_SEED))
+	refLogW := make([][]float64, maxK+1)
+	reference := make([]float64, n)
+	for b := 0; b < GAP_REFERENCE_SAMPLES; b++ {
+		for i := range reference {
+			reference[i] = lo + rng.Float64()*(hi-lo)
+		}
+		refStrata := mapStrata(buildDendrogram(reference), reference)
+		for k := 1; k <= maxK; k++ {
+			refLogW[k] = append(refLogW[k], math.Log(withinClusterSS(refStrata[n-k])+epsilon))
+		}
+	}
+
+	gaps := make([]float64, maxK+1)
+	stdErrs := make([]float64, maxK+1)
+	for k := 1; k <= maxK; k++ {
+		mean := 0.0
+		for _, v := range refLogW[k] {
+			mean += v
+		}
+		mean /= float64(len(refLogW[k]))
+		variance := 0.0
+		for _, v := range refLogW[k] {
+			variance += (v - mean) * (v - mean)
+		}
+		variance /= float64(len(refLogW[k]))
+
+		gaps[k] = mean - math.Log(withinClusterSS(strata[n-k])+epsilon)
+		stdErrs[k] = math.Sqrt(variance) * math.Sqrt(1+1/float64(GAP_REFERENCE_SAMPLES))
+		scores[n-k] = gaps[k]
+	}
+
+	for k := 1; k < maxK; k++ {
+		if gaps[k] >= gaps[k+1]-stdErrs[k+1] {
+			return n - k, scores
+		}
+	}
+	return n - maxK, scores
+}
@@ -0,0 +1,137 @@
+package stats
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"testing"
+)
+
+// Listing prices in the shapes keys commonly take, with the cluster sizes
+// (cheapest cluster first) each criterion should cut them into, worked out
+// by eye rather than taken from the output. A criterion is left out where
+// it can't give the answer by construction.
+var cutFixtures = []struct {
+	name     string
+	prices   []float64
+	expected map[CutCriterion][]int
+}{
+	{
+		name:   "two tiers",
+		prices: []float64{40, 42, 45, 45, 48, 50, 50, 52, 180, 190, 200, 200, 210},
+		expected: map[CutCriterion][]int{
+			CUT_SILHOUETTE:        {8, 5},
+			CUT_GAP:               {8, 5},
+			CUT_CALINSKI_HARABASZ: {8, 5},
+			CUT_HEIGHT_JUMP:       {8, 5},
+		},
+	},
+	{
+		// Calinski-Harabasz prefers splitting the bulk at 60/62 to a
+		// cluster of two baits, since the baits barely reduce W
+		name:   "baits under the bulk",
+		prices: []float64{1, 1, 55, 58, 60, 60, 60, 62, 65, 70},
+		expected: map[CutCriterion][]int{
+			CUT_SILHOUETTE:  {2, 8},
+			CUT_GAP:         {2, 8},
+			CUT_HEIGHT_JUMP: {2, 8},
+		},
+	},
+	{
+		// The widest single jump in merge height (64 to 342) only separates
+		// the top tier. W is measured in chaos, so the gap statistic keeps
+		// splitting the widest tier and can't find three.
+		name:   "three tiers",
+		prices: []float64{8, 9, 10, 10, 12, 60, 65, 65, 70, 72, 300, 320, 350},
+		expected: map[CutCriterion][]int{
+			CUT_SILHOUETTE:        {5, 5, 3},
+			CUT_CALINSKI_HARABASZ: {5, 5, 3},
+			CUT_HEIGHT_JUMP:       {10, 3},
+		},
+	},
+	{
+		// Calinski-Harabasz can't score a single cluster
+		name:   "single tier",
+		prices: []float64{95, 98, 100, 100, 100, 102, 105, 110},
+		expected: map[CutCriterion][]int{
+			CUT_SILHOUETTE:  {8},
+			CUT_GAP:         {8},
+			CUT_HEIGHT_JUMP: {8},
+		},
+	},
+	{
+		// Only the 400 listing is clearly apart; where the rest of the tail
+		// belongs is a matter of taste, so the criteria that split it
+		// further are left out
+		name:   "optimist tail",
+		prices: []float64{20, 21, 22, 22, 23, 25, 25, 26, 28, 30, 45, 60, 90, 150, 400},
+		expected: map[CutCriterion][]int{
+			CUT_SILHOUETTE:  {14, 1},
+			CUT_HEIGHT_JUMP: {14, 1},
+		},
+	},
+}
+
+func clusterSizes(clusters [][]float64) []int {
+	sorted := slices.Clone(clusters)
+	slices.SortFunc(sorted, func(a, b []float64) int {
+		return cmp.Compare(slices.Min(a), slices.Min(b))
+	})
+	sizes := make([]int, len(sorted))
+	for i, c := range sorted {
+		sizes[i] = len(c)
+	}
+	return sizes
+}
+
+func TestCutCriteria(t *testing.T) {
+	for _, f := range cutFixtures {
+		for criterion, expected := range f.expected {
+			t.Run(f.name+"/"+string(criterion), func(t *testing.T) {
+				t.Setenv("CLUSTER_CUT_CRITERION", string(criterion))
+				result := HCluster(f.prices, cutCriterion())
+				if result.Criterion != criterion {
+					t.Fatalf("cut with %q, want %q", result.Criterion, criterion)
+				}
+				if want := len(f.prices) - len(expected); result.CutLevel != want {
+					t.Errorf("cut at level %d, want %d", result.CutLevel, want)
+				}
+				if got := clusterSizes(result.Strata[result.CutLevel]); !slices.Equal(got, expected) {
+					t.Errorf("cluster sizes %v, want %v", got, expected)
+				}
+			})
+		}
+	}
+}
+
+func TestCutCriterionDefault(t *testing.T) {
+	for _, name := range []string{"", "kmeans"} {
+		t.Setenv("CLUSTER_CUT_CRITERION", name)
+		if c := cutCriterion(); c != CUT_SILHOUETTE {
+			t.Errorf("CLUSTER_CUT_CRITERION=%q selected %q, want silhouette", name, c)
+		}
+	}
+}
+
+func TestSilhouetteScore(t *testing.T) {
+	// Each point's b is its mean distance to the *other* cluster, averaged
+	// over that cluster's size: for 0, (10+12+14)/3
+	twoClusters := [][]float64{{0, 2}, {10, 12, 14}}
+	want := (10.0/12 + 8.0/10 + 6.0/9 + 9.0/11 + 10.0/13) / 5
+	if got := computeSilhouetteScore(twoClusters); math.Abs(got-want) > 1e-12 {
+		t.Errorf("silhouette %v, want %v", got, want)
+	}
+
+	// Singletons score 0 but still count towards the mean
+	withSingleton := [][]float64{{0}, {10, 12}}
+	want = (8.0/10 + 10.0/12) / 3
+	if got := computeSilhouetteScore(withSingleton); math.Abs(got-want) > 1e-12 {
+		t.Errorf("silhouette with a singleton %v, want %v", got, want)
+	}
+
+	for _, clusters := range [][][]float64{{{1, 2, 3}}, {{1}, {2}, {3}}} {
+		if got := computeSilhouetteScore(clusters); !math.IsNaN(got) {
+			t.Errorf("silhouette of %v is %v, want NaN", clusters, got)
+		}
+	}
+}
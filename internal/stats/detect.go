@@ -0,0 +1,151 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	db "github.com/faideww/ffff/internal/db"
+)
+
+// How far back to look at a seller's delisted listings and prior flags
+const SELLER_HISTORY_LOOKBACK = 7 * 24 * time.Hour
+
+// A delisted listing that lived less than this is considered to have
+// "vanished quickly"
+const BAIT_MAX_LIFETIME = time.Hour
+
+// Listings below this fraction of the window price are candidate bait
+const BAIT_PRICE_RATIO = 0.3
+
+// Listings above this multiple of the window price are candidate price-fixing
+const PRICE_FIX_RATIO = 10.0
+
+// Number of price changes after which a listing counts as repeatedly relisted
+const RELIST_THRESHOLD = 3
+
+// Number of quickly-vanishing cheap listings before a seller counts as a
+// repeat baiter
+const QUICK_BAIT_THRESHOLD = 2
+
+type SellerHistory struct {
+	// Delisted listings far below the window price that were up for less
+	// than BAIT_MAX_LIFETIME
+	QuickBaits int
+	// Distinct listings flagged in earlier snapshot sets
+	PriorFlags int
+}
+
+type FlaggedListing struct {
+	ItemId  string
+	Seller  string
+	Price   int
+	Reasons []string
+}
+
+// Builds per-seller history from delisted listings and earlier flags.
+// `windowPrices` are keyed by hashJewelKey and are used to judge whether a
+// delisted listing was priced far below the market.
+func loadSellerHistory(ctx context.Context, jewels db.JewelStore, snapshots db.SnapshotStore, realm string, leagues []string, rates map[string]map[string]float64, windowPrices map[string]float64, now time.Time) (map[string]SellerHistory, error) {
+	history := make(map[string]SellerHistory)
+	since := now.Add(-SELLER_HISTORY_LOOKBACK)
+
+	delistings, err := jewels.QuickDelistings(ctx, realm, leagues, since, BAIT_MAX_LIFETIME)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range delistings {
+		j := db.DBJewel{
+			Realm:             d.Realm,
+			League:            d.League,
+			JewelType:         d.JewelType,
+			JewelClass:        d.JewelClass,
+			AllocatedNode:     d.AllocatedNode,
+			ListPriceAmount:   d.ListPriceAmount,
+			ListPriceCurrency: d.ListPriceCurrency,
+		}
+		windowPrice, ok := windowPrices[hashJewelKey(&j)]
+		if !ok {
+			continue
+		}
+		price, priceOk := GetPriceInChaos(&j, rates[j.League])
+		if priceOk && float64(price) < windowPrice*BAIT_PRICE_RATIO {
+			h := history[d.AccountName]
+			h.QuickBaits++
+			history[d.AccountName] = h
+		}
+	}
+
+	priorFlags, err := snapshots.PriorFlagCounts(ctx, realm, since)
+	if err != nil {
+		return nil, err
+	}
+	for seller, count := range priorFlags {
+		h := history[seller]
+		h.PriorFlags = count
+		history[seller] = h
+	}
+
+	return history, nil
+}
+
+// Flags listings in a single key's distribution that look like bait (priced
+// far below the market by a seller with a habit of pulling such listings) or
+// price-fixing (relisted over and over at an implausible price). A listing
+// is only flagged when its price is out of line AND there is some behavioural
+// signal, so a single honest underpriced listing is left alone.
+func DetectSuspiciousListings(listings []SellerListing, windowPrice float64, history map[string]SellerHistory) []FlaggedListing {
+	var flagged []FlaggedListing
+	if windowPrice <= 0 {
+		return flagged
+	}
+
+	for _, listing := range listings {
+		var reasons []string
+		h := history[listing.Seller]
+		price := float64(listing.Price)
+
+		if price < windowPrice*BAIT_PRICE_RATIO {
+			if listing.Seller != "" && h.QuickBaits >= QUICK_BAIT_THRESHOLD {
+				reasons = append(reasons, fmt.Sprintf("bait: seller pulled %d cheap listings within %s", h.QuickBaits, BAIT_MAX_LIFETIME))
+			}
+			if listing.PriceChanges >= RELIST_THRESHOLD {
+				reasons = append(reasons, fmt.Sprintf("bait: relisted %d times below %.0f%% of window price", listing.PriceChanges, BAIT_PRICE_RATIO*100))
+			}
+			if listing.Seller != "" && h.PriorFlags > 0 {
+				reasons = append(reasons, fmt.Sprintf("bait: seller previously flagged on %d listings", h.PriorFlags))
+			}
+		}
+
+		if price > windowPrice*PRICE_FIX_RATIO && listing.PriceChanges >= RELIST_THRESHOLD {
+			reasons = append(reasons, fmt.Sprintf("price-fixing: relisted %d times above %.0fx window price", listing.PriceChanges, PRICE_FIX_RATIO))
+		}
+
+		if len(reasons) > 0 {
+			flagged = append(flagged, FlaggedListing{
+				ItemId:  listing.ItemId,
+				Seller:  listing.Seller,
+				Price:   listing.Price,
+				Reasons: reasons,
+			})
+		}
+	}
+
+	return flagged
+}
+
+func excludeFlagged(listings []SellerListing, flagged []FlaggedListing) []SellerListing {
+	flaggedIds := make(map[string]bool, len(flagged))
+	for _, f := range flagged {
+		flaggedIds[f.ItemId] = true
+	}
+
+	var kept []SellerListing
+	for _, listing := range listings {
+		if !flaggedIds[listing.ItemId] {
+			kept = append(kept, listing)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,183 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	db "github.com/faideww/ffff/internal/db"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Everything an estimator decided on the way to a key's window price
+type KeyDiagnostics struct {
+	Estimator string    `json:"estimator"`
+	Prices    []float64 `json:"prices"`
+	// Only set by the clustering estimator. Silhouettes and CutScores (the
+	// score under CutCriterion) run parallel to Dendrogram and are null
+	// where a stratum can't be scored; CutLevel is the stratum the inliers
+	// were chosen from.
+	Dendrogram   []DendrogramStrata `json:"dendrogram,omitempty"`
+	Silhouettes  []pgtype.Float8    `json:"silhouettes,omitempty"`
+	CutCriterion string             `json:"cutCriterion,omitempty"`
+	CutScores    []pgtype.Float8    `json:"cutScores,omitempty"`
+	CutLevel     pgtype.Int4        `json:"cutLevel"`
+	Inliers      []float64          `json:"inliers"`
+	Notes        []string           `json:"notes"`
+}
+
+// Appends a free-form line to the diagnostics. Safe to call on nil.
+func (d *KeyDiagnostics) Logf(format string, args ...any) {
+	if d == nil {
+		return
+	}
+	d.Notes = append(d.Notes, fmt.Sprintf(format, args...))
+}
+
+// Receives per-key diagnostics during aggregation. Snapshot set ids are only
+// known once the sets are inserted, so sinks buffer what they are given and
+// write it all out in Flush.
+type DiagnosticsSink interface {
+	// Records the diagnostics for a key; a later call for the same key (e.g.
+	// after flagged listings are excluded) replaces the earlier one
+	Record(key string, d *KeyDiagnostics)
+	Flush(ctx context.Context, setIdsByLeague map[string]int, generatedAt time.Time) error
+}
+
+// Selected with DIAGNOSTICS_SINK:
+//
+//	DIAGNOSTICS_SINK=             discard (default)
+//	DIAGNOSTICS_SINK=dir:/path    one JSON file per snapshot set in /path
+//	DIAGNOSTICS_SINK=postgres     snapshot_diagnostics table
+func NewDiagnosticsSink(spec string, store db.SnapshotStore) (DiagnosticsSink, error) {
+	switch {
+	case spec == "" || spec == "none":
+		return NoopDiagnostics{}, nil
+	case spec == "postgres":
+		return &StoreDiagnostics{store: store, keys: make(map[string]*KeyDiagnostics)}, nil
+	case strings.HasPrefix(spec, "dir:"):
+		dir := strings.TrimPrefix(spec, "dir:")
+		if dir == "" {
+			return nil, fmt.Errorf("diagnostics directory must not be empty")
+		}
+		return &DirDiagnostics{dir: dir, keys: make(map[string]*KeyDiagnostics)}, nil
+	default:
+		return nil, fmt.Errorf("unknown diagnostics sink %q", spec)
+	}
+}
+
+type NoopDiagnostics struct{}
+
+func (NoopDiagnostics) Record(key string, d *KeyDiagnostics) {}
+
+func (NoopDiagnostics) Flush(ctx context.Context, setIdsByLeague map[string]int, generatedAt time.Time) error {
+	return nil
+}
+
+// Writes <dir>/set-<setId>.json for every snapshot set. Set ids are unique,
+// so concurrent runs never write to the same file.
+type DirDiagnostics struct {
+	dir  string
+	keys map[string]*KeyDiagnostics
+}
+
+type dirDiagnosticsEntry struct {
+	JewelType     string `json:"jewelType"`
+	JewelClass    string `json:"jewelClass"`
+	AllocatedNode string `json:"allocatedNode"`
+	*KeyDiagnostics
+}
+
+func (s *DirDiagnostics) Record(key string, d *KeyDiagnostics) {
+	s.keys[key] = d
+}
+
+func (s *DirDiagnostics) Flush(ctx context.Context, setIdsByLeague map[string]int, generatedAt time.Time) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	entriesBySet := make(map[int][]dirDiagnosticsEntry)
+	for k, d := range s.keys {
+		jData := unhashJewelKey(k)
+		setId, ok := setIdsByLeague[jData.League]
+		if !ok {
+			continue
+		}
+		entriesBySet[setId] = append(entriesBySet[setId], dirDiagnosticsEntry{jData.JewelType, jData.JewelClass, jData.AllocatedNode, d})
+	}
+
+	for setId, entries := range entriesBySet {
+		data, err := json.Marshal(map[string]any{
+			"setId":       setId,
+			"generatedAt": generatedAt,
+			"keys":        entries,
+		})
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(filepath.Join(s.dir, fmt.Sprintf("set-%d.json", setId)), data, 0o644); err != nil {
+			return err
+		}
+	}
+
+	clear(s.keys)
+	return nil
+}
+
+type StoreDiagnostics struct {
+	store db.SnapshotStore
+	keys  map[string]*KeyDiagnostics
+}
+
+func (s *StoreDiagnostics) Record(key string, d *KeyDiagnostics) {
+	s.keys[key] = d
+}
+
+func (s *StoreDiagnostics) Flush(ctx context.Context, setIdsByLeague map[string]int, generatedAt time.Time) error {
+	var rows []db.DBSnapshotDiagnostics
+	for k, d := range s.keys {
+		jData := unhashJewelKey(k)
+		setId, ok := setIdsByLeague[jData.League]
+		if !ok {
+			continue
+		}
+
+		var dendrogram []byte
+		if d.Dendrogram != nil {
+			var err error
+			if dendrogram, err = json.Marshal(d.Dendrogram); err != nil {
+				return err
+			}
+		}
+		notes := d.Notes
+		if notes == nil {
+			notes = []string{}
+		}
+
+		rows = append(rows, db.DBSnapshotDiagnostics{
+			SetId:         setId,
+			JewelType:     jData.JewelType,
+			JewelClass:    jData.JewelClass,
+			AllocatedNode: jData.AllocatedNode,
+			Estimator:     d.Estimator,
+			Prices:        d.Prices,
+			Dendrogram:    dendrogram,
+			Silhouettes:   d.Silhouettes,
+			CutCriterion:  pgtype.Text{String: d.CutCriterion, Valid: d.CutCriterion != ""},
+			CutScores:     d.CutScores,
+			CutLevel:      d.CutLevel,
+			InlierPrices:  d.Inliers,
+			Notes:         notes,
+			GeneratedAt:   generatedAt,
+		})
+	}
+
+	err := s.store.InsertDiagnostics(ctx, rows)
+	clear(s.keys)
+	return err
+}
@@ -0,0 +1,297 @@
+package stats
+
+import (
+	"context"
+	"math"
+	"time"
+
+	db "github.com/faideww/ffff/internal/db"
+)
+
+// How much snapshot history the forecaster trains on
+const FORECAST_LOOKBACK = 14 * 24 * time.Hour
+
+// Play-time follows a daily cycle, so prices are modelled with a 24h season
+// on an hourly series
+const FORECAST_SEASON_LENGTH = 24
+
+// Trend damping. Prices fall over a league's life but the fall slows down,
+// so the trend is damped rather than extrapolated linearly.
+const FORECAST_TREND_DAMPING = 0.9
+
+// Minimum number of hourly points to fit a damped trend at all; the
+// seasonal component additionally needs two full seasons
+const FORECAST_MIN_POINTS = 6
+
+// z-score for the 95% prediction interval
+const FORECAST_INTERVAL_Z = 1.96
+
+var FORECAST_HORIZONS = []int{24, 72}
+
+type Forecast struct {
+	HorizonHours int
+	Price        float64
+	Lower        float64
+	Upper        float64
+	// Whether the daily seasonal component was fitted, or only level + trend
+	Seasonal bool
+}
+
+type holtWintersParams struct {
+	alpha, beta, gamma, phi float64
+}
+
+type holtWintersFit struct {
+	params   holtWintersParams
+	level    float64
+	trend    float64
+	seasonal []float64
+	// index into `seasonal` for the first step after the end of the series
+	nextSeason int
+	sse        float64
+	n          int
+}
+
+// Resamples irregular snapshots onto an hourly grid ending at `now`. Hours
+// with several snapshots are averaged; empty hours are linearly
+// interpolated between their neighbours.
+func resampleHourly(points []PricePoint, now time.Time) []float64 {
+	if len(points) == 0 {
+		return nil
+	}
+
+	start := points[0].At.Truncate(time.Hour)
+	n := int(now.Truncate(time.Hour).Sub(start)/time.Hour) + 1
+	sums := make([]float64, n)
+	counts := make([]int, n)
+	for _, p := range points {
+		i := int(p.At.Truncate(time.Hour).Sub(start) / time.Hour)
+		if i < 0 || i >= n {
+			continue
+		}
+		sums[i] += p.Price
+		counts[i]++
+	}
+
+	series := make([]float64, n)
+	last := -1
+	for i := 0; i < n; i++ {
+		if counts[i] == 0 {
+			continue
+		}
+		series[i] = sums[i] / float64(counts[i])
+		if last >= 0 && i-last > 1 {
+			for j := last + 1; j < i; j++ {
+				t := float64(j-last) / float64(i-last)
+				series[j] = series[last] + (series[i]-series[last])*t
+			}
+		} else if last < 0 {
+			for j := 0; j < i; j++ {
+				series[j] = series[i]
+			}
+		}
+		last = i
+	}
+	// Carry the last observation forward to the current hour
+	for j := last + 1; j < n; j++ {
+		series[j] = series[last]
+	}
+
+	return series
+}
+
+// Fits additive Holt-Winters with a damped trend. With m == 0 the seasonal
+// component is dropped (damped Holt's linear method).
+func fitHoltWinters(y []float64, m int, p holtWintersParams) holtWintersFit {
+	fit := holtWintersFit{params: p}
+
+	start := 1
+	fit.level = y[0]
+	if m > 0 {
+		firstMean, secondMean := 0.0, 0.0
+		for i := 0; i < m; i++ {
+			firstMean += y[i]
+			secondMean += y[m+i]
+		}
+		firstMean /= float64(m)
+		secondMean /= float64(m)
+
+		fit.level = firstMean
+		fit.trend = (secondMean - firstMean) / float64(m)
+		fit.seasonal = make([]float64, m)
+		for i := 0; i < m; i++ {
+			fit.seasonal[i] = y[i] - firstMean
+		}
+		start = m
+	} else {
+		fit.trend = y[1] - y[0]
+	}
+
+	for t := start; t < len(y); t++ {
+		season := 0.0
+		if m > 0 {
+			season = fit.seasonal[t%m]
+		}
+		predicted := fit.level + p.phi*fit.trend + season
+		err := y[t] - predicted
+		fit.sse += err * err
+		fit.n++
+
+		prevLevel := fit.level
+		fit.level = p.alpha*(y[t]-season) + (1-p.alpha)*(prevLevel+p.phi*fit.trend)
+		fit.trend = p.beta*(fit.level-prevLevel) + (1-p.beta)*p.phi*fit.trend
+		if m > 0 {
+			fit.seasonal[t%m] = p.gamma*(y[t]-fit.level) + (1-p.gamma)*season
+		}
+	}
+	if m > 0 {
+		fit.nextSeason = len(y) % m
+	}
+
+	return fit
+}
+
+// Predicts h steps ahead along with the standard deviation of the forecast
+// error, using the usual variance approximation for additive Holt-Winters
+func (fit holtWintersFit) predict(h int) (float64, float64) {
+	p := fit.params
+	m := len(fit.seasonal)
+
+	dampedSum := 0.0
+	for i := 1; i <= h; i++ {
+		dampedSum += math.Pow(p.phi, float64(i))
+	}
+	value := fit.level + dampedSum*fit.trend
+	if m > 0 {
+		value += fit.seasonal[(fit.nextSeason+h-1)%m]
+	}
+
+	sigma2 := 0.0
+	if fit.n > 0 {
+		sigma2 = fit.sse / float64(fit.n)
+	}
+	variance := 1.0
+	cumPhi := 0.0
+	for j := 1; j < h; j++ {
+		cumPhi += math.Pow(p.phi, float64(j))
+		c := p.alpha * (1 + p.beta*cumPhi)
+		if m > 0 && j%m == 0 {
+			c += p.gamma
+		}
+		variance += c * c
+	}
+
+	return value, math.Sqrt(sigma2 * variance)
+}
+
+// Forecasts the window price of a single key from its snapshot history.
+// Prices are modelled in log space so the intervals stay positive and
+// percentage moves are treated alike across cheap and expensive nodes.
+func ForecastPrices(history []PricePoint, now time.Time, horizons []int) []Forecast {
+	series := resampleHourly(history, now)
+	if len(series) < FORECAST_MIN_POINTS {
+		return nil
+	}
+
+	y := make([]float64, len(series))
+	for i, v := range series {
+		y[i] = math.Log(v)
+	}
+
+	m := 0
+	if len(y) >= 2*FORECAST_SEASON_LENGTH {
+		m = FORECAST_SEASON_LENGTH
+	}
+
+	// Pick the smoothing parameters with a coarse grid search on one-step
+	// ahead error; the series are short enough that this is cheap
+	grid := []float64{0.05, 0.1, 0.2, 0.3, 0.5, 0.8}
+	gammas := []float64{0}
+	if m > 0 {
+		gammas = grid
+	}
+
+	var best holtWintersFit
+	bestErr := math.Inf(1)
+	for _, alpha := range grid {
+		for _, beta := range grid {
+			if beta > alpha {
+				continue
+			}
+			for _, gamma := range gammas {
+				fit := fitHoltWinters(y, m, holtWintersParams{alpha, beta, gamma, FORECAST_TREND_DAMPING})
+				if fit.n > 0 && fit.sse/float64(fit.n) < bestErr {
+					bestErr = fit.sse / float64(fit.n)
+					best = fit
+				}
+			}
+		}
+	}
+	if math.IsInf(bestErr, 1) {
+		return nil
+	}
+
+	forecasts := make([]Forecast, len(horizons))
+	for i, h := range horizons {
+		value, stddev := best.predict(h)
+		forecasts[i] = Forecast{
+			HorizonHours: h,
+			Price:        math.Exp(value),
+			Lower:        math.Exp(value - FORECAST_INTERVAL_Z*stddev),
+			Upper:        math.Exp(value + FORECAST_INTERVAL_Z*stddev),
+			Seasonal:     m > 0,
+		}
+	}
+	return forecasts
+}
+
+// Produces forecasts for every key in the realm's given snapshot sets and
+// stores them alongside the set they were generated from
+func GenerateForecasts(ctx context.Context, store db.SnapshotStore, realm string, setIdsByLeague map[string]int, now time.Time) (int, error) {
+	leagues := make([]string, 0, len(setIdsByLeague))
+	for league := range setIdsByLeague {
+		leagues = append(leagues, league)
+	}
+
+	points, err := store.SnapshotHistory(ctx, realm, leagues, now.Add(-FORECAST_LOOKBACK))
+	if err != nil {
+		return 0, err
+	}
+
+	history := make(map[string][]PricePoint)
+	for _, p := range points {
+		if p.WindowPrice <= 0 {
+			continue
+		}
+		k := hashKey(p.Key)
+		history[k] = append(history[k], PricePoint{p.GeneratedAt, p.WindowPrice})
+	}
+
+	var forecasts []db.DBForecast
+	for k, points := range history {
+		jData := unhashJewelKey(k)
+		setId, ok := setIdsByLeague[jData.League]
+		if !ok {
+			continue
+		}
+
+		for _, f := range ForecastPrices(points, now, FORECAST_HORIZONS) {
+			forecasts = append(forecasts, db.DBForecast{
+				SetId:         setId,
+				JewelType:     jData.JewelType,
+				JewelClass:    jData.JewelClass,
+				AllocatedNode: jData.AllocatedNode,
+				HorizonHours:  f.HorizonHours,
+				ForecastPrice: f.Price,
+				LowerPrice:    f.Lower,
+				UpperPrice:    f.Upper,
+				Seasonal:      f.Seasonal,
+				GeneratedAt:   now,
+				TargetAt:      now.Add(time.Duration(f.HorizonHours) * time.Hour),
+			})
+		}
+	}
+
+	err = store.InsertForecasts(ctx, forecasts)
+	return len(forecasts), err
+}
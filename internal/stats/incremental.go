@@ -0,0 +1,143 @@
+package stats
+
+import (
+	"context"
+	"math"
+	"time"
+
+	db "github.com/faideww/ffff/internal/db"
+)
+
+// An exchange rate has to move by more than this (relative to the rate the
+// previous snapshots were computed with) before keys priced in that
+// currency are recomputed
+const RATE_CHANGE_THRESHOLD = 0.05
+
+type AggregateFlags struct {
+	// Recompute every key rather than only those whose listings changed
+	Full bool
+}
+
+type previousSet struct {
+	Id          int
+	GeneratedAt time.Time
+	Rates       map[string]float64
+	// Nil for sets from before the window settings were recorded
+	Window *WindowConfig
+}
+
+func loadPreviousSets(ctx context.Context, store db.SnapshotStore, realm string, leagues []string) (map[string]previousSet, error) {
+	latest, err := store.LatestSnapshotSets(ctx, realm, leagues)
+	if err != nil {
+		return nil, err
+	}
+
+	sets := make(map[string]previousSet, len(latest))
+	for _, set := range latest {
+		prev := previousSet{Id: set.Id, GeneratedAt: set.GeneratedAt, Rates: set.ExchangeRates}
+		if set.WindowSeconds.Valid && set.HalfLifeSeconds.Valid {
+			prev.Window = &WindowConfig{
+				Window:   time.Duration(set.WindowSeconds.Int64) * time.Second,
+				HalfLife: time.Duration(set.HalfLifeSeconds.Int64) * time.Second,
+			}
+		}
+		sets[set.League] = prev
+	}
+	return sets, nil
+}
+
+// Rates only move once they drift past RATE_CHANGE_THRESHOLD from the rate
+// the previous set was computed with. Every snapshot in a set is then priced
+// with exactly the rates stored on that set, and small daily wobbles don't
+// force a full recompute. Returns the rates to use and the currencies whose
+// rate moved.
+func anchorExchangeRates(previous, current map[string]float64) (map[string]float64, []string) {
+	anchored := make(map[string]float64, len(current))
+	for currency, rate := range previous {
+		anchored[currency] = rate
+	}
+
+	var changed []string
+	for currency, rate := range current {
+		prevRate, ok := previous[currency]
+		if !ok || prevRate <= 0 || math.Abs(rate/prevRate-1) > RATE_CHANGE_THRESHOLD {
+			anchored[currency] = rate
+			changed = append(changed, currency)
+		}
+	}
+
+	return anchored, changed
+}
+
+// A key is dirty if one of its listings was added or changed since the last
+// run, fell out of the time window since the last run, is priced in a
+// currency whose rate moved, or was delisted since the last run
+func findDirtyKeys(ctx context.Context, store db.JewelStore, realm string, league string, prev previousSet, changedCurrencies []string, windowSize time.Duration, now time.Time) (map[string]bool, error) {
+	prevCutoff := prev.GeneratedAt.Add(-windowSize)
+	cutoff := now.Add(-windowSize)
+	if changedCurrencies == nil {
+		changedCurrencies = []string{}
+	}
+
+	keys, err := store.ChangedKeys(ctx, realm, league, prev.GeneratedAt, prevCutoff, cutoff, changedCurrencies)
+	if err != nil {
+		return nil, err
+	}
+
+	dirty := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		dirty[hashKey(k)] = true
+	}
+	return dirty, nil
+}
+
+// Fetches every listing in the realm's given leagues that falls inside that
+// league's time window
+func fetchJewels(ctx context.Context, store db.JewelStore, realm string, leagues []string, cutoffs map[string]time.Time) ([]db.DBJewel, error) {
+	leagueCutoffs := make(map[string]time.Time, len(leagues))
+	for _, league := range leagues {
+		leagueCutoffs[league] = cutoffs[league]
+	}
+	return store.JewelsSince(ctx, realm, leagueCutoffs)
+}
+
+func fetchJewelsForKeys(ctx context.Context, store db.JewelStore, keys map[string]bool, cutoffs map[string]time.Time) ([]db.DBJewel, error) {
+	keyCutoffs := make(map[db.JewelKey]time.Time, len(keys))
+	for k := range keys {
+		key := unhashKey(k)
+		keyCutoffs[key] = cutoffs[key.League]
+	}
+	return store.JewelsForKeys(ctx, keyCutoffs)
+}
+
+// Loads the previous set's snapshots and flags for every key that isn't
+// dirty, so they can be carried into the new set unchanged
+func loadCarriedSnapshots(ctx context.Context, store db.SnapshotStore, realm string, league string, prev previousSet, dirty map[string]bool) (map[string]db.DBJewelSnapshot, map[string][]db.DBFlaggedListing, error) {
+	prevSnapshots, err := store.SnapshotsInSet(ctx, prev.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	carried := make(map[string]db.DBJewelSnapshot)
+	for _, s := range prevSnapshots {
+		k := hashKey(db.JewelKey{Realm: realm, League: league, JewelType: s.JewelType, JewelClass: s.JewelClass, AllocatedNode: s.AllocatedNode})
+		if !dirty[k] {
+			carried[k] = s
+		}
+	}
+
+	prevFlags, err := store.FlagsInSet(ctx, prev.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	carriedFlags := make(map[string][]db.DBFlaggedListing)
+	for _, f := range prevFlags {
+		k := hashKey(db.JewelKey{Realm: realm, League: league, JewelType: f.JewelType, JewelClass: f.JewelClass, AllocatedNode: f.AllocatedNode})
+		if _, ok := carried[k]; ok {
+			carriedFlags[k] = append(carriedFlags[k], f)
+		}
+	}
+
+	return carried, carriedFlags, nil
+}
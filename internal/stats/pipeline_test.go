@@ -0,0 +1,196 @@
+package stats
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	db "github.com/faideww/ffff/internal/db"
+	"github.com/faideww/ffff/internal/psapi"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	TEST_LEAGUE = "Settlers"
+	NODE_A      = "Elemental Equilibrium"
+	NODE_B      = "Chaos Inoculation"
+)
+
+func flame(id string, node string, price float64, currency string) psapi.JewelEntry {
+	return psapi.JewelEntry{Id: id, Type: "Forbidden Flame", Class: "Witch", Node: node, Price: psapi.Price{Count: price, Currency: currency}}
+}
+
+func stash(id string, account string, changeId string, recordedAt time.Time, items ...psapi.JewelEntry) psapi.StashSnapshot {
+	return psapi.StashSnapshot{Id: id, League: TEST_LEAGUE, AccountName: account, Items: items, ChangeId: changeId, RecordedAt: recordedAt}
+}
+
+func testRates(league string) (map[string]float64, error) {
+	return map[string]float64{"divine": 100}, nil
+}
+
+// What read-river and collect-stats share
+type pipelineStore interface {
+	db.JewelStore
+	db.SnapshotStore
+}
+
+// Runs `test` against a MemoryStore and against a SQLiteStore in a temp file
+func forEachStore(t *testing.T, test func(t *testing.T, store pipelineStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, db.NewMemoryStore())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		store, err := db.NewSQLiteStore(context.Background(), db.SQLiteConfig{Path: filepath.Join(t.TempDir(), "ffff.db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(store.Close)
+		test(t, store)
+	})
+}
+
+// The latest set's snapshots for `realm`, by allocated node
+func latestSnapshots(t *testing.T, store pipelineStore, realm string) map[string]db.DBJewelSnapshot {
+	t.Helper()
+	sets, err := store.LatestSnapshotSets(context.Background(), realm, []string{TEST_LEAGUE})
+	if err != nil || len(sets) != 1 {
+		t.Fatalf("latest %s snapshot sets: %v, %v", realm, sets, err)
+	}
+	snapshots, err := store.SnapshotsInSet(context.Background(), sets[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byNode := make(map[string]db.DBJewelSnapshot, len(snapshots))
+	for _, s := range snapshots {
+		byNode[s.AllocatedNode] = s
+	}
+	return byNode
+}
+
+func expectSnapshot(t *testing.T, snapshots map[string]db.DBJewelSnapshot, node string, numListed int, numSellers int, minPrice float64, maxPrice float64) {
+	t.Helper()
+	s, ok := snapshots[node]
+	if !ok {
+		t.Fatalf("no snapshot for %s in %v", node, snapshots)
+	}
+	if s.NumListed != numListed || s.NumSellers != numSellers || s.MinPrice != minPrice || s.MaxPrice != maxPrice {
+		t.Errorf("%s: %d listed by %d sellers at %v-%v, want %d by %d at %v-%v",
+			node, s.NumListed, s.NumSellers, s.MinPrice, s.MaxPrice, numListed, numSellers, minPrice, maxPrice)
+	}
+}
+
+// Feeds river pages through UpdateDb and aggregates them, the way
+// read-river and collect-stats share a database
+func TestRiverPagesToSnapshots(t *testing.T) {
+	t.Setenv("MAX_LISTINGS_PER_SELLER", "")
+	forEachStore(t, func(t *testing.T, store pipelineStore) {
+		ctx := context.Background()
+		start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+		firstRead := start.Add(-30 * time.Minute)
+		firstPage := []psapi.StashSnapshot{
+			stash("s1", "alice", "1-1", firstRead,
+				flame("a1", NODE_A, 10, "chaos"), flame("a2", NODE_A, 12, "chaos"), flame("a3", NODE_A, 14, "chaos")),
+			stash("s2", "bob", "1-1", firstRead,
+				flame("b1", NODE_A, 11, "chaos"), flame("b2", NODE_B, 1, "divine")),
+			stash("s3", "carol", "1-1", firstRead,
+				flame("c1", NODE_A, 13, "chaos"), flame("c2", NODE_B, 150, "chaos")),
+		}
+		if err := psapi.UpdateDb(ctx, store, "pc", firstPage, pgtype.Int4{}); err != nil {
+			t.Fatal(err)
+		}
+		consolePage := []psapi.StashSnapshot{
+			stash("x1", "dave", "1-1", firstRead, flame("d1", NODE_A, 40, "chaos")),
+		}
+		if err := psapi.UpdateDb(ctx, store, "sony", consolePage, pgtype.Int4{}); err != nil {
+			t.Fatal(err)
+		}
+
+		f := &AggregateFlags{}
+		for _, realm := range []string{"pc", "sony"} {
+			if err := Aggregate(ctx, store, store, realm, []string{TEST_LEAGUE}, testRates, f, start); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		snapshots := latestSnapshots(t, store, "pc")
+		expectSnapshot(t, snapshots, NODE_A, 5, 3, 10, 14)
+		expectSnapshot(t, snapshots, NODE_B, 2, 2, 100, 150)
+		consoleSnapshots := latestSnapshots(t, store, "sony")
+		expectSnapshot(t, consoleSnapshots, NODE_A, 1, 1, 40, 40)
+		if _, ok := consoleSnapshots[NODE_B]; ok {
+			t.Errorf("PC listings leaked into the sony snapshots")
+		}
+
+		// alice sells one jewel and reprices another; nothing else changes
+		secondRead := start.Add(10 * time.Minute)
+		secondPage := []psapi.StashSnapshot{
+			stash("s1", "alice", "2-2", secondRead, flame("a2", NODE_A, 20, "chaos"), flame("a3", NODE_A, 14, "chaos")),
+		}
+		if err := psapi.UpdateDb(ctx, store, "pc", secondPage, pgtype.Int4{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := Aggregate(ctx, store, store, "pc", []string{TEST_LEAGUE}, testRates, f, start.Add(15*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+
+		snapshots = latestSnapshots(t, store, "pc")
+		expectSnapshot(t, snapshots, NODE_A, 4, 3, 11, 20)
+		// Carried forward from the first set, since none of its listings changed
+		expectSnapshot(t, snapshots, NODE_B, 2, 2, 100, 150)
+
+		history, err := store.QuickDelistings(ctx, "pc", []string{TEST_LEAGUE}, start.Add(-time.Hour), 24*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 1 || history[0].ItemId != "a1" {
+			t.Errorf("delisted %v, want only a1", history)
+		}
+	})
+}
+
+// Snapshots computed under other window settings aren't carried forward,
+// even when none of their listings changed
+func TestWindowChangeSkipsCarryForward(t *testing.T) {
+	t.Setenv("MAX_LISTINGS_PER_SELLER", "")
+	t.Setenv("STATS_WINDOW", "")
+	forEachStore(t, func(t *testing.T, store pipelineStore) {
+		ctx := context.Background()
+		start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+		oldRead := start.Add(-30 * time.Minute)
+		firstPage := []psapi.StashSnapshot{
+			stash("s1", "alice", "1-1", oldRead, flame("a1", NODE_A, 10, "chaos")),
+			stash("s2", "bob", "1-1", oldRead, flame("b1", NODE_B, 20, "chaos")),
+		}
+		if err := psapi.UpdateDb(ctx, store, "pc", firstPage, pgtype.Int4{}); err != nil {
+			t.Fatal(err)
+		}
+		f := &AggregateFlags{}
+		if err := Aggregate(ctx, store, store, "pc", []string{TEST_LEAGUE}, testRates, f, start); err != nil {
+			t.Fatal(err)
+		}
+		if snapshots := latestSnapshots(t, store, "pc"); len(snapshots) != 2 {
+			t.Fatalf("snapshots for %d nodes, expected 2", len(snapshots))
+		}
+
+		// Only alice relists, and the window shrinks past bob's listing
+		secondPage := []psapi.StashSnapshot{
+			stash("s1", "alice", "2-2", start.Add(10*time.Minute), flame("a1", NODE_A, 12, "chaos")),
+		}
+		if err := psapi.UpdateDb(ctx, store, "pc", secondPage, pgtype.Int4{}); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("STATS_WINDOW", "20m")
+		if err := Aggregate(ctx, store, store, "pc", []string{TEST_LEAGUE}, testRates, f, start.Add(15*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+
+		snapshots := latestSnapshots(t, store, "pc")
+		expectSnapshot(t, snapshots, NODE_A, 1, 1, 12, 12)
+		if s, ok := snapshots[NODE_B]; ok {
+			t.Errorf("carried %s forward from a set with a 48h window: %+v", NODE_B, s)
+		}
+	})
+}
@@ -0,0 +1,232 @@
+// Package robust implements the quantile and robust location/scale
+// estimators used by the stats aggregation.
+//
+// Functions that take `sorted` expect their input in ascending order and
+// do not modify it. Every estimator returns NaN for empty input rather than
+// panicking, so callers only need to check the result where it matters.
+package robust
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+)
+
+// Scales the MAD so it estimates the standard deviation of normally
+// distributed data
+const MAD_NORMAL_SCALE = 1.4826
+
+// Returns a sorted copy of values
+func Sorted(values []float64) []float64 {
+	s := slices.Clone(values)
+	slices.Sort(s)
+	return s
+}
+
+// Hyndman-Fan type 7 quantile: linear interpolation between the order
+// statistics at h = (n-1)q. This is the default in R and numpy.
+func Quantile(sorted []float64, q float64) float64 {
+	n := len(sorted)
+	if n == 0 || math.IsNaN(q) {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return sorted[0]
+	}
+	if q >= 1 {
+		return sorted[n-1]
+	}
+
+	h := float64(n-1) * q
+	lo := int(math.Floor(h))
+	if lo+1 >= n {
+		return sorted[n-1]
+	}
+	return sorted[lo] + (h-float64(lo))*(sorted[lo+1]-sorted[lo])
+}
+
+// Weighted generalisation of the type 7 quantile. Each value sits at a
+// position proportional to the weight accumulated up to its midpoint, with
+// the first and last values pinned to 0 and 1; with equal weights this
+// reduces exactly to Quantile. A nil `weights` means equal weights.
+func WeightedQuantile(sorted []float64, weights []float64, q float64) float64 {
+	if weights == nil {
+		return Quantile(sorted, q)
+	}
+
+	n := len(sorted)
+	if n == 0 || math.IsNaN(q) {
+		return math.NaN()
+	}
+	if n == 1 || q <= 0 {
+		return sorted[0]
+	}
+	if q >= 1 {
+		return sorted[n-1]
+	}
+
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	span := total - weights[0]/2 - weights[n-1]/2
+	if span <= 0 {
+		return Quantile(sorted, q)
+	}
+
+	cumulative := 0.0
+	prevPos, prevValue := 0.0, sorted[0]
+	for i := 0; i < n; i++ {
+		cumulative += weights[i]
+		pos := (cumulative - weights[i]/2 - weights[0]/2) / span
+		if pos >= q {
+			if i == 0 || pos == prevPos {
+				return sorted[i]
+			}
+			t := (q - prevPos) / (pos - prevPos)
+			return prevValue + t*(sorted[i]-prevValue)
+		}
+		prevPos, prevValue = pos, sorted[i]
+	}
+	return sorted[n-1]
+}
+
+// The true median: the middle value, or the mean of the two middle values
+func Median(sorted []float64) float64 {
+	return Quantile(sorted, 0.5)
+}
+
+// Median absolute deviation from the median (unscaled)
+func MAD(sorted []float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+
+	median := Median(sorted)
+	deviations := make([]float64, len(sorted))
+	for i, v := range sorted {
+		deviations[i] = math.Abs(v - median)
+	}
+	slices.Sort(deviations)
+	return Median(deviations)
+}
+
+func Mean(values []float64) float64 {
+	return WeightedMean(values, nil)
+}
+
+func WeightedMean(values []float64, weights []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	sum, total := 0.0, 0.0
+	for i, v := range values {
+		w := 1.0
+		if weights != nil {
+			w = weights[i]
+		}
+		sum += w * v
+		total += w
+	}
+	if total <= 0 {
+		return math.NaN()
+	}
+	return sum / total
+}
+
+// Sample standard deviation around the mean
+func StdDev(values []float64) float64 {
+	return WeightedStdDev(values, nil)
+}
+
+// Standard deviation around the weighted mean, using reliability weights.
+// With nil weights this is the usual n-1 sample standard deviation.
+func WeightedStdDev(values []float64, weights []float64) float64 {
+	n := len(values)
+	if n == 0 {
+		return math.NaN()
+	}
+	if n == 1 {
+		return 0
+	}
+
+	mean := WeightedMean(values, weights)
+	sumSq, total, totalSq := 0.0, 0.0, 0.0
+	for i, v := range values {
+		w := 1.0
+		if weights != nil {
+			w = weights[i]
+		}
+		sumSq += w * (v - mean) * (v - mean)
+		total += w
+		totalSq += w * w
+	}
+
+	denom := total - totalSq/total
+	if denom <= 0 {
+		return 0
+	}
+	return math.Sqrt(sumSq / denom)
+}
+
+// Number of values to cut from each tail for a trimming proportion
+func tailCount(n int, proportion float64) int {
+	if proportion <= 0 {
+		return 0
+	}
+	k := int(math.Floor(float64(n) * proportion))
+	if 2*k >= n {
+		k = (n - 1) / 2
+	}
+	return k
+}
+
+// Mean after dropping `proportion` of the values from each tail
+func TrimmedMean(sorted []float64, proportion float64) float64 {
+	k := tailCount(len(sorted), proportion)
+	return Mean(sorted[k : len(sorted)-k])
+}
+
+// Mean after clamping `proportion` of the values in each tail to the
+// nearest remaining value
+func WinsorizedMean(sorted []float64, proportion float64) float64 {
+	n := len(sorted)
+	if n == 0 {
+		return math.NaN()
+	}
+
+	k := tailCount(n, proportion)
+	lo, hi := sorted[k], sorted[n-1-k]
+	sum := 0.0
+	for _, v := range sorted {
+		sum += math.Min(math.Max(v, lo), hi)
+	}
+	return sum / float64(n)
+}
+
+// Percentile bootstrap confidence interval for `statistic`. Each resample
+// is sorted before being passed to the statistic, so the sorted-input
+// estimators above can be used directly.
+func BootstrapCI(values []float64, statistic func(sorted []float64) float64, resamples int, confidence float64, rng *rand.Rand) (float64, float64) {
+	n := len(values)
+	if n == 0 || resamples <= 0 {
+		return math.NaN(), math.NaN()
+	}
+
+	estimates := make([]float64, 0, resamples)
+	sample := make([]float64, n)
+	for r := 0; r < resamples; r++ {
+		for i := range sample {
+			sample[i] = values[rng.Intn(n)]
+		}
+		slices.Sort(sample)
+		if est := statistic(sample); !math.IsNaN(est) {
+			estimates = append(estimates, est)
+		}
+	}
+	slices.Sort(estimates)
+
+	alpha := (1 - confidence) / 2
+	return Quantile(estimates, alpha), Quantile(estimates, 1-alpha)
+}
@@ -0,0 +1,213 @@
+package robust
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+const PROPERTY_TRIALS = 500
+
+// Tolerance for results that are only equal up to floating point rounding
+const EPSILON = 1e-9
+
+// Random sorted samples of mixed sizes, with ties and the occasional
+// outlier, in the shape of a key's chaos prices
+func randomSamples(seed int64, trials int) [][]float64 {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([][]float64, trials)
+	for t := range samples {
+		n := 1 + rng.Intn(60)
+		values := make([]float64, n)
+		for i := range values {
+			switch rng.Intn(10) {
+			case 0:
+				values[i] = float64(rng.Intn(5))
+			case 1:
+				values[i] = rng.Float64() * 10000
+			default:
+				values[i] = 50 + rng.NormFloat64()*10
+			}
+		}
+		samples[t] = Sorted(values)
+	}
+	return samples
+}
+
+func within(t *testing.T, name string, v float64, sorted []float64) {
+	t.Helper()
+	lo, hi := sorted[0], sorted[len(sorted)-1]
+	tol := EPSILON * math.Max(1, math.Max(math.Abs(lo), math.Abs(hi)))
+	if math.IsNaN(v) || v < lo-tol || v > hi+tol {
+		t.Fatalf("%s = %v outside [%v, %v] for %v", name, v, lo, hi, sorted)
+	}
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) <= EPSILON*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+func TestQuantileMonotoneAndBounded(t *testing.T) {
+	for _, sorted := range randomSamples(1, PROPERTY_TRIALS) {
+		prev := math.Inf(-1)
+		for p := -0.1; p <= 1.1; p += 0.01 {
+			q := Quantile(sorted, p)
+			within(t, "Quantile", q, sorted)
+			if q < prev-EPSILON*math.Max(1, math.Abs(prev)) {
+				t.Fatalf("Quantile(%v) = %v below %v at the previous p for %v", p, q, prev, sorted)
+			}
+			prev = q
+		}
+	}
+}
+
+func TestWeightedQuantileEqualWeightsMatchesQuantile(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for _, sorted := range randomSamples(2, PROPERTY_TRIALS) {
+		weights := make([]float64, len(sorted))
+		w := 0.1 + rng.Float64()*5
+		for i := range weights {
+			weights[i] = w
+		}
+		for p := 0.0; p <= 1; p += 0.05 {
+			if got, want := WeightedQuantile(sorted, weights, p), Quantile(sorted, p); !approxEqual(got, want) {
+				t.Fatalf("WeightedQuantile(%v) = %v, Quantile = %v for %v", p, got, want, sorted)
+			}
+		}
+	}
+}
+
+// Reference values from R's quantile(type = 7), which numpy's default
+// "linear" method matches
+var quantileCases = []struct {
+	sorted []float64
+	q      float64
+	want   float64
+}{
+	{[]float64{1, 2, 3, 4}, 0.1, 1.3},
+	{[]float64{1, 2, 3, 4}, 0.25, 1.75},
+	{[]float64{1, 2, 3, 4}, 0.5, 2.5},
+	{[]float64{1, 2, 3, 4}, 0.9, 3.7},
+	{[]float64{2, 4, 6, 100}, 0.5, 5},
+	{[]float64{1, 3, 7, 15, 31}, 0.3, 3.8},
+	{[]float64{1, 3, 7, 15, 31}, 0.5, 7},
+	{[]float64{1, 3, 7, 15, 31}, 0.75, 15},
+	{[]float64{1, 3, 7, 15, 31}, 0.95, 27.8},
+	{[]float64{1, 1, 2, 2, 2, 9}, 0.1, 1},
+	{[]float64{1, 1, 2, 2, 2, 9}, 0.5, 2},
+	{[]float64{1, 1, 2, 2, 2, 9}, 0.9, 5.5},
+	{[]float64{7}, 0.5, 7},
+	{[]float64{10, 20}, -0.5, 10},
+	{[]float64{10, 20}, 1.5, 20},
+}
+
+func TestQuantileReferenceValues(t *testing.T) {
+	for _, c := range quantileCases {
+		if got := Quantile(c.sorted, c.q); !approxEqual(got, c.want) {
+			t.Errorf("Quantile(%v, %v) = %v, expected %v", c.sorted, c.q, got, c.want)
+		}
+	}
+	if got := Median([]float64{1, 2, 3, 4, 5, 6}); got != 3.5 {
+		t.Errorf("median of an even-length input is %v, expected 3.5", got)
+	}
+}
+
+// Worked by hand: each value sits at (weight before it + half its own
+// weight - half the first weight) / (total - half the first and last
+// weights), and the quantile interpolates linearly between those positions
+var weightedQuantileCases = []struct {
+	sorted  []float64
+	weights []float64
+	q       float64
+	want    float64
+}{
+	// Positions 0, 1/2, 1
+	{[]float64{10, 20, 30}, []float64{1, 2, 1}, 0.25, 15},
+	{[]float64{10, 20, 30}, []float64{1, 2, 1}, 0.5, 20},
+	// Positions 0, 2/3, 1: the heavy first value drags the median down
+	{[]float64{10, 20, 30}, []float64{3, 1, 1}, 0.5, 17.5},
+	{[]float64{10, 20, 30}, []float64{3, 1, 1}, 0.9, 27},
+	// Positions 0, 1/3, 1
+	{[]float64{10, 20, 30}, []float64{1, 1, 3}, 0.5, 22.5},
+	// Positions 0, 1/2, 1, however light the middle value is
+	{[]float64{10, 20, 30}, []float64{1, 0, 1}, 0.5, 20},
+	// Positions 0, 2/9, 5/9, 1
+	{[]float64{1, 2, 4, 8}, []float64{0.5, 0.5, 1, 1}, 0.25, 2 + 1.0/6},
+	{[]float64{1, 2, 4, 8}, []float64{0.5, 0.5, 1, 1}, 0.75, 5.75},
+}
+
+func TestWeightedQuantileUnequalWeights(t *testing.T) {
+	for _, c := range weightedQuantileCases {
+		if got := WeightedQuantile(c.sorted, c.weights, c.q); !approxEqual(got, c.want) {
+			t.Errorf("WeightedQuantile(%v, %v, %v) = %v, expected %v", c.sorted, c.weights, c.q, got, c.want)
+		}
+	}
+}
+
+func TestMAD(t *testing.T) {
+	for _, sorted := range randomSamples(3, PROPERTY_TRIALS) {
+		if mad := MAD(sorted); math.IsNaN(mad) || mad < 0 {
+			t.Fatalf("MAD = %v for %v", mad, sorted)
+		}
+	}
+	for _, n := range []int{1, 2, 7} {
+		constant := make([]float64, n)
+		for i := range constant {
+			constant[i] = 42
+		}
+		if mad := MAD(constant); mad != 0 {
+			t.Fatalf("MAD = %v for %d constant values", mad, n)
+		}
+	}
+}
+
+func TestTrimmedAndWinsorizedMean(t *testing.T) {
+	for _, sorted := range randomSamples(4, PROPERTY_TRIALS) {
+		mean := Mean(sorted)
+		if got := TrimmedMean(sorted, 0); !approxEqual(got, mean) {
+			t.Fatalf("TrimmedMean(0) = %v, Mean = %v for %v", got, mean, sorted)
+		}
+		if got := WinsorizedMean(sorted, 0); !approxEqual(got, mean) {
+			t.Fatalf("WinsorizedMean(0) = %v, Mean = %v for %v", got, mean, sorted)
+		}
+		for _, proportion := range []float64{0.05, 0.1, 0.25, 0.5, 0.9} {
+			within(t, "TrimmedMean", TrimmedMean(sorted, proportion), sorted)
+			within(t, "WinsorizedMean", WinsorizedMean(sorted, proportion), sorted)
+		}
+	}
+}
+
+func TestBootstrapCIContainsEstimate(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	statistics := []struct {
+		name      string
+		statistic func([]float64) float64
+	}{{"Mean", Mean}, {"Median", Median}}
+	for _, sorted := range randomSamples(5, 100) {
+		if len(sorted) < 10 {
+			continue
+		}
+		for _, s := range statistics {
+			estimate := s.statistic(sorted)
+			lo, hi := BootstrapCI(sorted, s.statistic, 500, 0.95, rng)
+			if lo > hi || estimate < lo || estimate > hi {
+				t.Fatalf("%s = %v outside its interval [%v, %v] for %v", s.name, estimate, lo, hi, sorted)
+			}
+		}
+	}
+}
+
+func TestEmptyInput(t *testing.T) {
+	for name, v := range map[string]float64{
+		"Quantile":         Quantile(nil, 0.5),
+		"WeightedQuantile": WeightedQuantile(nil, []float64{}, 0.5),
+		"MAD":              MAD(nil),
+		"Mean":             Mean(nil),
+		"TrimmedMean":      TrimmedMean(nil, 0.1),
+		"WinsorizedMean":   WinsorizedMean(nil, 0.1),
+	} {
+		if !math.IsNaN(v) {
+			t.Errorf("%s = %v for empty input, want NaN", name, v)
+		}
+	}
+}
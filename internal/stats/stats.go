@@ -1,9 +1,7 @@
 package stats
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -11,33 +9,51 @@ import (
 	"net/http"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	db "github.com/faideww/ffff/internal/db"
 	"github.com/faideww/ffff/internal/poeninja"
-	"github.com/faideww/ffff/internal/utils"
-	"github.com/jackc/pgx/v5"
+	"github.com/faideww/ffff/internal/stats/robust"
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
 type Boxplot = [5]float64
 
-const DATE_CUTOFF = 48 * time.Hour
+// Seller capping is off unless MAX_LISTINGS_PER_SELLER is set, since turning
+// it on moves every published price
+const DEFAULT_MAX_LISTINGS_PER_SELLER = 0
+
+// Smallest cluster the clustering estimator will take a window price from,
+// as an absolute count and as a share of the key's listings
+const MIN_INLIER_CLUSTER_SIZE = 3
+const MIN_INLIER_CLUSTER_SHARE = 0.1
 
 func hashJewelKey(j *db.DBJewel) string {
-	return fmt.Sprintf("%s_%s_%s_%s", j.League, j.JewelType, j.JewelClass, j.AllocatedNode)
+	return fmt.Sprintf("%s_%s_%s_%s_%s", j.Realm, j.League, j.JewelType, j.JewelClass, j.AllocatedNode)
 }
 
 func unhashJewelKey(key string) db.DBJewel {
 	props := strings.Split(key, "_")
 	return db.DBJewel{
-		League:        props[0],
-		JewelType:     props[1],
-		JewelClass:    props[2],
-		AllocatedNode: props[3],
+		Realm:         props[0],
+		League:        props[1],
+		JewelType:     props[2],
+		JewelClass:    props[3],
+		AllocatedNode: props[4],
 	}
 }
 
+func hashKey(k db.JewelKey) string {
+	return hashJewelKey(&db.DBJewel{Realm: k.Realm, League: k.League, JewelType: k.JewelType, JewelClass: k.JewelClass, AllocatedNode: k.AllocatedNode})
+}
+
+func unhashKey(key string) db.JewelKey {
+	j := unhashJewelKey(key)
+	return db.JewelKey{Realm: j.Realm, League: j.League, JewelType: j.JewelType, JewelClass: j.JewelClass, AllocatedNode: j.AllocatedNode}
+}
+
 func GetPriceInChaos(j *db.DBJewel, rates map[string]float64) (int, bool) {
 	if j.ListPriceCurrency == "chaos" {
 		return int(j.ListPriceAmount), true
@@ -56,149 +72,164 @@ func GetPriceInChaos(j *db.DBJewel, rates map[string]float64) (int, bool) {
 	return chaosEquiv, true
 }
 
-func calculateStandardDeviation(values []float64) float64 {
-	n := len(values)
-	median := values[n/2]
-	if n%2 == 0 {
-		median = values[(n/2)-1] + values[n/2]/2
-	}
-	// calculate standard deviation
-	sumDeviation := 0.0
-	for _, v := range values {
-		sumDeviation += (v - median) * (v - median)
-	}
-	return math.Sqrt(sumDeviation / float64(n))
+type SellerListing struct {
+	Price        int
+	Seller       string
+	ItemId       string
+	PriceChanges int
+	// Recency weight; 1 when recency weighting is disabled
+	Weight float64
 }
 
-func calculatePriceSpread(prices []int) ([5]float64, float64) {
-	n := len(prices)
-	floatPrices := make([]float64, n)
-	for i, p := range prices {
-		floatPrices[i] = float64(p)
-	}
-	pMin := floatPrices[0]
-	pMax := floatPrices[n-1]
-	pMed := floatPrices[n/2]
-	pQ1 := floatPrices[n/4]
-	pQ3 := floatPrices[(3*n)/4]
-	stddev := calculateStandardDeviation(floatPrices)
-
-	return [5]float64{pMin, pQ1, pMed, pQ3, pMax}, stddev
+type priceSummary struct {
+	Boxplot     Boxplot
+	Stddev      float64
+	WindowPrice float64
+	Confidence  float64
+	// The sorted chaos prices the summary was computed from, and the cluster
+	// the window price was chosen from
+	Prices  []float64
+	Inliers []float64
 }
 
-func calculateWindowPriceStddev(prices []int, boxplot [5]float64, stddev float64) float64 {
-	meanMinusOne := boxplot[2] - stddev
-	meanPlusOne := boxplot[2] + stddev
+// `weights` runs parallel to `prices`; nil means every listing counts equally
+func summarizePrices(prices []int, weights []float64, d *KeyDiagnostics) (priceSummary, error) {
+	boxplot, stddev := calculatePriceSpread(prices, weights)
+	name, estimator := windowPriceEstimator()
+	d.Estimator = name
+	d.Prices = toFloats(prices)
+	windowPrice, confidence, inliers, err := estimator(prices, weights, d)
+	if err != nil {
+		return priceSummary{}, err
+	}
 
-	filteredPrices := []int{}
+	return priceSummary{boxplot, stddev, windowPrice, confidence, toFloats(prices), inliers}, nil
+}
 
-	for _, p := range prices {
-		if float64(p) >= meanMinusOne && float64(p) <= meanPlusOne && p >= 1 {
-			filteredPrices = append(filteredPrices, p)
-		}
+// Estimates a key's window price from its sorted prices. Returns the window
+// price, the confidence in it, and the listings it was derived from. How it
+// got there is recorded in `d`.
+type WindowPriceEstimator func(prices []int, weights []float64, d *KeyDiagnostics) (float64, float64, []float64, error)
+
+// Selected with PRICE_ESTIMATOR: "cluster" (hierarchical clustering, the
+// default) or "kde" (lowest significant kernel density mode)
+func windowPriceEstimator() (string, WindowPriceEstimator) {
+	switch os.Getenv("PRICE_ESTIMATOR") {
+	case "kde":
+		return "kde", calculateWindowPriceKDE
+	default:
+		return "cluster", calculateWindowPriceClustered
 	}
-	// recalculate stddev and filter again
-	nextBox, nextStddev := calculatePriceSpread(filteredPrices)
-	meanMinusOne = nextBox[2] - nextStddev
-	meanPlusOne = nextBox[2] + nextStddev
-
-	doubleFilteredPrices := []int{}
+}
 
-	for _, p := range filteredPrices {
-		if float64(p) >= meanMinusOne && float64(p) <= meanPlusOne {
-			doubleFilteredPrices = append(doubleFilteredPrices, p)
-		}
+// How many listings a single seller may contribute to a key's price
+// distribution. 0 disables the cap.
+func maxListingsPerSeller() int {
+	n, err := strconv.Atoi(os.Getenv("MAX_LISTINGS_PER_SELLER"))
+	if err != nil || n < 0 {
+		return DEFAULT_MAX_LISTINGS_PER_SELLER
 	}
+	return n
+}
 
-	return float64(doubleFilteredPrices[0])
+func compareListingPrice(a, b SellerListing) int {
+	return a.Price - b.Price
 }
 
-// https://www.itl.nist.gov/div898/handbook/eda/section3/eda35h.htm - modified Z-score
-// https://eurekastatistics.com/using-the-median-absolute-deviation-to-find-outliers/
-func calculateWindowPriceMAD(prices []int, w *bufio.Writer) float64 {
-	median := prices[len(prices)/2]
-	var deviationsLeft []int
-	var deviationsRight []int
-	for _, p := range prices {
-		if p <= median {
-			diff := (median - p)
-			deviationsLeft = append(deviationsLeft, diff)
-		}
-		if p >= median {
-			diff := (p - median)
-			deviationsRight = append(deviationsRight, diff)
-		}
-	}
-
-	slices.Sort(deviationsLeft)
-	slices.Sort(deviationsRight)
-	medianDeviationLeft := deviationsLeft[len(deviationsLeft)/2]
-	medianDeviationRight := deviationsRight[len(deviationsRight)/2]
-	// if medianDeviationLeft == 0 {
-	//   return float64(median)
-	// }
-
-	mThreshold := 2.0
-
-	distances := make([]float64, len(prices))
-	var inliers []int
-	for i, x := range prices {
-		mad := 0.0
-		if x != median {
-			if x < median {
-				mad = float64(medianDeviationLeft)
-			} else if x > median {
-				mad = float64(medianDeviationRight)
-			}
-			distance := (float64(x) - float64(median)) / mad
-			if distance < 0 {
-				distance *= -1
-			}
-			distances[i] = distance
-		} else {
-			distances[i] = 0.0
+// Keeps each seller's cheapest `maxPerSeller` listings, so one account
+// listing 30 copies counts as one data point rather than 30. Listings with
+// no known seller are kept as-is and counted apart from the sellers. Returns
+// the sorted prices, their weights, the number of distinct sellers and the
+// number of listings with no known seller.
+func capListingsPerSeller(listings []SellerListing, maxPerSeller int) ([]int, []float64, int, int) {
+	bySeller := make(map[string][]SellerListing)
+	var kept []SellerListing
+	for _, listing := range listings {
+		if listing.Seller == "" {
+			kept = append(kept, listing)
+			continue
 		}
-		if distances[i] < mThreshold {
-			inliers = append(inliers, x)
+		bySeller[listing.Seller] = append(bySeller[listing.Seller], listing)
+	}
+
+	numSellers := len(bySeller)
+	numUnknown := len(kept)
+	for _, sellerListings := range bySeller {
+		if maxPerSeller > 0 && len(sellerListings) > maxPerSeller {
+			slices.SortFunc(sellerListings, compareListingPrice)
+			sellerListings = sellerListings[:maxPerSeller]
 		}
+		kept = append(kept, sellerListings...)
 	}
 
-	fmt.Fprintf(w, " - prices: %+v\n", prices)
-	fmt.Fprintf(w, " - deviations left: %+v\n", deviationsLeft)
-	fmt.Fprintf(w, " - deviations right: %+v\n", deviationsRight)
-	fmt.Fprintf(w, " - median: %d - mad (left): %d - mad (right): %d\n", median, medianDeviationLeft, medianDeviationRight)
-	fmt.Fprintf(w, " - zscores: %+v\n", distances)
-	fmt.Fprintf(w, " - inliers: %+v\n", inliers)
-	if len(inliers) > 1 {
-		return float64(inliers[1])
+	// Sorting once here rather than inserting in order keeps this O(n log n)
+	slices.SortStableFunc(kept, compareListingPrice)
+	prices := make([]int, len(kept))
+	weights := make([]float64, len(kept))
+	for i, listing := range kept {
+		prices[i] = listing.Price
+		weights[i] = listing.Weight
 	}
-	return float64(inliers[0])
+	return prices, weights, numSellers, numUnknown
 }
 
-func calculateWindowPriceClustered(prices []int, w *bufio.Writer) (float64, float64, error) {
+func toFloats(prices []int) []float64 {
 	floatPrices := make([]float64, len(prices))
 	for i, p := range prices {
 		floatPrices[i] = float64(p)
 	}
-	clusters := HCluster(floatPrices)
+	return floatPrices
+}
 
-	var inliers [][]float64
-	var minClusterSize = 3
+func calculatePriceSpread(prices []int, weights []float64) ([5]float64, float64) {
+	n := len(prices)
+	if n == 0 {
+		return [5]float64{}, 0
+	}
+	floatPrices := toFloats(prices)
+	pMin := floatPrices[0]
+	pMax := floatPrices[n-1]
+	pMed := robust.WeightedQuantile(floatPrices, weights, 0.5)
+	pQ1 := robust.WeightedQuantile(floatPrices, weights, 0.25)
+	pQ3 := robust.WeightedQuantile(floatPrices, weights, 0.75)
+	stddev := robust.WeightedStdDev(floatPrices, weights)
+
+	return [5]float64{pMin, pQ1, pMed, pQ3, pMax}, stddev
+}
 
-	for len(inliers) == 0 && minClusterSize > 0 {
-		for _, c := range clusters {
-			if len(c) >= minClusterSize {
+// Returns the window price, the confidence in it, and the inlier cluster the
+// window price was taken from
+func calculateWindowPriceClustered(prices []int, weights []float64, d *KeyDiagnostics) (float64, float64, []float64, error) {
+	if len(prices) == 0 {
+		return 0, 0, nil, errors.New("no prices")
+	}
+	result := HCluster(toFloats(prices), cutCriterion())
+	d.Dendrogram = result.Dendrogram
+	d.Silhouettes = toNullableFloats(result.Silhouettes)
+	d.CutCriterion = string(result.Criterion)
+	d.CutScores = toNullableFloats(result.CutScores)
+
+	// If no cluster at the chosen cut is big enough to trust, move to coarser
+	// cuts until one is. The root holds every listing, so this always ends.
+	minSize := minInlierClusterSize(len(prices))
+	strata := result.Strata
+	cutLevel := result.CutLevel
+	var inliers [][]float64
+	for ; cutLevel < len(strata); cutLevel++ {
+		for _, c := range strata[cutLevel] {
+			if len(c) >= minSize {
 				inliers = append(inliers, c)
 			}
 		}
-		minClusterSize--
+		if len(inliers) > 0 {
+			break
+		}
 	}
-
-	if len(inliers) == 0 {
-		fmt.Printf("clusters: %+v\n", clusters)
-		fmt.Printf("inliers: %+v\n", inliers)
-		return 0, 0, errors.New("found 0 inliers")
+	if cutLevel != result.CutLevel {
+		d.Logf("no cluster of %d+ listings at level %d, moved cut to level %d", minSize, result.CutLevel, cutLevel)
 	}
+	clusters := strata[cutLevel]
+	d.CutLevel = pgtype.Int4{Int32: int32(cutLevel), Valid: true}
 
 	for _, c := range inliers {
 		slices.Sort(c)
@@ -215,190 +246,415 @@ func calculateWindowPriceClustered(prices []int, w *bufio.Writer) (float64, floa
 		}
 	})
 
-	fmt.Fprintf(w, " - prices: %+v\n", prices)
-	fmt.Fprintf(w, " - clusters: %+v\n", clusters)
-	fmt.Fprintf(w, " - inliers: %+v\n", inliers)
+	d.Logf("clusters: %+v", clusters)
+	d.Logf("inliers: %+v", inliers)
 
 	// Use the median value of the cluster
 	// Estimate confidence as a function of the cluster size
 	targetCluster := inliers[0]
+	d.Inliers = targetCluster
 	const highConfClusterSize = 10.0
 	confidence := math.Min(float64(len(targetCluster))/highConfClusterSize, 1.0)
 
-	return targetCluster[len(targetCluster)/2], confidence, nil
+	if weights == nil {
+		return robust.Median(targetCluster), confidence, targetCluster, nil
+	}
+	return robust.WeightedQuantile(targetCluster, clusterWeights(targetCluster, prices, weights), 0.5), confidence, targetCluster, nil
+}
+
+// A cluster needs at least MIN_INLIER_CLUSTER_SIZE listings (or every
+// listing, when there are fewer) and MIN_INLIER_CLUSTER_SHARE of them to be
+// used as the inlier cluster
+func minInlierClusterSize(n int) int {
+	return max(min(MIN_INLIER_CLUSTER_SIZE, n), int(math.Ceil(MIN_INLIER_CLUSTER_SHARE*float64(n))))
+}
+
+func toNullableFloats(values []float64) []pgtype.Float8 {
+	nullable := make([]pgtype.Float8, len(values))
+	for i, v := range values {
+		nullable[i] = pgtype.Float8{Float64: v, Valid: !math.IsNaN(v) && !math.IsInf(v, 0)}
+	}
+	return nullable
 }
 
-func AggregateStats() error {
+// Clusters only carry prices, so look each member's weight back up by price.
+// Listings at the same price share their average weight.
+func clusterWeights(cluster []float64, prices []int, weights []float64) []float64 {
+	totals := make(map[float64]float64)
+	counts := make(map[float64]int)
+	for i, p := range prices {
+		totals[float64(p)] += weights[i]
+		counts[float64(p)]++
+	}
+
+	clusterWeights := make([]float64, len(cluster))
+	for i, v := range cluster {
+		clusterWeights[i] = totals[v] / float64(counts[v])
+	}
+	return clusterWeights
+}
+
+func AggregateStats(f *AggregateFlags) error {
 	start := time.Now()
-	l := log.New(os.Stdout, "[STATS]", log.Ldate|log.Ltime)
 	ctx := context.Background()
-	dbHandle, err := db.DBConnect(os.Getenv("PG_DB_CONNSTR"))
+	store, err := db.OpenStore(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer dbHandle.Close()
+	defer store.Close()
+
+	if err = store.CheckSchema(ctx); err != nil {
+		return err
+	}
+	if err = store.PreparePartitions(ctx, start); err != nil {
+		return err
+	}
 
 	client := &http.Client{Timeout: 30 * time.Second}
 	// TODO: is there a nicer way to find leagues than a hardcoded env var?
 	leagues := strings.Split(os.Getenv("LEAGUES"), ",")
+	// Every realm runs the same leagues
+	realms := []string{"pc"}
+	if os.Getenv("REALMS") != "" {
+		realms = strings.Split(os.Getenv("REALMS"), ",")
+	}
+	// poe.ninja only tracks PC's economy, so console listings are priced
+	// with PC's exchange rates
+	rates := func(league string) (map[string]float64, error) {
+		return poeninja.GetExchangeRates(client, league)
+	}
+
+	for _, realm := range realms {
+		if err = Aggregate(ctx, store, store, realm, leagues, rates, f, start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Computes a new snapshot set for every league of `realm` from the listings
+// in `jewels`, pricing them with the exchange rates returned by `rates`
+func Aggregate(ctx context.Context, jewelStore db.JewelStore, snapshotStore db.SnapshotStore, realm string, leagues []string, rates func(league string) (map[string]float64, error), f *AggregateFlags, start time.Time) error {
+	l := log.New(os.Stdout, "[STATS]["+realm+"]", log.Ldate|log.Ltime)
+
+	windowConfigs, err := LoadWindowConfigs(leagues)
+	if err != nil {
+		return err
+	}
+
+	previousSets := make(map[string]previousSet)
+	if !f.Full {
+		previousSets, err = loadPreviousSets(ctx, snapshotStore, realm, leagues)
+		if err != nil {
+			l.Printf("failed to load previous snapshot sets\n")
+			return err
+		}
+	}
 
 	exchangeRates := make(map[string]map[string]float64, len(leagues))
+	changedCurrencies := make(map[string][]string, len(leagues))
 	for _, league := range leagues {
-		rates, ratesErr := poeninja.GetExchangeRates(client, league)
+		leagueRates, ratesErr := rates(league)
 		if ratesErr != nil {
 			l.Printf("Failed to retrieve exchange rates for league %s\n", league)
-			return err
+			return ratesErr
+		}
+		exchangeRates[league] = leagueRates
+		if prev, ok := previousSets[league]; ok {
+			exchangeRates[league], changedCurrencies[league] = anchorExchangeRates(prev.Rates, leagueRates)
 		}
-		exchangeRates[league] = rates
 	}
 
 	jewelFetchStart := time.Now()
-	dateCutoff := time.Now().Add(-DATE_CUTOFF)
-	rows, _ := dbHandle.Query(ctx, "SELECT * FROM jewels WHERE league = any($1) AND recordedat > ($2)", leagues, dateCutoff)
-	defer rows.Close()
-	jewelFetchElapsed := time.Since(jewelFetchStart)
-	l.Printf("db fetch took %.3fs\n", jewelFetchElapsed.Seconds())
+	cutoffs := make(map[string]time.Time, len(leagues))
+	for _, league := range leagues {
+		cutoffs[league] = start.Add(-windowConfigs[league].Window)
+	}
+
+	// Leagues without a usable previous set are recomputed from scratch; the
+	// rest only recompute keys whose listings changed since the last run. A
+	// set computed with other window settings isn't usable, since every
+	// snapshot in it would change.
+	var fullLeagues []string
+	dirtyKeys := make(map[string]bool)
+	carriedSnapshots := make(map[string]db.DBJewelSnapshot)
+	carriedFlags := make(map[string][]db.DBFlaggedListing)
+	for _, league := range leagues {
+		prev, ok := previousSets[league]
+		if !ok || start.Sub(prev.GeneratedAt) > windowConfigs[league].Window {
+			fullLeagues = append(fullLeagues, league)
+			continue
+		}
+		if prev.Window == nil || *prev.Window != windowConfigs[league] {
+			l.Printf("%s: window settings changed since the last set, recomputing every key\n", league)
+			fullLeagues = append(fullLeagues, league)
+			continue
+		}
 
-	aggStart := time.Now()
+		leagueDirty, dirtyErr := findDirtyKeys(ctx, jewelStore, realm, league, prev, changedCurrencies[league], windowConfigs[league].Window, start)
+		if dirtyErr != nil {
+			l.Printf("failed to find changed keys for league %s\n", league)
+			return dirtyErr
+		}
+		leagueCarried, leagueFlags, carryErr := loadCarriedSnapshots(ctx, snapshotStore, realm, league, prev, leagueDirty)
+		if carryErr != nil {
+			l.Printf("failed to load previous snapshots for league %s\n", league)
+			return carryErr
+		}
+		l.Printf("%s: %d changed keys, carrying forward %d snapshots\n", league, len(leagueDirty), len(leagueCarried))
 
-	jewels, err := pgx.CollectRows(rows, pgx.RowToStructByName[db.DBJewel])
-	if err != nil {
-		l.Printf("failed to collect rows\n")
-		return err
+		for k := range leagueDirty {
+			dirtyKeys[k] = true
+		}
+		for k, s := range leagueCarried {
+			carriedSnapshots[k] = s
+		}
+		for k, flags := range leagueFlags {
+			carriedFlags[k] = flags
+		}
 	}
 
-	l.Printf("row marshalling took %.3fs\n", time.Since(aggStart).Seconds())
-	jewelPrices := make(map[string][]int)
-	seenCurrencies := make(map[string]map[string]bool)
+	var jewels []db.DBJewel
+	if len(fullLeagues) > 0 {
+		jewels, err = fetchJewels(ctx, jewelStore, realm, fullLeagues, cutoffs)
+		if err != nil {
+			l.Printf("failed to collect rows\n")
+			return err
+		}
+	}
+	if len(dirtyKeys) > 0 {
+		dirtyJewels, fetchErr := fetchJewelsForKeys(ctx, jewelStore, dirtyKeys, cutoffs)
+		if fetchErr != nil {
+			l.Printf("failed to collect rows\n")
+			return fetchErr
+		}
+		jewels = append(jewels, dirtyJewels...)
+	}
+	l.Printf("db fetch took %.3fs\n", time.Since(jewelFetchStart).Seconds())
+
+	jewelListings := make(map[string][]SellerListing)
 	for _, j := range jewels {
 
 		jKey := hashJewelKey(&j)
-		_, keyOk := jewelPrices[jKey]
 		price, priceOk := GetPriceInChaos(&j, exchangeRates[j.League])
-		if _, leagueOk := seenCurrencies[j.League]; !leagueOk {
-			seenCurrencies[j.League] = make(map[string]bool)
-		}
 		if priceOk {
-			if !keyOk {
-				jewelPrices[jKey] = []int{}
-			}
-			jewelPrices[jKey] = utils.InsertSorted(jewelPrices[jKey], price)
-			seenCurrencies[j.League][j.ListPriceCurrency] = true
+			jewelListings[jKey] = append(jewelListings[jKey], SellerListing{
+				Price:        price,
+				Seller:       j.AccountName,
+				ItemId:       j.ItemId,
+				PriceChanges: j.PriceChanges,
+				Weight:       windowConfigs[j.League].Weight(j.RecordedAt, start),
+			})
 		}
 	}
+
+	maxPerSeller := maxListingsPerSeller()
+	jewelPrices := make(map[string][]int, len(jewelListings))
+	jewelWeights := make(map[string][]float64, len(jewelListings))
+	jewelSellers := make(map[string]int, len(jewelListings))
+	capListings := func(k string) (unknown int) {
+		jewelPrices[k], jewelWeights[k], jewelSellers[k], unknown = capListingsPerSeller(jewelListings[k], maxPerSeller)
+		if windowConfigs[unhashJewelKey(k).League].HalfLife <= 0 {
+			jewelWeights[k] = nil
+		}
+		return unknown
+	}
+	numUnknownSellers := 0
+	for k := range jewelListings {
+		numUnknownSellers += capListings(k)
+	}
 	parseTime := time.Since(start)
 
 	l.Printf("Parsing %d jewels took %s\n", len(jewels), parseTime)
+	if numUnknownSellers > 0 {
+		l.Printf("%d listings have no known seller and aren't counted in numSellers\n", numUnknownSellers)
+	}
 
-	tx, err := dbHandle.BeginTx(ctx, pgx.TxOptions{})
+	diagnostics, err := NewDiagnosticsSink(os.Getenv("DIAGNOSTICS_SINK"), snapshotStore)
 	if err != nil {
+		l.Printf("failed to create diagnostics sink\n")
 		return err
 	}
-	defer tx.Rollback(ctx)
 
-	fmt.Printf("seenCurrencies:%+v\n", seenCurrencies)
-	// seenExchangeRates := make(map[string]map[string]float64)
-	setIdsByLeague := make(map[string]int)
-	for league, rates := range seenCurrencies {
-		leagueRates := make(map[string]float64)
-		for currency, cOk := range rates {
-			if cOk {
-				leagueRates[currency] = exchangeRates[league][currency]
-			}
-		}
-		var setId int
-		exchangeRatesJson, marshalErr := json.Marshal(leagueRates)
-		if marshalErr != nil {
-			l.Printf("failed to marshal exchange rates\n")
-			return err
-		}
-		err = tx.QueryRow(ctx, "INSERT INTO snapshot_sets(league, exchangeRates, generatedAt) VALUES (@league, @exchangeRates, @generatedAt) RETURNING id",
-			pgx.NamedArgs{
-				"league":        league,
-				"exchangeRates": exchangeRatesJson,
-				"generatedAt":   start,
-			}).Scan(&setId)
-		if err != nil {
-			l.Printf("failed to create new snapshot set\n")
-			return err
+	summaries := make(map[string]priceSummary, len(jewelPrices))
+	windowPrices := make(map[string]float64, len(jewelPrices)+len(carriedSnapshots))
+	for k, s := range carriedSnapshots {
+		windowPrices[k] = s.WindowPrice
+	}
+	for k, p := range jewelPrices {
+		d := &KeyDiagnostics{}
+		summary, priceErr := summarizePrices(p, jewelWeights[k], d)
+		if priceErr != nil {
+			return priceErr
 		}
-		setIdsByLeague[league] = setId
+		diagnostics.Record(k, d)
+		summaries[k] = summary
+		windowPrices[k] = summary.WindowPrice
 	}
 
-	debugFile, err := os.Create("stats.txt")
+	// Flag bait and price-fixing listings against the first-pass window
+	// price, then recompute the affected keys without them
+	history, err := loadSellerHistory(ctx, jewelStore, snapshotStore, realm, leagues, exchangeRates, windowPrices, start)
 	if err != nil {
-		l.Printf("failed to create file\n")
+		l.Printf("failed to load seller history\n")
 		return err
 	}
-	defer debugFile.Close()
-	w := bufio.NewWriter(debugFile)
-	defer w.Flush()
-
-	batch := &pgx.Batch{}
-	for k, p := range jewelPrices {
+	flaggedListings := carriedFlags
+	for k, listings := range jewelListings {
+		flagged := DetectSuspiciousListings(listings, windowPrices[k], history)
+		if len(flagged) == 0 {
+			continue
+		}
 		jData := unhashJewelKey(k)
-		fmt.Fprintf(w, "%+v\n", jData)
-		boxplot, stddev := calculatePriceSpread(p)
-		setId := setIdsByLeague[jData.League]
-		// windowPrice := calculateWindowPriceStddev(p, boxplot, stddev)
-		// windowPrice := calculateWindowPriceMAD(p, w)
-		windowPrice, confidence, priceErr := calculateWindowPriceClustered(p, w)
+		for _, f := range flagged {
+			flaggedListings[k] = append(flaggedListings[k], db.DBFlaggedListing{
+				ItemId:        f.ItemId,
+				AccountName:   f.Seller,
+				JewelType:     jData.JewelType,
+				JewelClass:    jData.JewelClass,
+				AllocatedNode: jData.AllocatedNode,
+				ChaosPrice:    float64(f.Price),
+				WindowPrice:   windowPrices[k],
+				Reasons:       f.Reasons,
+			})
+		}
+		jewelListings[k] = excludeFlagged(listings, flagged)
+		l.Printf("flagged %d listings for %s\n", len(flagged), k)
+
+		if len(jewelListings[k]) == 0 {
+			delete(jewelListings, k)
+			delete(jewelPrices, k)
+			delete(summaries, k)
+			continue
+		}
+
+		capListings(k)
+		d := &KeyDiagnostics{}
+		d.Logf("excluding %d flagged listings", len(flagged))
+		summary, priceErr := summarizePrices(jewelPrices[k], jewelWeights[k], d)
 		if priceErr != nil {
 			return priceErr
 		}
+		diagnostics.Record(k, d)
+		summaries[k] = summary
+	}
 
-		s := db.DBJewelSnapshot{
-			SetId:              setId,
+	numCarried := len(carriedSnapshots)
+	snapshots := carriedSnapshots
+	for k, summary := range summaries {
+		jData := unhashJewelKey(k)
+		snapshots[k] = db.DBJewelSnapshot{
 			JewelType:          jData.JewelType,
 			JewelClass:         jData.JewelClass,
 			AllocatedNode:      jData.AllocatedNode,
-			MinPrice:           boxplot[0],
-			FirstQuartilePrice: boxplot[1],
-			MedianPrice:        boxplot[2],
-			ThirdQuartilePrice: boxplot[3],
-			MaxPrice:           boxplot[4],
-			WindowPrice:        windowPrice,
-			Confidence:         confidence,
-			Stddev:             stddev,
-			NumListed:          len(p),
-			GeneratedAt:        start,
-		}
-
-		batch.Queue("INSERT INTO snapshots(setId,jewelType,jewelClass,allocatedNode,minPrice,firstQuartilePrice,medianPrice,thirdQuartilePrice,maxPrice,windowPrice,stddev,numListed,generatedAt) VALUES (@setId,@jewelType,@jewelClass,@allocatedNode,@minPrice,@q1Price,@medianPrice,@q3Price,@maxPrice,@windowPrice,@stddev,@numListed,@generatedAt)", pgx.NamedArgs{
-			"setId":         s.SetId,
-			"jewelType":     s.JewelType,
-			"jewelClass":    s.JewelClass,
-			"allocatedNode": s.AllocatedNode,
-			"minPrice":      s.MinPrice,
-			"q1Price":       s.FirstQuartilePrice,
-			"medianPrice":   s.MedianPrice,
-			"q3Price":       s.ThirdQuartilePrice,
-			"maxPrice":      s.MaxPrice,
-			"windowPrice":   s.WindowPrice,
-			"stddev":        s.Stddev,
-			"numListed":     s.NumListed,
-			"generatedAt":   s.GeneratedAt,
-		})
+			MinPrice:           summary.Boxplot[0],
+			FirstQuartilePrice: summary.Boxplot[1],
+			MedianPrice:        summary.Boxplot[2],
+			ThirdQuartilePrice: summary.Boxplot[3],
+			MaxPrice:           summary.Boxplot[4],
+			WindowPrice:        summary.WindowPrice,
+			Confidence:         summary.Confidence,
+			Stddev:             summary.Stddev,
+			NumListed:          len(jewelListings[k]),
+			NumSellers:         jewelSellers[k],
+			Prices:             summary.Prices,
+			InlierPrices:       summary.Inliers,
+		}
+	}
+
+	trendHistory, err := loadTrendHistory(ctx, snapshotStore, realm, leagues, start)
+	if err != nil {
+		l.Printf("failed to load snapshot history for trends\n")
+		return err
+	}
+
+	// Only currencies that are actually used are recorded on the set
+	seenCurrencies := make(map[string]map[string]bool)
+	for _, j := range jewels {
+		if _, leagueOk := seenCurrencies[j.League]; !leagueOk {
+			seenCurrencies[j.League] = make(map[string]bool)
+		}
+		seenCurrencies[j.League][j.ListPriceCurrency] = true
+	}
+	for k := range carriedSnapshots {
+		league := unhashJewelKey(k).League
+		if _, leagueOk := seenCurrencies[league]; !leagueOk {
+			seenCurrencies[league] = make(map[string]bool)
+		}
+		for currency := range previousSets[league].Rates {
+			seenCurrencies[league][currency] = true
+		}
+	}
+
+	fmt.Printf("seenCurrencies:%+v\n", seenCurrencies)
+	newSets := make(map[string]*db.NewSnapshotSet, len(seenCurrencies))
+	for league, currencies := range seenCurrencies {
+		leagueRates := make(map[string]float64)
+		for currency, cOk := range currencies {
+			if rate, rateOk := exchangeRates[league][currency]; cOk && rateOk {
+				leagueRates[currency] = rate
+			}
+		}
+		newSets[league] = &db.NewSnapshotSet{
+			Realm:         realm,
+			League:        league,
+			ExchangeRates: leagueRates,
+			GeneratedAt:   start,
+			Window:        windowConfigs[league].Window,
+			HalfLife:      windowConfigs[league].HalfLife,
+		}
+	}
+
+	for k, s := range snapshots {
+		jData := unhashJewelKey(k)
+		trend := ComputeTrend(trendHistory[k], PricePoint{start, s.WindowPrice})
+
+		s.Change1h = trend.Change1h
+		s.Change24h = trend.Change24h
+		s.Change7d = trend.Change7d
+		s.Ewma = trend.Ewma
+		s.Volatility = trend.Volatility
+		s.GeneratedAt = start
+
+		set := newSets[jData.League]
+		set.Snapshots = append(set.Snapshots, s)
 		// l.Printf("%s: %v (%f)\n", k, boxplot, stddev)
 	}
 
-	results := tx.SendBatch(ctx, batch)
-	for range jewelPrices {
-		_, err = results.Exec()
-		if err != nil {
-			fmt.Printf("failed to insert snapshot\n")
-			return err
+	numFlagged := 0
+	for k, flagged := range flaggedListings {
+		if _, ok := snapshots[k]; !ok {
+			continue
 		}
+		set := newSets[unhashJewelKey(k).League]
+		set.Flags = append(set.Flags, flagged...)
+		numFlagged += len(flagged)
+	}
+
+	sets := make([]db.NewSnapshotSet, 0, len(newSets))
+	for _, set := range newSets {
+		sets = append(sets, *set)
+	}
+	setIdsByLeague, err := snapshotStore.InsertSnapshotSets(ctx, sets)
+	if err != nil {
+		l.Printf("failed to insert snapshot sets\n")
+		return err
+	}
+
+	// Diagnostics are best-effort; losing them shouldn't fail the run
+	if err = diagnostics.Flush(ctx, setIdsByLeague, start); err != nil {
+		l.Printf("failed to write diagnostics: %s\n", err)
 	}
-	results.Close()
 
-	err = tx.Commit(ctx)
+	forecastStart := time.Now()
+	numForecasts, err := GenerateForecasts(ctx, snapshotStore, realm, setIdsByLeague, start)
 	if err != nil {
-		l.Printf("failed to commit tx\n")
+		l.Printf("failed to generate forecasts\n")
 		return err
 	}
+	l.Printf("Generated %d forecasts in %.2fs\n", numForecasts, time.Since(forecastStart).Seconds())
 
-	l.Printf("Aggregated %d listings into %d entries in %.2fs\n", len(jewels), len(jewelPrices), time.Since(start).Seconds())
+	l.Printf("Aggregated %d listings into %d entries (%d recomputed, %d carried forward, %d flagged) in %.2fs\n", len(jewels), len(snapshots), len(summaries), numCarried, numFlagged, time.Since(start).Seconds())
 
 	return nil
 }
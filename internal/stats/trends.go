@@ -0,0 +1,114 @@
+package stats
+
+import (
+	"context"
+	"math"
+	"time"
+
+	db "github.com/faideww/ffff/internal/db"
+	"github.com/faideww/ffff/internal/stats/robust"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// How much snapshot history to load when computing trends. Slightly more
+// than the longest change horizon so the 7d comparison has something to
+// match against.
+const TREND_LOOKBACK = 8 * 24 * time.Hour
+
+// Half-life of the exponentially weighted moving average of window prices
+const TREND_EWMA_HALF_LIFE = 12 * time.Hour
+
+type PricePoint struct {
+	At    time.Time
+	Price float64
+}
+
+type Trend struct {
+	// Relative change of the window price over each horizon (0.1 = +10%).
+	// Null when there is no snapshot close enough to the horizon to compare
+	// against.
+	Change1h  pgtype.Float8
+	Change24h pgtype.Float8
+	Change7d  pgtype.Float8
+	// Time-weighted EWMA of the window price, including the current value
+	Ewma float64
+	// Standard deviation of log returns between successive snapshots,
+	// normalised to a one-day horizon
+	Volatility float64
+}
+
+// Loads previous window prices for every key in the realm's given leagues,
+// ordered oldest first
+func loadTrendHistory(ctx context.Context, store db.SnapshotStore, realm string, leagues []string, now time.Time) (map[string][]PricePoint, error) {
+	points, err := store.SnapshotHistory(ctx, realm, leagues, now.Add(-TREND_LOOKBACK))
+	if err != nil {
+		return nil, err
+	}
+
+	history := make(map[string][]PricePoint)
+	for _, p := range points {
+		k := hashKey(p.Key)
+		history[k] = append(history[k], PricePoint{p.GeneratedAt, p.WindowPrice})
+	}
+	return history, nil
+}
+
+// Compares the current window price against earlier snapshots of the same key
+func ComputeTrend(history []PricePoint, current PricePoint) Trend {
+	points := append(history[:len(history):len(history)], current)
+
+	t := Trend{
+		Change1h:  priceChange(history, current, time.Hour),
+		Change24h: priceChange(history, current, 24*time.Hour),
+		Change7d:  priceChange(history, current, 7*24*time.Hour),
+	}
+
+	// Snapshots aren't evenly spaced, so decay by elapsed time rather than
+	// by sample count
+	t.Ewma = points[0].Price
+	for i := 1; i < len(points); i++ {
+		dt := points[i].At.Sub(points[i-1].At)
+		alpha := 1 - math.Exp(-math.Ln2*dt.Hours()/TREND_EWMA_HALF_LIFE.Hours())
+		t.Ewma += alpha * (points[i].Price - t.Ewma)
+	}
+
+	var returns []float64
+	for i := 1; i < len(points); i++ {
+		prev, curr := points[i-1], points[i]
+		days := curr.At.Sub(prev.At).Hours() / 24
+		if prev.Price <= 0 || curr.Price <= 0 || days <= 0 {
+			continue
+		}
+		returns = append(returns, math.Log(curr.Price/prev.Price)/math.Sqrt(days))
+	}
+	if len(returns) > 1 {
+		t.Volatility = robust.StdDev(returns)
+	}
+
+	return t
+}
+
+// Finds the snapshot closest to `horizon` ago (within half the horizon
+// either side) and returns the relative change since then
+func priceChange(history []PricePoint, current PricePoint, horizon time.Duration) pgtype.Float8 {
+	target := current.At.Add(-horizon)
+	tolerance := horizon / 2
+
+	var best *PricePoint
+	bestDist := time.Duration(math.MaxInt64)
+	for i := range history {
+		dist := history[i].At.Sub(target)
+		if dist < 0 {
+			dist = -dist
+		}
+		if dist <= tolerance && dist < bestDist {
+			best = &history[i]
+			bestDist = dist
+		}
+	}
+
+	if best == nil || best.Price <= 0 {
+		return pgtype.Float8{}
+	}
+	return pgtype.Float8{Float64: (current.Price - best.Price) / best.Price, Valid: true}
+}
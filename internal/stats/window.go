@@ -0,0 +1,107 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// Listings older than the window are ignored entirely. Fresh leagues move
+// fast enough that 6h is plenty; late in a league a week may be needed to
+// see enough listings.
+const DEFAULT_WINDOW = 48 * time.Hour
+
+// Time window and recency weighting used when aggregating a league
+type WindowConfig struct {
+	Window time.Duration
+	// Listings lose half their weight every HalfLife. 0 disables recency
+	// weighting, so every listing inside the window counts equally.
+	HalfLife time.Duration
+}
+
+// Reads the per-league window configuration from the environment.
+//
+//	STATS_WINDOW=48h                       default window for every league
+//	STATS_HALF_LIFE=12h                    default half-life (unset = no weighting)
+//	STATS_LEAGUE_WINDOWS=Settlers=6h,Standard=168h
+//	STATS_LEAGUE_HALF_LIVES=Settlers=2h
+func LoadWindowConfigs(leagues []string) (map[string]WindowConfig, error) {
+	defaults := WindowConfig{Window: DEFAULT_WINDOW}
+
+	var err error
+	if v := os.Getenv("STATS_WINDOW"); v != "" {
+		if defaults.Window, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid STATS_WINDOW: %w", err)
+		}
+	}
+	if v := os.Getenv("STATS_HALF_LIFE"); v != "" {
+		if defaults.HalfLife, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid STATS_HALF_LIFE: %w", err)
+		}
+	}
+
+	windows, err := parseLeagueDurations(os.Getenv("STATS_LEAGUE_WINDOWS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid STATS_LEAGUE_WINDOWS: %w", err)
+	}
+	halfLives, err := parseLeagueDurations(os.Getenv("STATS_LEAGUE_HALF_LIVES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid STATS_LEAGUE_HALF_LIVES: %w", err)
+	}
+
+	configs := make(map[string]WindowConfig, len(leagues))
+	for _, league := range leagues {
+		c := defaults
+		if d, ok := windows[league]; ok {
+			c.Window = d
+		}
+		if d, ok := halfLives[league]; ok {
+			c.HalfLife = d
+		}
+		if c.Window <= 0 {
+			return nil, fmt.Errorf("window for league %s must be positive", league)
+		}
+		configs[league] = c
+	}
+
+	return configs, nil
+}
+
+// Parses "League A=6h,League B=168h"
+func parseLeagueDurations(s string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	if s == "" {
+		return durations, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		league, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected League=duration, got %q", entry)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		durations[strings.TrimSpace(league)] = d
+	}
+
+	return durations, nil
+}
+
+// Weight of a listing last recorded at `recordedAt`. Because the decay is
+// exponential, letting time pass scales every weight by the same factor,
+// which leaves weighted quantiles unchanged - so snapshots carried forward
+// by the incremental aggregation stay valid.
+func (c WindowConfig) Weight(recordedAt, now time.Time) float64 {
+	if c.HalfLife <= 0 {
+		return 1
+	}
+	age := now.Sub(recordedAt)
+	if age < 0 {
+		age = 0
+	}
+	return math.Exp(-math.Ln2 * age.Hours() / c.HalfLife.Hours())
+}